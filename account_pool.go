@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/tokens"
+	official_types "freechatgpt/typings/official"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	cooldownBase = 30 * time.Second
+	cooldownMax  = 30 * time.Minute
+)
+
+// accountUnit is one capacity unit of an account, team accounts have a personal and a team unit
+type accountUnit struct {
+	Account  string
+	Team     bool
+	Weight   int
+	InFlight int
+	Failures int
+	// CooldownUntil is set when upstream rejected the unit, it is skipped until then
+	CooldownUntil time.Time
+	LastError     string
+}
+
+func (u *accountUnit) available(now time.Time) bool {
+	return now.After(u.CooldownUntil)
+}
+
+// plan names the model list of the unit
+func (u *accountUnit) plan() string {
+	if u.Team {
+		return "team"
+	}
+	return "personal"
+}
+
+// AccountPool selects the account serving each request. Strategies are round_robin, which uses
+// each unit as many times in a row as its weight from accounts.txt, least_loaded and random.
+type AccountPool struct {
+	lock     sync.Mutex
+	strategy string
+	units    []*accountUnit
+	// next is the round robin position and used the uses of that unit so far
+	next int
+	used int
+}
+
+// AccountLease is an account in use by a request, it must be released once the request is done
+type AccountLease struct {
+	Account string
+	Secret  tokens.Secret
+	pool    *AccountPool
+	unit    *accountUnit
+}
+
+var accountPool = NewAccountPool("round_robin")
+
+func NewAccountPool(strategy string) *AccountPool {
+	return &AccountPool{strategy: strategy}
+}
+
+func (p *AccountPool) SetStrategy(strategy string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.strategy = strategy
+}
+
+// accountWeights returns the personal and team weights of an account
+func accountWeights(account string, has_team bool) (int, int) {
+	personal, team := 1, 0
+	if info, ok := getAccount(account); ok && len(info.Times) != 0 {
+		personal = info.Times[0]
+		if len(info.Times) == 2 {
+			team = info.Times[1]
+		}
+	}
+	if !has_team {
+		team = 0
+	}
+	return personal, team
+}
+
+// Add registers an account or updates its units, the health of existing units is kept
+func (p *AccountPool) Add(account string, has_team bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.add(account, has_team)
+}
+
+func (p *AccountPool) add(account string, has_team bool) {
+	personal, team := accountWeights(account, has_team)
+	p.setUnit(account, true, team)
+	p.setUnit(account, false, personal)
+}
+
+func (p *AccountPool) setUnit(account string, team bool, weight int) {
+	for i, unit := range p.units {
+		if unit.Account == account && unit.Team == team {
+			if weight == 0 {
+				p.units = append(p.units[:i], p.units[i+1:]...)
+				p.next, p.used = 0, 0
+			} else {
+				unit.Weight = weight
+			}
+			return
+		}
+	}
+	if weight != 0 {
+		p.units = append(p.units, &accountUnit{Account: account, Team: team, Weight: weight})
+	}
+}
+
+func (p *AccountPool) Remove(account string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.setUnit(account, true, 0)
+	p.setUnit(account, false, 0)
+}
+
+// Reset replaces the accounts of the pool
+func (p *AccountPool) Reset(secrets map[string]tokens.Secret) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	units := p.units
+	p.units = nil
+	p.next, p.used = 0, 0
+	for account, secret := range secrets {
+		p.add(account, secret.TeamUserID != "")
+	}
+	// Units which stay are kept with their health, their leases release against them
+	for i, unit := range p.units {
+		for _, old := range units {
+			if unit.Account == old.Account && unit.Team == old.Team {
+				old.Weight = unit.Weight
+				p.units[i] = old
+			}
+		}
+	}
+}
+
+// Units returns a copy of the units of an account
+func (p *AccountPool) Units(account string) []accountUnit {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var units []accountUnit
+	for _, unit := range p.units {
+		if unit.Account == account {
+			units = append(units, *unit)
+		}
+	}
+	return units
+}
+
+// Accounts returns the accounts of the pool
+func (p *AccountPool) Accounts() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var list []string
+	for _, unit := range p.units {
+		list = AppendIfNone(list, unit.Account)
+	}
+	return list
+}
+
+// Healthy returns the number of accounts with a unit outside its cooldown and of all accounts
+func (p *AccountPool) Healthy() (int, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	var healthy, all []string
+	for _, unit := range p.units {
+		all = AppendIfNone(all, unit.Account)
+		if unit.available(now) {
+			healthy = AppendIfNone(healthy, unit.Account)
+		}
+	}
+	return len(healthy), len(all)
+}
+
+func (p *AccountPool) Contains(account string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, unit := range p.units {
+		if unit.Account == account {
+			return true
+		}
+	}
+	return false
+}
+
+// Acquire selects a healthy unit whose plan serves the model slug, limited to allowed accounts if
+// not empty and skipping the excluded accounts. An empty slug fits any unit. An empty pool serves
+// anonymously. If no unit is available it returns nil with the time until one leaves its cooldown.
+func (p *AccountPool) Acquire(slug string, allowed []string, exclude []string) (*AccountLease, time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.units) == 0 && len(allowed) == 0 {
+		return &AccountLease{}, 0
+	}
+	now := time.Now()
+	var candidates []int
+	wait := time.Duration(0)
+	for i, unit := range p.units {
+		if len(allowed) != 0 && !containsString(allowed, unit.Account) || containsString(exclude, unit.Account) {
+			continue
+		}
+		if slug != "" && !chatgpt.PlanServes(unit.Account, unit.plan(), slug) {
+			continue
+		}
+		if !unit.available(now) {
+			if until := unit.CooldownUntil.Sub(now); wait == 0 || until < wait {
+				wait = until
+			}
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		return nil, wait
+	}
+	var unit *accountUnit
+	switch p.strategy {
+	case "least_loaded":
+		unit = p.leastLoaded(candidates)
+	case "random":
+		unit = p.random(candidates)
+	default:
+		unit = p.roundRobin(candidates)
+	}
+	return p.lease(unit), 0
+}
+
+// AcquireAccount leases the unit of a given account, used to continue its conversations. It
+// returns nil while the unit cools down.
+func (p *AccountPool) AcquireAccount(account string, team bool) *AccountLease {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for _, unit := range p.units {
+		if unit.Account == account && unit.Team == team && unit.available(now) {
+			return p.lease(unit)
+		}
+	}
+	return nil
+}
+
+func (p *AccountPool) lease(unit *accountUnit) *AccountLease {
+	unit.InFlight++
+	secret := ACCESS_TOKENS.GetSecret(unit.Account)
+	if !unit.Team {
+		secret.TeamUserID = ""
+	}
+	return &AccountLease{Account: unit.Account, Secret: secret, pool: p, unit: unit}
+}
+
+func (p *AccountPool) roundRobin(candidates []int) *accountUnit {
+	for tries := 0; tries <= len(p.units); tries++ {
+		if p.next >= len(p.units) {
+			p.next, p.used = 0, 0
+		}
+		unit := p.units[p.next]
+		if p.used < unit.Weight && containsInt(candidates, p.next) {
+			p.used++
+			return unit
+		}
+		p.next++
+		p.used = 0
+	}
+	return p.units[candidates[0]]
+}
+
+func (p *AccountPool) leastLoaded(candidates []int) *accountUnit {
+	// Start after the last pick so that idle units take turns
+	var best *accountUnit
+	for i := range p.units {
+		idx := (p.next + i) % len(p.units)
+		if !containsInt(candidates, idx) {
+			continue
+		}
+		unit := p.units[idx]
+		if best == nil || unit.InFlight*best.Weight < best.InFlight*unit.Weight {
+			best = unit
+		}
+	}
+	p.next = (p.next + 1) % len(p.units)
+	return best
+}
+
+func (p *AccountPool) random(candidates []int) *accountUnit {
+	total := 0
+	for _, idx := range candidates {
+		total += p.units[idx].Weight
+	}
+	pick := rand.Intn(total)
+	for _, idx := range candidates {
+		pick -= p.units[idx].Weight
+		if pick < 0 {
+			return p.units[idx]
+		}
+	}
+	return p.units[candidates[0]]
+}
+
+func containsInt(slice []int, i int) bool {
+	for _, ele := range slice {
+		if ele == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Release ends the lease. Upstream rejecting the account with an expired token, a rate limit or
+// a login requirement puts it in an exponentially growing cooldown, a success resets it.
+func (l *AccountLease) Release(err error) {
+	if l == nil || l.unit == nil {
+		return
+	}
+	p := l.pool
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	l.unit.InFlight--
+	var api_err *official_types.APIError
+	if err == nil {
+		l.unit.Failures = 0
+		return
+	}
+	if !errors.As(err, &api_err) {
+		return
+	}
+	if api_err.Type == "server_error" || api_err.Status == 429 {
+		l.unit.LastError = api_err.Message
+	}
+	switch api_err.Code {
+	case "upstream_token_expired", "login_required":
+		// The token belongs to the account, both of its units fail
+		for _, unit := range p.units {
+			if unit.Account == l.unit.Account {
+				p.cooldown(unit, "")
+			}
+		}
+	case "rate_limit_exceeded":
+		p.cooldown(l.unit, api_err.RetryAfter)
+	}
+}
+
+func (p *AccountPool) cooldown(unit *accountUnit, retry_after string) {
+	unit.Failures++
+	duration := cooldownBase << (unit.Failures - 1)
+	if duration > cooldownMax || duration <= 0 {
+		duration = cooldownMax
+	}
+	if seconds, err := strconv.Atoi(retry_after); err == nil && time.Duration(seconds)*time.Second > duration {
+		duration = time.Duration(seconds) * time.Second
+	}
+	unit.CooldownUntil = time.Now().Add(duration)
+	slog.Warn("Account cooling down", "account", unit.Account, "team", unit.Team, "duration", duration)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/tokens"
+	official_types "freechatgpt/typings/official"
+	"testing"
+	"time"
+)
+
+// setAccounts replaces accounts.txt for the duration of a test
+func setAccounts(t *testing.T, list map[string]AccountInfo) {
+	t.Helper()
+	accounts_lock.Lock()
+	saved := accounts
+	accounts = list
+	accounts_lock.Unlock()
+	t.Cleanup(func() {
+		accounts_lock.Lock()
+		accounts = saved
+		accounts_lock.Unlock()
+	})
+}
+
+// newTestPool returns a pool with personal units of the accounts weighted by accounts.txt
+func newTestPool(strategy string, names ...string) *AccountPool {
+	pool := NewAccountPool(strategy)
+	for _, name := range names {
+		pool.Add(name, false)
+	}
+	return pool
+}
+
+func TestAccountPoolStrategies(t *testing.T) {
+	setAccounts(t, map[string]AccountInfo{"a": {Times: []int{2}}, "b": {Times: []int{1}}})
+	tests := []struct {
+		strategy string
+		// hold keeps every lease until the end of the test
+		hold bool
+		want []string
+	}{
+		{"round_robin", false, []string{"a", "a", "b", "a", "a", "b"}},
+		{"round_robin", true, []string{"a", "a", "b", "a", "a", "b"}},
+		{"least_loaded", false, []string{"a", "b", "a", "b"}},
+		{"least_loaded", true, []string{"a", "b", "a", "b", "a", "a"}},
+	}
+	for _, test := range tests {
+		name := test.strategy
+		if test.hold {
+			name += " holding leases"
+		}
+		t.Run(name, func(t *testing.T) {
+			pool := newTestPool(test.strategy, "a", "b")
+			for i, want := range test.want {
+				lease, _ := pool.Acquire("", nil, nil)
+				if lease == nil || lease.Account != want {
+					t.Fatalf("pick %d is %+v, want %s", i, lease, want)
+				}
+				if !test.hold {
+					lease.Release(nil)
+				}
+			}
+		})
+	}
+}
+
+func TestAccountPoolRandom(t *testing.T) {
+	setAccounts(t, map[string]AccountInfo{"a": {Times: []int{1}}, "b": {Times: []int{3}}})
+	pool := newTestPool("random", "a", "b")
+	picks := map[string]int{}
+	for i := 0; i < 400; i++ {
+		lease, _ := pool.Acquire("", nil, nil)
+		picks[lease.Account]++
+		lease.Release(nil)
+	}
+	if picks["a"] == 0 || picks["b"] <= picks["a"] {
+		t.Errorf("picks %v do not follow the weights 1:3", picks)
+	}
+}
+
+func TestAccountPoolAcquire(t *testing.T) {
+	setAccounts(t, nil)
+	tests := []struct {
+		name     string
+		accounts []string
+		cooling  []string
+		allowed  []string
+		exclude  []string
+		// want is the account leased, "-" for none
+		want string
+	}{
+		{"empty pool serves anonymously", nil, nil, nil, nil, ""},
+		{"empty pool with allowed accounts", nil, nil, []string{"a"}, nil, "-"},
+		{"allowed", []string{"a", "b"}, nil, []string{"b"}, nil, "b"},
+		{"excluded", []string{"a", "b"}, nil, nil, []string{"a"}, "b"},
+		{"cooling down", []string{"a", "b"}, []string{"a"}, nil, nil, "b"},
+		{"all cooling down", []string{"a"}, []string{"a"}, nil, nil, "-"},
+		{"all excluded", []string{"a", "b"}, nil, nil, []string{"a", "b"}, "-"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestPool("round_robin", test.accounts...)
+			for _, unit := range pool.units {
+				if containsString(test.cooling, unit.Account) {
+					unit.CooldownUntil = time.Now().Add(time.Minute)
+				}
+			}
+			lease, wait := pool.Acquire("", test.allowed, test.exclude)
+			if test.want == "-" {
+				if lease != nil {
+					t.Fatalf("leased %s", lease.Account)
+				}
+				if len(test.cooling) != 0 && (wait <= 0 || wait > time.Minute) {
+					t.Errorf("wait %v", wait)
+				}
+				return
+			}
+			if lease == nil || lease.Account != test.want {
+				t.Fatalf("leased %+v, want %q", lease, test.want)
+			}
+		})
+	}
+}
+
+func TestAccountPoolAcquireModel(t *testing.T) {
+	setAccounts(t, nil)
+	chatgpt.SetPlanModels("a", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini"}})
+	chatgpt.SetPlanModels("b", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini"}, {Slug: "o1"}})
+	t.Cleanup(func() { chatgpt.RetainPlanModels(map[string]bool{}) })
+	tests := []struct {
+		slug string
+		want []string
+	}{
+		{"", []string{"a", "b", "c"}},
+		{"gpt-4o-mini", []string{"a", "b", "c"}},
+		// c has no model list yet and is left to upstream
+		{"o1", []string{"b", "c"}},
+		{"gpt-5", []string{"c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.slug, func(t *testing.T) {
+			pool := newTestPool("round_robin", "a", "b", "c")
+			var got []string
+			for range []string{"a", "b", "c"} {
+				lease, _ := pool.Acquire(test.slug, nil, got)
+				if lease == nil {
+					break
+				}
+				got = append(got, lease.Account)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("leased %v, want %v", got, test.want)
+			}
+			for _, account := range test.want {
+				if !containsString(got, account) {
+					t.Errorf("leased %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAccountLeaseRelease(t *testing.T) {
+	setAccounts(t, map[string]AccountInfo{"a": {Times: []int{1, 1}}})
+	expired := official_types.UpstreamError(503, "upstream_token_expired", "expired")
+	limited := official_types.RateLimitError("slow down")
+	limited.RetryAfter = "3600"
+	tests := []struct {
+		name string
+		err  error
+		// cooling are the units of a cooling down after the release, personal then team
+		cooling  [2]bool
+		failures int
+		atLeast  time.Duration
+	}{
+		{"success", nil, [2]bool{false, false}, 0, 0},
+		{"other error", errors.New("broken"), [2]bool{false, false}, 0, 0},
+		{"bad request", official_types.InvalidRequestError("messages", "bad"), [2]bool{false, false}, 0, 0},
+		{"expired token", expired, [2]bool{true, true}, 1, cooldownBase},
+		{"rate limit", limited, [2]bool{true, false}, 1, time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := NewAccountPool("round_robin")
+			pool.Add("a", true)
+			lease := pool.AcquireAccount("a", false)
+			lease.Release(test.err)
+			for _, unit := range pool.Units("a") {
+				index := 0
+				if unit.Team {
+					index = 1
+				}
+				if unit.InFlight != 0 {
+					t.Errorf("unit %+v still in flight", unit)
+				}
+				cooling := !unit.available(time.Now())
+				if cooling != test.cooling[index] {
+					t.Errorf("unit %+v cooling %v, want %v", unit, cooling, test.cooling[index])
+				}
+				if cooling && time.Until(unit.CooldownUntil) < test.atLeast-time.Second {
+					t.Errorf("unit %+v cools down shorter than %v", unit, test.atLeast)
+				}
+				if !unit.Team && unit.Failures != test.failures {
+					t.Errorf("unit %+v has %d failures, want %d", unit, unit.Failures, test.failures)
+				}
+			}
+			if test.cooling[0] && pool.AcquireAccount("a", false) != nil {
+				t.Error("leased a cooling unit")
+			}
+		})
+	}
+}
+
+func TestAccountPoolReset(t *testing.T) {
+	setAccounts(t, nil)
+	pool := newTestPool("round_robin", "a", "b")
+	lease := pool.AcquireAccount("a", false)
+	pool.Reset(map[string]tokens.Secret{"a": {Token: "t"}, "c": {Token: "t"}})
+	if accounts := pool.Accounts(); len(accounts) != 2 || !containsString(accounts, "a") || !containsString(accounts, "c") {
+		t.Fatalf("accounts %v after reset", accounts)
+	}
+	if units := pool.Units("a"); len(units) != 1 || units[0].InFlight != 1 {
+		t.Fatalf("units of a %+v, the lease must stay counted", units)
+	}
+	lease.Release(nil)
+	if units := pool.Units("a"); units[0].InFlight != 0 {
+		t.Errorf("units of a %+v after release", units)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	official_types "freechatgpt/typings/official"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin handlers for accounts, API keys, proxies and access tokens. Changes are written to
+// their files atomically and take effect at once.
+
+func notFoundError(message string) *official_types.APIError {
+	return official_types.NewAPIError(404, "invalid_request_error", "not_found", message)
+}
+
+type accountView struct {
+	Email          string     `json:"email"`
+	Times          []int      `json:"times"`
+	HasToken       bool       `json:"has_token"`
+	Team           bool       `json:"team"`
+	TokenExpiresAt *time.Time `json:"token_expires_at,omitempty"`
+	InFlight       int        `json:"in_flight"`
+	Failures       int        `json:"failures"`
+	CooldownUntil  *time.Time `json:"cooldown_until,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+func viewAccount(email string, info AccountInfo) accountView {
+	view := accountView{Email: email, Times: info.Times}
+	secret := ACCESS_TOKENS.GetSecret(email)
+	if secret.Token != "" {
+		view.HasToken = true
+		view.Team = secret.TeamUserID != ""
+		if expire, err := getTokenExpire(secret.Token); err == nil {
+			view.TokenExpiresAt = &expire
+		}
+	}
+	for _, unit := range accountPool.Units(email) {
+		view.InFlight += unit.InFlight
+		view.Failures += unit.Failures
+		if unit.CooldownUntil.After(time.Now()) && (view.CooldownUntil == nil || unit.CooldownUntil.After(*view.CooldownUntil)) {
+			cooldown := unit.CooldownUntil
+			view.CooldownUntil = &cooldown
+		}
+		if unit.LastError != "" {
+			view.LastError = unit.LastError
+		}
+	}
+	if login_error := getLoginError(email); login_error != "" {
+		view.LastError = login_error
+	}
+	return view
+}
+
+func listAccountsHandler(c *gin.Context) {
+	snapshot := accountsSnapshot()
+	list := []accountView{}
+	for email, info := range snapshot {
+		list = append(list, viewAccount(email, info))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Email < list[j].Email
+	})
+	c.JSON(200, gin.H{"object": "list", "data": list})
+}
+
+func getAccountHandler(c *gin.Context) {
+	email := c.Param("email")
+	info, ok := getAccount(email)
+	if !ok {
+		abortWithError(c, notFoundError("No account "+email))
+		return
+	}
+	c.JSON(200, viewAccount(email, info))
+}
+
+type accountRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Times    []int  `json:"times"`
+}
+
+func validTimes(times []int) bool {
+	if len(times) > 2 {
+		return false
+	}
+	for _, t := range times {
+		if t < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// createAccountHandler adds an account and logs it in in the background
+func createAccountHandler(c *gin.Context) {
+	var request accountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	if request.Email == "" || request.Password == "" || strings.Contains(request.Email, ":") {
+		abortWithError(c, official_types.InvalidRequestError("email", "email and password are required, email must not contain ':'"))
+		return
+	}
+	if !validTimes(request.Times) {
+		abortWithError(c, official_types.InvalidRequestError("times", "times takes a personal and an optional team weight of at least 1"))
+		return
+	}
+	if len(request.Times) == 0 {
+		request.Times = []int{1}
+	}
+	accounts_lock.Lock()
+	if _, ok := accounts[request.Email]; ok {
+		accounts_lock.Unlock()
+		abortWithError(c, official_types.NewAPIError(409, "invalid_request_error", "already_exists", "Account "+request.Email+" already exists"))
+		return
+	}
+	accounts[request.Email] = AccountInfo{Password: request.Password, Times: request.Times}
+	accounts_lock.Unlock()
+	if err := saveAccounts(); err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save accounts.txt: "+err.Error()))
+		return
+	}
+	go func() {
+		updateSingleToken(request.Email, request.Password, nil, true)
+		refreshModels()
+	}()
+	info, _ := getAccount(request.Email)
+	c.JSON(201, viewAccount(request.Email, info))
+}
+
+// updateAccountHandler changes the password or weights of an account, a new password logs in again
+func updateAccountHandler(c *gin.Context) {
+	email := c.Param("email")
+	var request accountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	if !validTimes(request.Times) {
+		abortWithError(c, official_types.InvalidRequestError("times", "times takes a personal and an optional team weight of at least 1"))
+		return
+	}
+	accounts_lock.Lock()
+	info, ok := accounts[email]
+	if !ok {
+		accounts_lock.Unlock()
+		abortWithError(c, notFoundError("No account "+email))
+		return
+	}
+	relogin := request.Password != "" && request.Password != info.Password
+	if request.Password != "" {
+		info.Password = request.Password
+	}
+	if len(request.Times) != 0 {
+		info.Times = request.Times
+	}
+	accounts[email] = info
+	accounts_lock.Unlock()
+	if err := saveAccounts(); err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save accounts.txt: "+err.Error()))
+		return
+	}
+	if accountPool.Contains(email) {
+		accountPool.Add(email, ACCESS_TOKENS.GetSecret(email).TeamUserID != "")
+	}
+	if relogin {
+		go updateSingleToken(email, info.Password, nil, true)
+	}
+	c.JSON(200, viewAccount(email, info))
+}
+
+func deleteAccountHandler(c *gin.Context) {
+	email := c.Param("email")
+	accounts_lock.Lock()
+	_, ok := accounts[email]
+	delete(accounts, email)
+	delete(login_errors, email)
+	accounts_lock.Unlock()
+	if !ok {
+		abortWithError(c, notFoundError("No account "+email))
+		return
+	}
+	if err := saveAccounts(); err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save accounts.txt: "+err.Error()))
+		return
+	}
+	ACCESS_TOKENS.Delete(email)
+	ACCESS_TOKENS.Save()
+	accountPool.Remove(email)
+	go refreshModels()
+	c.JSON(200, gin.H{"id": email, "deleted": true})
+}
+
+type keyView struct {
+	*APIKey
+	Hash           string `json:"hash,omitempty"`
+	Key            string `json:"key,omitempty"`
+	RequestsMinute int    `json:"requests_this_minute"`
+	TokensToday    int    `json:"tokens_today"`
+}
+
+// viewKey shows a key with its usage, the hash is left out
+func viewKey(api_key *APIKey) keyView {
+	requests, tokens := keyStore.Usage(api_key.Hash)
+	return keyView{APIKey: api_key, RequestsMinute: requests, TokensToday: tokens}
+}
+
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:3] + "..." + key[len(key)-4:]
+}
+
+func listKeysHandler(c *gin.Context) {
+	list := []keyView{}
+	for _, api_key := range keyStore.List() {
+		list = append(list, viewKey(api_key))
+	}
+	c.JSON(200, gin.H{"object": "list", "data": list})
+}
+
+// keyRequest holds the settings of a key, fields left out are not changed by an update
+type keyRequest struct {
+	Key       string    `json:"key"`
+	Name      *string   `json:"name"`
+	Models    *[]string `json:"models"`
+	Endpoints *[]string `json:"endpoints"`
+	RPM       *int      `json:"rpm"`
+	TPD       *int      `json:"tpd"`
+	ExpiresAt *string   `json:"expires_at"`
+	Disabled  *bool     `json:"disabled"`
+}
+
+var keyEndpoints = []string{"chat", "completions", "responses", "messages", "files", "speech", "transcriptions", "models"}
+
+func (r *keyRequest) validate() error {
+	if r.Endpoints != nil {
+		for _, endpoint := range *r.Endpoints {
+			if !containsString(keyEndpoints, endpoint) {
+				return official_types.InvalidRequestError("endpoints", "Unknown endpoint "+endpoint+", endpoints are "+strings.Join(keyEndpoints, ", "))
+			}
+		}
+	}
+	if r.ExpiresAt != nil && *r.ExpiresAt != "" {
+		if _, err := time.Parse(time.RFC3339, *r.ExpiresAt); err != nil {
+			return official_types.InvalidRequestError("expires_at", "expires_at must be an RFC 3339 time or empty")
+		}
+	}
+	if r.RPM != nil && *r.RPM < 0 || r.TPD != nil && *r.TPD < 0 {
+		return official_types.InvalidRequestError("rpm", "Limits must not be negative")
+	}
+	return nil
+}
+
+func (r *keyRequest) apply(api_key *APIKey) {
+	if r.Name != nil {
+		api_key.Name = *r.Name
+	}
+	if r.Models != nil {
+		api_key.Models = *r.Models
+	}
+	if r.Endpoints != nil {
+		api_key.Endpoints = *r.Endpoints
+	}
+	if r.RPM != nil {
+		api_key.RPM = *r.RPM
+	}
+	if r.TPD != nil {
+		api_key.TPD = *r.TPD
+	}
+	if r.ExpiresAt != nil {
+		api_key.ExpiresAt = nil
+		if expires_at, err := time.Parse(time.RFC3339, *r.ExpiresAt); err == nil {
+			api_key.ExpiresAt = &expires_at
+		}
+	}
+	if r.Disabled != nil {
+		api_key.Disabled = *r.Disabled
+	}
+}
+
+// createKeyHandler adds the given key or generates one, the key is only returned here
+func createKeyHandler(c *gin.Context) {
+	var request keyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			abortWithError(c, invalidJSONError(err))
+			return
+		}
+	}
+	if err := request.validate(); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if request.Key == "" {
+		random := make([]byte, 24)
+		rand.Read(random)
+		request.Key = hex.EncodeToString(random)
+	}
+	if strings.ContainsAny(request.Key, " \r\n") {
+		abortWithError(c, official_types.InvalidRequestError("key", "key must not contain whitespace"))
+		return
+	}
+	if keyStore.Lookup(request.Key) != nil {
+		abortWithError(c, official_types.NewAPIError(409, "invalid_request_error", "already_exists", "The key exists"))
+		return
+	}
+	api_key := NewAPIKey(request.Key)
+	request.apply(api_key)
+	if err := keyStore.Add(api_key); err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save "+apiKeysFile+": "+err.Error()))
+		return
+	}
+	view := viewKey(api_key)
+	view.Key = request.Key
+	c.JSON(201, view)
+}
+
+func getKeyHandler(c *gin.Context) {
+	id := c.Param("id")
+	for _, api_key := range keyStore.List() {
+		if api_key.ID == id {
+			c.JSON(200, viewKey(api_key))
+			return
+		}
+	}
+	abortWithError(c, notFoundError("No API key "+id))
+}
+
+// updateKeyHandler changes the scopes, limits, expiry or disabled flag of a key
+func updateKeyHandler(c *gin.Context) {
+	id := c.Param("id")
+	var request keyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	if err := request.validate(); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	api_key, found, err := keyStore.Update(id, request.apply)
+	if !found {
+		abortWithError(c, notFoundError("No API key "+id))
+		return
+	}
+	if err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save "+apiKeysFile+": "+err.Error()))
+		return
+	}
+	c.JSON(200, viewKey(api_key))
+}
+
+func deleteKeyHandler(c *gin.Context) {
+	id := c.Param("id")
+	found, err := keyStore.Delete(id)
+	if !found {
+		abortWithError(c, notFoundError("No API key "+id))
+		return
+	}
+	if err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save "+apiKeysFile+": "+err.Error()))
+		return
+	}
+	c.JSON(200, gin.H{"id": id, "deleted": true})
+}
+
+func createProxyHandler(c *gin.Context) {
+	var request struct {
+		URL string `json:"url"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	proxy_url, err := parseProxy(strings.TrimSpace(request.URL))
+	if err != nil {
+		abortWithError(c, official_types.InvalidRequestError("url", "Invalid proxy: "+err.Error()))
+		return
+	}
+	list := readProxyFile()
+	if containsString(list, proxy_url) {
+		abortWithError(c, official_types.NewAPIError(409, "invalid_request_error", "already_exists", "Proxy "+redactProxy(proxy_url)+" already exists"))
+		return
+	}
+	if err := saveProxyFile(append(list, proxy_url)); err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save proxies.txt: "+err.Error()))
+		return
+	}
+	c.JSON(201, gin.H{"id": proxyID(proxy_url), "url": redactProxy(proxy_url)})
+}
+
+func deleteProxyHandler(c *gin.Context) {
+	id := c.Param("id")
+	list := readProxyFile()
+	var kept []string
+	for _, proxy_url := range list {
+		if proxyID(proxy_url) != id {
+			kept = append(kept, proxy_url)
+		}
+	}
+	if len(kept) == len(list) {
+		abortWithError(c, notFoundError("No proxy "+id+" in proxies.txt"))
+		return
+	}
+	if err := saveProxyFile(kept); err != nil {
+		abortWithError(c, official_types.ServerError("Unable to save proxies.txt: "+err.Error()))
+		return
+	}
+	c.JSON(200, gin.H{"id": id, "deleted": true})
+}
+
+type tokenView struct {
+	Account    string     `json:"account"`
+	Token      string     `json:"token"`
+	HasPUID    bool       `json:"has_puid"`
+	TeamUserID string     `json:"team_uid,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	InPool     bool       `json:"in_pool"`
+}
+
+func viewToken(account string) tokenView {
+	secret := ACCESS_TOKENS.GetSecret(account)
+	view := tokenView{Account: account, Token: maskKey(secret.Token), HasPUID: secret.PUID != "", TeamUserID: secret.TeamUserID, InPool: accountPool.Contains(account)}
+	if expire, err := getTokenExpire(secret.Token); err == nil {
+		view.ExpiresAt = &expire
+	}
+	return view
+}
+
+func listTokensHandler(c *gin.Context) {
+	list := []tokenView{}
+	for account := range ACCESS_TOKENS.GetAll() {
+		list = append(list, viewToken(account))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Account < list[j].Account
+	})
+	c.JSON(200, gin.H{"object": "list", "data": list})
+}
+
+func getTokenHandler(c *gin.Context) {
+	account := c.Param("account")
+	if _, ok := ACCESS_TOKENS.GetAll()[account]; !ok {
+		abortWithError(c, notFoundError("No access token for "+account))
+		return
+	}
+	c.JSON(200, viewToken(account))
+}
+
+// putTokenHandler sets the access token of an account, it serves requests at once
+func putTokenHandler(c *gin.Context) {
+	account := c.Param("account")
+	var request struct {
+		Token      string `json:"token"`
+		PUID       string `json:"puid"`
+		TeamUserID string `json:"team_uid"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	if strings.Count(request.Token, ".") != 2 {
+		abortWithError(c, official_types.InvalidRequestError("token", "token must be a ChatGPT access token"))
+		return
+	}
+	ACCESS_TOKENS.Set(account, request.Token, request.PUID, request.TeamUserID)
+	if !ACCESS_TOKENS.Save() {
+		abortWithError(c, official_types.ServerError("Unable to save access_tokens.json"))
+		return
+	}
+	accountPool.Add(account, request.TeamUserID != "")
+	go refreshModels()
+	c.JSON(200, viewToken(account))
+}
+
+func deleteTokenHandler(c *gin.Context) {
+	account := c.Param("account")
+	if _, ok := ACCESS_TOKENS.GetAll()[account]; !ok {
+		abortWithError(c, notFoundError("No access token for "+account))
+		return
+	}
+	ACCESS_TOKENS.Delete(account)
+	if !ACCESS_TOKENS.Save() {
+		abortWithError(c, official_types.ServerError("Unable to save access_tokens.json"))
+		return
+	}
+	accountPool.Remove(account)
+	go refreshModels()
+	c.JSON(200, gin.H{"id": account, "deleted": true})
+}
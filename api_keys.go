@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"freechatgpt/internal/fileutil"
+	official_types "freechatgpt/typings/official"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiKeysFile = "api_keys.json"
+
+// APIKey is a client key of the proxy. Only the SHA-256 of the key is stored. Empty Models and
+// Endpoints allow everything, models may contain * wildcards. RPM and TPD limit the requests per
+// minute and the tokens per UTC day, 0 is unlimited.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Hash      string     `json:"hash"`
+	Preview   string     `json:"preview"`
+	Models    []string   `json:"models,omitempty"`
+	Endpoints []string   `json:"endpoints,omitempty"`
+	RPM       int        `json:"rpm,omitempty"`
+	TPD       int        `json:"tpd,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Disabled  bool       `json:"disabled,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// keyUsage counts the requests of the current minute and the tokens of the current day
+type keyUsage struct {
+	minute   time.Time
+	requests int
+	day      string
+	tokens   int
+}
+
+type KeyStore struct {
+	lock  sync.Mutex
+	keys  map[string]*APIKey
+	usage map[string]*keyUsage
+}
+
+var keyStore = NewKeyStore()
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: map[string]*APIKey{}, usage: map[string]*keyUsage{}}
+}
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewAPIKey prepares a key record, the ID is the start of its hash
+func NewAPIKey(key string) *APIKey {
+	hash := hashKey(key)
+	return &APIKey{ID: hash[:12], Hash: hash, Preview: maskKey(key), CreatedAt: time.Now().UTC()}
+}
+
+func (k *APIKey) AllowsEndpoint(endpoint string) bool {
+	return len(k.Endpoints) == 0 || containsString(k.Endpoints, endpoint)
+}
+
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, pattern := range k.Models {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads api_keys.json. Without it the plaintext keys of api_keys.txt are hashed into it and
+// api_keys.txt is renamed to api_keys.txt.bak.
+func (s *KeyStore) Load() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = map[string]*APIKey{}
+	data, err := os.ReadFile(apiKeysFile)
+	if err == nil {
+		var file struct {
+			Keys []*APIKey `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			slog.Error("Failed to load API keys", "path", apiKeysFile, "error", err)
+			return
+		}
+		for _, key := range file.Keys {
+			s.keys[key.Hash] = key
+		}
+		return
+	}
+	file, err := os.Open("api_keys.txt")
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			api_key := NewAPIKey(key)
+			s.keys[api_key.Hash] = api_key
+		}
+	}
+	file.Close()
+	if err := s.save(); err != nil {
+		slog.Error("Failed to migrate api_keys.txt", "error", err)
+		return
+	}
+	os.Rename("api_keys.txt", "api_keys.txt.bak")
+	slog.Info("Migrated API keys, delete api_keys.txt.bak once it is no longer needed", "keys", len(s.keys), "from", "api_keys.txt", "to", apiKeysFile)
+}
+
+func (s *KeyStore) save() error {
+	file := struct {
+		Keys []*APIKey `json:"keys"`
+	}{Keys: []*APIKey{}}
+	for _, key := range s.keys {
+		file.Keys = append(file.Keys, key)
+	}
+	sortKeys(file.Keys)
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(apiKeysFile, append(data, '\n'), 0600)
+}
+
+func sortKeys(keys []*APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+}
+
+// Empty reports whether no keys are configured, the API is open then
+func (s *KeyStore) Empty() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.keys) == 0
+}
+
+// Lookup returns a copy of the record of a plaintext key
+func (s *KeyStore) Lookup(key string) *APIKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if api_key, ok := s.keys[hashKey(key)]; ok {
+		copied := *api_key
+		return &copied
+	}
+	return nil
+}
+
+// List returns copies of all keys, oldest first
+func (s *KeyStore) List() []*APIKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := []*APIKey{}
+	for _, api_key := range s.keys {
+		copied := *api_key
+		list = append(list, &copied)
+	}
+	sortKeys(list)
+	return list
+}
+
+// Add stores a new key
+func (s *KeyStore) Add(api_key *APIKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys[api_key.Hash] = api_key
+	if err := s.save(); err != nil {
+		delete(s.keys, api_key.Hash)
+		return err
+	}
+	return nil
+}
+
+// Update changes the key with the given ID, it returns false if there is none
+func (s *KeyStore) Update(id string, change func(api_key *APIKey)) (*APIKey, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, api_key := range s.keys {
+		if api_key.ID == id {
+			previous := *api_key
+			change(api_key)
+			if err := s.save(); err != nil {
+				*api_key = previous
+				return nil, true, err
+			}
+			copied := *api_key
+			return &copied, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (s *KeyStore) Delete(id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for hash, api_key := range s.keys {
+		if api_key.ID == id {
+			delete(s.keys, hash)
+			delete(s.usage, hash)
+			return true, s.save()
+		}
+	}
+	return false, nil
+}
+
+// current returns the usage of a key with windows that ended reset
+func (s *KeyStore) current(hash string, now time.Time) *keyUsage {
+	usage := s.usage[hash]
+	if usage == nil {
+		usage = &keyUsage{}
+		s.usage[hash] = usage
+	}
+	if now.Sub(usage.minute) >= time.Minute {
+		usage.minute = now
+		usage.requests = 0
+	}
+	if day := now.UTC().Format("2006-01-02"); usage.day != day {
+		usage.day = day
+		usage.tokens = 0
+	}
+	return usage
+}
+
+// Usage returns the requests of the current minute and the tokens of the current day
+func (s *KeyStore) Usage(hash string) (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	usage := s.current(hash, time.Now())
+	return usage.requests, usage.tokens
+}
+
+// Take counts a request against the limits of a key. It returns the x-ratelimit-* headers and an
+// error if a limit is exhausted.
+func (s *KeyStore) Take(api_key *APIKey) (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	usage := s.current(api_key.Hash, now)
+	headers := map[string]string{}
+	var err error
+	if api_key.TPD != 0 {
+		reset := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+		headers["x-ratelimit-limit-tokens"] = strconv.Itoa(api_key.TPD)
+		headers["x-ratelimit-remaining-tokens"] = strconv.Itoa(max(api_key.TPD-usage.tokens, 0))
+		headers["x-ratelimit-reset-tokens"] = reset.Round(time.Second).String()
+		if usage.tokens >= api_key.TPD {
+			api_err := official_types.NewAPIError(429, "tokens", "rate_limit_exceeded", "Rate limit reached for tokens per day (TPD): Limit "+strconv.Itoa(api_key.TPD)+", Used "+strconv.Itoa(usage.tokens)+". Please try again in "+reset.Round(time.Second).String()+".")
+			api_err.RetryAfter = strconv.Itoa(int(reset.Seconds()) + 1)
+			err = api_err
+		}
+	}
+	if api_key.RPM != 0 {
+		reset := usage.minute.Add(time.Minute).Sub(now)
+		headers["x-ratelimit-limit-requests"] = strconv.Itoa(api_key.RPM)
+		headers["x-ratelimit-reset-requests"] = reset.Round(time.Millisecond).String()
+		if usage.requests >= api_key.RPM && err == nil {
+			api_err := official_types.RateLimitError("Rate limit reached for requests per min (RPM): Limit " + strconv.Itoa(api_key.RPM) + ", Used " + strconv.Itoa(usage.requests) + ". Please try again in " + reset.Round(time.Second).String() + ".")
+			api_err.RetryAfter = strconv.Itoa(int(reset.Seconds()) + 1)
+			err = api_err
+		}
+		if err == nil {
+			usage.requests++
+		}
+		headers["x-ratelimit-remaining-requests"] = strconv.Itoa(max(api_key.RPM-usage.requests, 0))
+	} else if err == nil {
+		usage.requests++
+	}
+	return headers, err
+}
+
+// AddTokens charges the tokens of a finished request to a key
+func (s *KeyStore) AddTokens(hash string, tokens int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.current(hash, time.Now()).tokens += tokens
+}
+
+// requestKey returns the key the request was authorized with, nil when the API is open
+func requestKey(c *gin.Context) *APIKey {
+	if value, ok := c.Get("api_key"); ok {
+		return value.(*APIKey)
+	}
+	return nil
+}
+
+// checkKeyModel rejects models the key of the request may not use as if they did not exist
+func checkKeyModel(c *gin.Context, model string) error {
+	if api_key := requestKey(c); api_key != nil && !api_key.AllowsModel(model) {
+		return official_types.ModelNotFoundError(model)
+	}
+	return nil
+}
+
+// chargeTokens reports the tokens of a finished request to the usage store and counts them
+// against the daily limit of its key
+func chargeTokens(c *gin.Context, prompt_tokens int, completion_tokens int) {
+	c.Set("prompt_tokens", prompt_tokens)
+	c.Set("completion_tokens", completion_tokens)
+	if api_key := requestKey(c); api_key != nil {
+		keyStore.AddTokens(api_key.Hash, prompt_tokens+completion_tokens)
+	}
+}
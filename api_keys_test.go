@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	chatgpt "freechatgpt/internal/chatgpt"
+	official_types "freechatgpt/typings/official"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setKeys replaces the key store with one holding the given keys for the duration of a test,
+// without writing api_keys.json
+func setKeys(t *testing.T, keys map[string]*APIKey) {
+	t.Helper()
+	saved := keyStore
+	keyStore = NewKeyStore()
+	for key, api_key := range keys {
+		api_key.Hash = hashKey(key)
+		keyStore.keys[api_key.Hash] = api_key
+	}
+	t.Cleanup(func() { keyStore = saved })
+}
+
+// sendWithKey sends a request with an Authorization header and decodes the error, if any
+func sendWithKey(t *testing.T, method string, path string, authorization string, body string) (*httptest.ResponseRecorder, official_types.APIError) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	newRouter().ServeHTTP(recorder, request)
+	var response struct {
+		Error official_types.APIError `json:"error"`
+	}
+	if recorder.Code != 200 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("body %q is not an error object: %v", recorder.Body.String(), err)
+		}
+	}
+	return recorder, response.Error
+}
+
+func TestAPIKeyAllows(t *testing.T) {
+	api_key := &APIKey{Models: []string{"gpt-4o", "o1*"}, Endpoints: []string{"chat", "models"}}
+	models := map[string]bool{
+		"gpt-4o":      true,
+		"gpt-4o-mini": false,
+		"o1":          true,
+		"o1-mini":     true,
+		"gpt-4":       false,
+	}
+	for model, want := range models {
+		if got := api_key.AllowsModel(model); got != want {
+			t.Errorf("AllowsModel(%q) = %v, want %v", model, got, want)
+		}
+	}
+	endpoints := map[string]bool{
+		"chat":      true,
+		"models":    true,
+		"responses": false,
+	}
+	for endpoint, want := range endpoints {
+		if got := api_key.AllowsEndpoint(endpoint); got != want {
+			t.Errorf("AllowsEndpoint(%q) = %v, want %v", endpoint, got, want)
+		}
+	}
+	open := &APIKey{}
+	if !open.AllowsModel("anything") || !open.AllowsEndpoint("anything") {
+		t.Error("a key without scopes must allow everything")
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	setKeys(t, map[string]*APIKey{
+		"valid":    {ID: "valid"},
+		"disabled": {ID: "disabled", Disabled: true},
+		"expired":  {ID: "expired", ExpiresAt: &expired},
+		"chat":     {ID: "chat", Endpoints: []string{"chat"}},
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		message       string
+	}{
+		{"missing", "", 401, "No API key provided"},
+		{"invalid", "Bearer guess", 401, "Invalid API key"},
+		{"official key", "Bearer sk-proj-123", 401, "official API key"},
+		{"without Bearer", "valid", 401, "Invalid API key"},
+		{"disabled", "Bearer disabled", 401, "disabled"},
+		{"expired", "Bearer expired", 401, "expired"},
+		{"endpoint not allowed", "Bearer chat", 403, "can not be used for models"},
+		{"valid", "Bearer valid", 200, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, api_err := sendWithKey(t, http.MethodGet, "/v1/models", test.authorization, "")
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d", recorder.Code, test.status)
+			}
+			if !strings.Contains(api_err.Message, test.message) {
+				t.Errorf("error %+v, want %q", api_err, test.message)
+			}
+		})
+	}
+}
+
+func TestAuthorizationModels(t *testing.T) {
+	chatgpt.SetPlanModels("a", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini"}, {Slug: "gpt-4o"}})
+	t.Cleanup(func() { chatgpt.RetainPlanModels(map[string]bool{}) })
+	setKeys(t, map[string]*APIKey{"mini": {ID: "mini", Models: []string{"gpt-4o-mini"}}})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"allowed model", http.MethodGet, "/v1/models/gpt-4o-mini", "", 200},
+		{"other model", http.MethodGet, "/v1/models/gpt-4o", "", 404},
+		{"chat with allowed model", http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello"}]}`, 200},
+		{"chat with other model", http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}]}`, 404},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, api_err := sendWithKey(t, test.method, test.path, "Bearer mini", test.body)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d: %+v", recorder.Code, test.status, api_err)
+			}
+			if test.status == 404 && api_err.Code != "model_not_found" {
+				t.Errorf("error %+v", api_err)
+			}
+		})
+	}
+	recorder, _ := sendWithKey(t, http.MethodGet, "/v1/models", "Bearer mini", "")
+	var list struct {
+		Data []modelEntry `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].ID != "gpt-4o-mini" {
+		t.Errorf("listed %+v, want only gpt-4o-mini", list.Data)
+	}
+}
+
+func TestKeyStoreTake(t *testing.T) {
+	tests := []struct {
+		name string
+		rpm  int
+		tpd  int
+		// tokens are charged before the requests
+		tokens   int
+		requests int
+		// limited is the first request which is refused, 0 if none is
+		limited int
+		// limit is the type of the rate limit error
+		limit string
+	}{
+		{"unlimited", 0, 0, 1000, 5, 0, ""},
+		{"requests per minute", 2, 0, 0, 3, 3, "requests"},
+		{"tokens per day", 0, 100, 100, 1, 1, "tokens"},
+		{"tokens left", 0, 100, 99, 2, 0, ""},
+		{"both limits", 1, 100, 100, 1, 1, "tokens"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewKeyStore()
+			api_key := &APIKey{Hash: hashKey(test.name), RPM: test.rpm, TPD: test.tpd}
+			store.AddTokens(api_key.Hash, test.tokens)
+			for i := 1; i <= test.requests; i++ {
+				headers, err := store.Take(api_key)
+				if test.rpm != 0 && headers["x-ratelimit-limit-requests"] == "" || test.tpd != 0 && headers["x-ratelimit-limit-tokens"] == "" {
+					t.Errorf("request %d headers %v", i, headers)
+				}
+				if i != test.limited {
+					if err != nil {
+						t.Fatalf("request %d: %v", i, err)
+					}
+					continue
+				}
+				api_err, ok := err.(*official_types.APIError)
+				if !ok || api_err.Status != 429 || api_err.Type != test.limit || api_err.RetryAfter == "" {
+					t.Fatalf("request %d error %+v, want a %s rate limit", i, err, test.limit)
+				}
+			}
+			requests, _ := store.Usage(api_key.Hash)
+			want := test.requests
+			if test.limited != 0 {
+				want = test.limited - 1
+			}
+			if requests != want {
+				t.Errorf("counted %d requests, want %d", requests, want)
+			}
+		})
+	}
+}
+
+func TestChargeTokens(t *testing.T) {
+	setKeys(t, map[string]*APIKey{"limited": {ID: "limited", TPD: 1}})
+	body := `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello"}]}`
+	if recorder, api_err := sendWithKey(t, http.MethodPost, "/v1/chat/completions", "Bearer limited", body); recorder.Code != 200 {
+		t.Fatalf("status %d: %+v", recorder.Code, api_err)
+	}
+	if _, tokens := keyStore.Usage(hashKey("limited")); tokens == 0 {
+		t.Fatal("the tokens of the reply were not charged to the key")
+	}
+	recorder, api_err := sendWithKey(t, http.MethodPost, "/v1/chat/completions", "Bearer limited", body)
+	if recorder.Code != 429 || api_err.Type != "tokens" || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("status %d, error %+v after the daily tokens were used", recorder.Code, api_err)
+	}
+}
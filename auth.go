@@ -4,21 +4,28 @@ import (
 	"bufio"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/fileutil"
+	"freechatgpt/internal/metrics"
 	"freechatgpt/internal/tokens"
-
-	"github.com/xqdoo00o/OpenAIAuth/auth"
 )
 
 var accounts map[string]AccountInfo
+var accounts_lock sync.Mutex
 
-var validAccounts []string
+// login_errors keeps the last failed login of each account
+var login_errors = map[string]string{}
 
 const interval = time.Hour * 24
 
@@ -33,7 +40,11 @@ type TokenExp struct {
 }
 
 func getTokenExpire(tokenstring string) (time.Time, error) {
-	payLoadData := strings.Split(tokenstring, ".")[1]
+	parts := strings.Split(tokenstring, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("not a JWT")
+	}
+	payLoadData := parts[1]
 	// Decode payload
 	payload, err := base64.RawStdEncoding.DecodeString(payLoadData)
 	if err != nil {
@@ -57,35 +68,69 @@ func AppendIfNone(slice []string, i string) []string {
 	return append(slice, i)
 }
 
-var TimesCounter int
+func getAccount(email string) (AccountInfo, bool) {
+	accounts_lock.Lock()
+	defer accounts_lock.Unlock()
+	info, ok := accounts[email]
+	return info, ok
+}
 
-func getSecret() (string, tokens.Secret) {
-	if len(validAccounts) != 0 {
-		account := validAccounts[0]
-		secret := ACCESS_TOKENS.GetSecret(account)
-		if TimesCounter == 0 {
-			TimesCounter = accounts[account].Times[0]
-			if secret.TeamUserID != "" && len(accounts[account].Times) == 2 {
-				TimesCounter += accounts[account].Times[1]
-			}
-		}
-		TimesCounter--
-		if TimesCounter == 0 {
-			validAccounts = append(validAccounts[1:], account)
-		}
-		if secret.TeamUserID != "" {
-			if TimesCounter < accounts[account].Times[0] {
-				secret.TeamUserID = ""
+// accountsSnapshot returns a copy of the accounts which is safe to iterate while they change
+func accountsSnapshot() map[string]AccountInfo {
+	accounts_lock.Lock()
+	defer accounts_lock.Unlock()
+	snapshot := make(map[string]AccountInfo, len(accounts))
+	for email, info := range accounts {
+		snapshot[email] = info
+	}
+	return snapshot
+}
+
+// saveAccounts writes the accounts back to accounts.txt as email:password[:times]
+func saveAccounts() error {
+	accounts_lock.Lock()
+	defer accounts_lock.Unlock()
+	emails := make([]string, 0, len(accounts))
+	for email := range accounts {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	var content strings.Builder
+	for _, email := range emails {
+		info := accounts[email]
+		content.WriteString(email + ":" + info.Password)
+		if len(info.Times) != 0 && !(len(info.Times) == 1 && info.Times[0] == 1) {
+			times := make([]string, len(info.Times))
+			for i, t := range info.Times {
+				times[i] = strconv.Itoa(t)
 			}
+			content.WriteString(":" + strings.Join(times, "/"))
 		}
-		return account, secret
+		content.WriteString("\n")
+	}
+	return fileutil.WriteAtomic("accounts.txt", []byte(content.String()), 0600)
+}
+
+func setLoginError(email string, message string) {
+	accounts_lock.Lock()
+	defer accounts_lock.Unlock()
+	if message == "" {
+		delete(login_errors, email)
 	} else {
-		return "", tokens.Secret{}
+		login_errors[email] = message
 	}
 }
 
+func getLoginError(email string) string {
+	accounts_lock.Lock()
+	defer accounts_lock.Unlock()
+	return login_errors[email]
+}
+
 // Read accounts.txt and create a list of accounts
 func readAccounts() {
+	accounts_lock.Lock()
+	defer accounts_lock.Unlock()
 	accounts = map[string]AccountInfo{}
 	// Read accounts.txt and create a list of accounts
 	if _, err := os.Stat("accounts.txt"); err == nil {
@@ -127,6 +172,10 @@ func readAccounts() {
 
 func newTimeFunc(email string, password string, token_list map[string]tokens.Secret, cron bool) func() {
 	return func() {
+		// The account was removed or its password changed since the renewal was scheduled
+		if info, ok := getAccount(email); !ok || info.Password != password {
+			return
+		}
 		updateSingleToken(email, password, token_list, cron)
 	}
 }
@@ -157,9 +206,9 @@ func scheduleTokenPUID() {
 		if len(token_list) == 0 {
 			updateToken()
 		} else {
-			ACCESS_TOKENS = tokens.NewAccessToken(token_list)
-			validAccounts = []string{}
-			for account, info := range accounts {
+			ACCESS_TOKENS.Replace(token_list)
+			accountPool.Reset(nil)
+			for account, info := range accountsSnapshot() {
 				token := token_list[account].Token
 				if token == "" {
 					updateSingleToken(account, info.Password, nil, true)
@@ -203,7 +252,7 @@ func scheduleTokenPUID() {
 						}
 					}
 					if toExpire > 0 {
-						validAccounts = AppendIfNone(validAccounts, account)
+						accountPool.Add(account, token_list[account].TeamUserID != "")
 						f := newTimeFunc(account, info.Password, nil, true)
 						time.AfterFunc(toExpire+time.Second, f)
 					} else {
@@ -222,51 +271,30 @@ func updateSingleToken(email string, password string, token_list map[string]toke
 		exec.Command("warp-cli", "connect").Run()
 		time.Sleep(5 * time.Second)
 	}
-	println("Updating access token for " + email)
-	var proxy_url string
-	if len(proxies) == 0 {
-		proxy_url = ""
-	} else {
-		proxy_url = proxies[0]
-		// Push used proxy to the back of the list
-		proxies = append(proxies[1:], proxies[0])
-	}
-	authenticator := auth.NewAuthenticator(email, password, proxy_url)
-	err := authenticator.RenewWithCookies()
+	proxy_url := proxyPool.Next(email)
+	log := slog.With("account", email, "proxy", redactProxy(proxy_url))
+	log.Info("Updating access token")
+	secret, err := chatgpt.Upstream.Login(email, password, proxy_url)
 	if err != nil {
-		authenticator.ResetCookies()
-		err := authenticator.Begin()
-		if err != nil {
-			if token_list == nil {
-				ACCESS_TOKENS.Delete(email)
-				for i, v := range validAccounts {
-					if v == email {
-						validAccounts = append(validAccounts[:i], validAccounts[i+1:]...)
-						break
-					}
-				}
-			}
-			println("Location: " + err.Location)
-			println("Status code: " + strconv.Itoa(err.StatusCode))
-			println("Details: " + err.Details)
-			return
+		if token_list == nil {
+			ACCESS_TOKENS.Delete(email)
+			accountPool.Remove(email)
 		}
+		log.Error("Login failed", "location", err.Location, "status", err.StatusCode, "details", err.Details)
+		setLoginError(email, "Login failed with status "+strconv.Itoa(err.StatusCode)+": "+err.Details)
+		metrics.TokenRefresh(false)
+		return
 	}
-	access_token := authenticator.GetAccessToken()
-	puid, _ := authenticator.GetPUID()
-	teamUserID, _ := authenticator.GetTeamUserID()
 	if token_list != nil {
-		token_list[email] = tokens.Secret{Token: access_token, PUID: puid, TeamUserID: teamUserID}
+		token_list[email] = secret
 	} else {
-		ACCESS_TOKENS.Set(email, access_token, puid, teamUserID)
+		ACCESS_TOKENS.Set(email, secret.Token, secret.PUID, secret.TeamUserID)
 		ACCESS_TOKENS.Save()
 	}
-	validAccounts = AppendIfNone(validAccounts, email)
-	println("Success!")
-	err = authenticator.SaveCookies()
-	if err != nil {
-		println(err.Details)
-	}
+	accountPool.Add(email, secret.TeamUserID != "")
+	setLoginError(email, "")
+	metrics.TokenRefresh(true)
+	log.Info("Access token updated", "team", secret.TeamUserID != "")
 	if cron {
 		f := newTimeFunc(email, password, token_list, cron)
 		time.AfterFunc(interval+time.Second, f)
@@ -275,13 +303,13 @@ func updateSingleToken(email string, password string, token_list map[string]toke
 
 func updateToken() {
 	token_list := map[string]tokens.Secret{}
-	validAccounts = []string{}
+	accountPool.Reset(nil)
 	// Loop through each account
-	for account, info := range accounts {
+	for account, info := range accountsSnapshot() {
 		updateSingleToken(account, info.Password, token_list, false)
 	}
 	// Append access token to access_tokens.json
-	ACCESS_TOKENS = tokens.NewAccessToken(token_list)
+	ACCESS_TOKENS.Replace(token_list)
 	ACCESS_TOKENS.Save()
 	time.AfterFunc(interval, updateToken)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	bard_request_converter "freechatgpt/conversion/requests/bard"
+	"freechatgpt/internal/bard"
+	"freechatgpt/internal/tokenizer"
+	official_types "freechatgpt/typings/official"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var bard_cookies []string
+var bard_lock sync.Mutex
+
+// bardModels are listed in /v1/models when a cookie is configured, any model
+// prefixed gemini- or bard- is served by Gemini
+var bardModels = []string{"gemini-web", "bard-web"}
+
+func isBardModel(model string) bool {
+	return strings.HasPrefix(model, "gemini-") || strings.HasPrefix(model, "bard-")
+}
+
+// Read the Google cookies from BARD_COOKIE and bard_cookies.txt, one account per line
+func readBardCookies() {
+	bard_cookies = []string{}
+	if cookie := os.Getenv("BARD_COOKIE"); cookie != "" {
+		bard_cookies = append(bard_cookies, cookie)
+	}
+	if _, err := os.Stat("bard_cookies.txt"); err == nil {
+		file, _ := os.Open("bard_cookies.txt")
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			cookie := strings.TrimSpace(scanner.Text())
+			if cookie != "" {
+				bard_cookies = append(bard_cookies, cookie)
+			}
+		}
+	}
+}
+
+func getBardCookie() string {
+	bard_lock.Lock()
+	defer bard_lock.Unlock()
+	if len(bard_cookies) == 0 {
+		return ""
+	}
+	cookie := bard_cookies[0]
+	// Push used cookie to the back of the list
+	bard_cookies = append(bard_cookies[1:], cookie)
+	return cookie
+}
+
+// runBardChoice asks Gemini and writes the answer to writer in chunks, Gemini does not stream.
+// With reuse the conversation of the message history is continued when it is cached.
+func runBardChoice(c *gin.Context, original_request official_types.APIRequest, reuse bool, writer *limitWriter) (int, error) {
+	turns, last := bard_request_converter.ConvertAPIRequest(original_request)
+	if len(turns) == 0 {
+		return 0, official_types.InvalidRequestError("messages", "messages must not be empty")
+	}
+	var session *bard.Bard
+	var old_hash string
+	if reuse && len(turns) > 1 {
+		old_hash = bard.HashConversation(turns[:len(turns)-1])
+		session = bard.GetBard(old_hash)
+	}
+	prompt := last
+	if session == nil {
+		cookie := getBardCookie()
+		if cookie == "" {
+			return 0, official_types.UpstreamError(503, "no_account_available", "No Gemini cookie is configured")
+		}
+		var err error
+		session, err = bard.New(cookie)
+		if err != nil {
+			return 0, official_types.UpstreamError(502, "upstream_error", "Unable to start a Gemini conversation: "+err.Error())
+		}
+		if len(turns) > 1 {
+			prompt = strings.Join(turns, "\n\n")
+		}
+	}
+	prompt_tokens := tokenizer.Count(original_request.Model, prompt) + tokenizer.ReplyPriming
+	answer, err := session.Ask(prompt)
+	if err != nil {
+		return 0, official_types.UpstreamError(502, "upstream_error", "Gemini failed to answer: "+err.Error())
+	}
+	writer.SetModel(original_request.Model)
+	for _, piece := range splitWords(answer.Content, 4) {
+		err = writer.WriteDelta(piece)
+		if err == errChoiceDone {
+			break
+		}
+		if err != nil {
+			return prompt_tokens, err
+		}
+	}
+	if err := writer.Finish("stop"); err != nil && !errors.Is(err, errChoiceDone) {
+		return prompt_tokens, err
+	}
+	if reuse {
+		hash := bard.HashConversation(append(turns, bard_request_converter.AssistantTurn(writer.emitted.String())))
+		if old_hash != "" && bard.GetBard(old_hash) == session {
+			bard.UpdateBardHash(old_hash, hash)
+		} else {
+			bard.SetBard(hash, session)
+		}
+	}
+	return prompt_tokens, nil
+}
+
+// splitWords cuts text into pieces of size words, keeping the whitespace
+func splitWords(text string, size int) []string {
+	var pieces []string
+	words := 0
+	start := 0
+	in_word := false
+	for i, r := range text {
+		space := r == ' ' || r == '\n' || r == '\t'
+		if !space && !in_word {
+			if words == size {
+				pieces = append(pieces, text[start:i])
+				start = i
+				words = 0
+			}
+			words++
+		}
+		in_word = !space
+	}
+	if start < len(text) {
+		pieces = append(pieces, text[start:])
+	}
+	return pieces
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
+	"freechatgpt/internal/logging"
+	official_types "freechatgpt/typings/official"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// textChunkWriter streams text_completion chunks of one choice, choices of the same request
+// share the lock
+type textChunkWriter struct {
+	c     *gin.Context
+	meta  official_types.CompletionMeta
+	index int
+	lock  *sync.Mutex
+	// echo is the prompt, sent before the first text of the choice
+	echo string
+	// onFirstWrite may set response headers before the first chunk of the request
+	onFirstWrite func()
+}
+
+func (w *textChunkWriter) write(text string, reason interface{}) error {
+	text, w.echo = w.echo+text, ""
+	chunk := official_types.NewTextCompletion(w.meta, []official_types.TextChoice{{Text: text, Index: w.index, FinishReason: reason}})
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.c.Writer.Written() {
+		if w.onFirstWrite != nil {
+			w.onFirstWrite()
+		}
+		w.c.Header("Content-Type", "text/event-stream")
+	}
+	_, err := w.c.Writer.WriteString("data: " + chunk.String() + "\n\n")
+	w.c.Writer.Flush()
+	return err
+}
+
+func (w *textChunkWriter) WriteDelta(text string) error {
+	return w.write(text, nil)
+}
+
+func (w *textChunkWriter) SetModel(slug string) {
+	w.meta.SetModel(slug)
+}
+
+// Written reports whether an event of the request reached the client
+func (w *textChunkWriter) Written() bool {
+	return w.c.Writer.Written()
+}
+
+func (w *textChunkWriter) Finish(reason string) error {
+	return w.write("", reason)
+}
+
+// completionsHandler serves the legacy completions API. Every prompt is sent as one user message,
+// stop sequences and max_tokens are enforced on the returned text.
+func completionsHandler(c *gin.Context) {
+	var request official_types.CompletionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	c.Set("usage_model", request.Model)
+	if err := checkKeyModel(c, request.Model); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	prompts, api_err := request.Prompts()
+	if api_err != nil {
+		abortWithError(c, api_err)
+		return
+	}
+	n := request.N
+	if n == 0 {
+		n = 1
+	}
+	if n < 0 || n*len(prompts) > maxChoices {
+		abortWithError(c, official_types.InvalidRequestError("n", "n times the number of prompts must be between 1 and "+strconv.Itoa(maxChoices)))
+		return
+	}
+	chat_requests := make([]official_types.APIRequest, len(prompts))
+	for i, prompt := range prompts {
+		chat_requests[i], api_err = request.ChatRequest(prompt)
+		if api_err != nil {
+			abortWithError(c, api_err)
+			return
+		}
+	}
+	if param, message := chatgpt_request_converter.CheckParams(chat_requests[0], STRICT_PARAMS, maxChoices); param != "" {
+		abortWithError(c, official_types.InvalidRequestError(param, message))
+		return
+	}
+	stop := chatgpt_request_converter.StopSequences(chat_requests[0])
+	max_tokens := chatgpt_request_converter.MaxTokens(chat_requests[0])
+	use_bard := isBardModel(request.Model)
+
+	route := chatgpt_request_converter.ResolveModel(request.Model)
+	meta := official_types.NewTextCompletionMeta(request.Model)
+	if !use_bard && route.Slug != "" {
+		meta.SetModel(route.Slug)
+	}
+	// Choice i answers prompt i / n
+	choices := n * len(prompts)
+	var lock sync.Mutex
+	var attempts int32
+	limits := make([]*limitWriter, choices)
+	chunk_writers := make([]*textChunkWriter, choices)
+	collected := make([]*collectWriter, choices)
+	for i := range limits {
+		var writer completionWriter
+		if request.Stream {
+			chunk_writers[i] = &textChunkWriter{c: c, meta: meta, index: i, lock: &lock, onFirstWrite: func() {
+				c.Header(attemptsHeader, strconv.Itoa(int(atomic.LoadInt32(&attempts))))
+			}}
+			if request.Echo {
+				chunk_writers[i].echo = prompts[i/n]
+			}
+			writer = chunk_writers[i]
+		} else {
+			collected[i] = &collectWriter{}
+			writer = collected[i]
+		}
+		limits[i] = &limitWriter{completionWriter: writer, model: request.Model, stop: stop, maxTokens: max_tokens}
+	}
+	errs := make([]error, choices)
+	prompt_tokens := make([]int, choices)
+	var wg sync.WaitGroup
+	for i := range limits {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer recoverChoice(c, &errs[i])
+			if use_bard {
+				errs[i] = withRetries(limits[i], &attempts, func(try int) error {
+					var err error
+					prompt_tokens[i], err = runBardChoice(c, chat_requests[i/n], false, limits[i])
+					if err != nil {
+						logging.From(c).Warn("Gemini request failed", "attempt", try+1, "error", err)
+					}
+					return err
+				})
+			} else {
+				prompt_tokens[i], _, errs[i] = serveChoice(c, chat_requests[i/n], route, nil, limits[i], &attempts)
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Set("attempts", int(attempts))
+	if !c.Writer.Written() {
+		c.Header(attemptsHeader, strconv.Itoa(int(attempts)))
+	}
+	for _, err := range errs {
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	usage := official_types.Usage{}
+	for i, limit := range limits {
+		if i%n == 0 {
+			usage.PromptTokens += prompt_tokens[i]
+		}
+		usage.CompletionTokens += limit.CompletionTokens()
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	chargeTokens(c, usage.PromptTokens, usage.CompletionTokens)
+	if !request.Stream {
+		if collected[0].model != "" {
+			meta.SetModel(collected[0].model)
+		}
+		var text_choices []official_types.TextChoice
+		for i, writer := range collected {
+			text := writer.text.String()
+			if request.Echo {
+				text = prompts[i/n] + text
+			}
+			text_choices = append(text_choices, official_types.TextChoice{Text: text, Index: i, FinishReason: writer.reason})
+		}
+		completion := official_types.NewTextCompletion(meta, text_choices)
+		completion.Usage = &usage
+		c.JSON(200, completion)
+		return
+	}
+	if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+		usage_chunk := official_types.NewTextCompletion(chunk_writers[0].meta, []official_types.TextChoice{})
+		usage_chunk.Usage = &usage
+		c.Writer.WriteString("data: " + usage_chunk.String() + "\n\n")
+	}
+	c.String(200, "data: [DONE]\n\n")
+}
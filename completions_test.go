@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"strings"
+	"testing"
+)
+
+// createCompletion sends a request to the legacy completions API and returns the completion, the
+// chunks of a stream are joined per choice
+func createCompletion(t *testing.T, body string, stream bool) official_types.TextCompletion {
+	t.Helper()
+	if stream {
+		body = strings.Replace(body, "{", `{"stream":true,"stream_options":{"include_usage":true},`, 1)
+	}
+	response := post(t, "/v1/completions", body)
+	if response.StatusCode != 200 {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	var completion official_types.TextCompletion
+	if !stream {
+		if err := json.NewDecoder(response.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+		return completion
+	}
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			return completion
+		}
+		var chunk official_types.TextCompletion
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		if chunk.Object != "text_completion" {
+			t.Errorf("chunk object %q", chunk.Object)
+		}
+		completion.ID, completion.Object, completion.Model = chunk.ID, chunk.Object, chunk.Model
+		if chunk.Usage != nil {
+			completion.Usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			for len(completion.Choices) <= choice.Index {
+				completion.Choices = append(completion.Choices, official_types.TextChoice{Index: len(completion.Choices)})
+			}
+			joined := &completion.Choices[choice.Index]
+			joined.Text += choice.Text
+			if choice.FinishReason != nil {
+				joined.FinishReason = choice.FinishReason
+			}
+		}
+	}
+	t.Fatal("stream ended without [DONE]")
+	return completion
+}
+
+func TestCompletions(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// texts and reasons are the ones of the choices in order
+		texts   []string
+		reasons []string
+	}{
+		{"prompt", `{"model":"gpt-4o-mini","prompt":"Hello","max_tokens":100}`, []string{recordedReply}, []string{"stop"}},
+		{"default max_tokens", `{"model":"gpt-4o-mini","prompt":"Hello"}`, []string{"Hello! This is a recorded reply from the mock backend. How can I help"}, []string{"length"}},
+		{"echo", `{"model":"gpt-4o-mini","prompt":"Say: ","echo":true,"max_tokens":100}`, []string{"Say: " + recordedReply}, []string{"stop"}},
+		{"suffix", `{"model":"gpt-4o-mini","prompt":"Hello","suffix":" Bye.","max_tokens":100}`, []string{recordedReply}, []string{"stop"}},
+		{"stop", `{"model":"gpt-4o-mini","prompt":"Hello","stop":"mock","max_tokens":100}`, []string{"Hello! This is a recorded reply from the "}, []string{"stop"}},
+		{"prompt array", `{"model":"gpt-4o-mini","prompt":["One","Two"],"echo":true,"max_tokens":100}`, []string{"One" + recordedReply, "Two" + recordedReply}, []string{"stop", "stop"}},
+		{"n per prompt", `{"model":"gpt-4o-mini","prompt":["One","Two"],"n":2,"echo":true,"max_tokens":1}`, []string{"One" + "Hello", "One" + "Hello", "Two" + "Hello", "Two" + "Hello"}, []string{"length", "length", "length", "length"}},
+	}
+	for _, test := range tests {
+		for _, stream := range []bool{false, true} {
+			name := test.name
+			if stream {
+				name += " stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				completion := createCompletion(t, test.body, stream)
+				if completion.Object != "text_completion" || !strings.HasPrefix(completion.ID, "cmpl-") {
+					t.Errorf("completion %+v", completion)
+				}
+				if len(completion.Choices) != len(test.texts) {
+					t.Fatalf("%d choices, want %d", len(completion.Choices), len(test.texts))
+				}
+				for i, choice := range completion.Choices {
+					if choice.Index != i || choice.Text != test.texts[i] || choice.FinishReason != test.reasons[i] {
+						t.Errorf("choice %d is %q finishing with %v, want %q with %s", choice.Index, choice.Text, choice.FinishReason, test.texts[i], test.reasons[i])
+					}
+				}
+				if completion.Usage == nil || completion.Usage.CompletionTokens == 0 || completion.Usage.TotalTokens != completion.Usage.PromptTokens+completion.Usage.CompletionTokens {
+					t.Errorf("usage %+v", completion.Usage)
+				}
+			})
+		}
+	}
+}
+
+func TestCompletionsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		param string
+	}{
+		{"token prompt", `{"model":"gpt-4o-mini","prompt":[1,2,3]}`, "prompt"},
+		{"empty prompt array", `{"model":"gpt-4o-mini","prompt":[]}`, "prompt"},
+		{"prompt object", `{"model":"gpt-4o-mini","prompt":{"text":"Hello"}}`, "prompt"},
+		{"logprobs", `{"model":"gpt-4o-mini","prompt":"Hello","logprobs":1}`, "logprobs"},
+		{"best_of", `{"model":"gpt-4o-mini","prompt":"Hello","best_of":2}`, "best_of"},
+		{"too many choices", `{"model":"gpt-4o-mini","prompt":["a","b","c"],"n":3}`, "n"},
+		{"max_tokens", `{"model":"gpt-4o-mini","prompt":"Hello","max_tokens":-1}`, "max_tokens"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := post(t, "/v1/completions", test.body)
+			var body struct {
+				Error official_types.APIError `json:"error"`
+			}
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != 400 || body.Error.Param != test.param {
+				t.Errorf("status %d, error %+v, want param %q", response.StatusCode, body.Error, test.param)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
+	chatgpt_response_converter "freechatgpt/conversion/response/chatgpt"
+	chatgpt "freechatgpt/internal/chatgpt"
+	official_types "freechatgpt/typings/official"
+)
+
+// resumeConversation looks up the upstream conversation of the message history,
+// the returned request only holds the new turn
+func resumeConversation(original_request official_types.APIRequest) (*chatgpt.ConversationInfo, official_types.APIRequest) {
+	n := chatgpt_request_converter.SplitHistory(original_request)
+	if n == 0 {
+		return nil, original_request
+	}
+	info := chatgpt.GetConversation(chatgpt_request_converter.HashConversation(original_request, n))
+	// The conversation can only be continued by the account owning it
+	if info == nil || ACCESS_TOKENS.GetSecret(info.Account).Token == "" {
+		return nil, original_request
+	}
+	resumed := original_request
+	resumed.Messages = append(resumed.Messages[:0:0], original_request.Messages[n:]...)
+	// Results of tool calls made in earlier turns are named after the stored calls
+	for i := range resumed.Messages {
+		if resumed.Messages[i].Name == "" && resumed.Messages[i].ToolCallID != "" {
+			resumed.Messages[i].Name = info.ToolNames[resumed.Messages[i].ToolCallID]
+		}
+	}
+	// The tool definitions were sent with the first turn
+	resumed.Tools = nil
+	return info, resumed
+}
+
+// saveConversation records the upstream conversation of the message history followed by the reply
+func saveConversation(original_request official_types.APIRequest, info *chatgpt.ConversationInfo, reply string, use_tools bool) {
+	if info == nil || info.Account == "" || info.ConversationID == "" {
+		return
+	}
+	var tool_calls []official_types.ToolCall
+	if use_tools {
+		reply, tool_calls = chatgpt_response_converter.ParseToolCalls(reply)
+	}
+	history := original_request
+	history.Messages = history.Messages[:len(history.Messages):len(history.Messages)]
+	history.AddAssistantMessage(reply, tool_calls)
+	hash := chatgpt_request_converter.HashConversation(history, len(history.Messages))
+	saved := *info
+	saved.ToolNames = chatgpt_request_converter.ToolNames(history)
+	chatgpt.SetConversation(hash, saved)
+}
@@ -0,0 +1,54 @@
+package bard
+
+import (
+	official_types "freechatgpt/typings/official"
+	"strings"
+)
+
+var roleNames = map[string]string{
+	"system":    "System",
+	"user":      "User",
+	"assistant": "Assistant",
+}
+
+// ConvertAPIRequest flattens the messages into "Role: text" turns, Bard takes one plain text
+// prompt per turn. It also returns the text of the last message.
+func ConvertAPIRequest(api_request official_types.APIRequest) ([]string, string) {
+	var turns []string
+	var last string
+	for _, api_message := range api_request.Messages {
+		role := roleNames[api_message.Role]
+		if role == "" {
+			role = "User"
+		}
+		last = messageText(api_message.Content)
+		turns = append(turns, role+": "+last)
+	}
+	return turns, last
+}
+
+// AssistantTurn formats a reply the way ConvertAPIRequest formats assistant messages
+func AssistantTurn(text string) string {
+	return roleNames["assistant"] + ": " + text
+}
+
+// messageText joins the text parts of a message, images are dropped
+func messageText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var parts []string
+		for _, item := range v {
+			part, ok := item.(map[string]interface{})
+			if !ok || part["type"] != "text" {
+				continue
+			}
+			if text, ok := part["text"].(string); ok {
+				parts = append(parts, text)
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
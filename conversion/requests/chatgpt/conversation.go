@@ -0,0 +1,72 @@
+package chatgpt
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"hash"
+	"strings"
+)
+
+// HashConversation hashes the model and the first n messages of the request with their image
+// and file parts. Tool call ids of assistant messages are generated by the gateway, so only their
+// name and arguments count.
+func HashConversation(api_request official_types.APIRequest, n int) string {
+	hash := sha1.New()
+	hash.Write([]byte(api_request.Model))
+	for _, api_message := range api_request.Messages[:n] {
+		hash.Write([]byte{0})
+		hash.Write([]byte(api_message.Role + "\n" + strings.TrimSpace(contentText(api_message.Content))))
+		hashAttachments(hash, api_message.Content)
+		for _, call := range api_message.ToolCalls {
+			hash.Write([]byte("\n" + call.Function.Name + "\n" + call.Function.Arguments))
+		}
+		if api_message.FunctionCall != nil {
+			hash.Write([]byte("\n" + api_message.FunctionCall.Name + "\n" + api_message.FunctionCall.Arguments))
+		}
+		if api_message.ToolCallID != "" {
+			hash.Write([]byte("\n" + api_message.ToolCallID))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// hashAttachments adds the parts of content which are no text to digest
+func hashAttachments(digest hash.Hash, content interface{}) {
+	parts, _ := content.([]interface{})
+	for _, part := range parts {
+		part_map, _ := part.(map[string]interface{})
+		if part_map == nil || part_map["type"] == "text" {
+			continue
+		}
+		// Map keys are marshaled in order
+		data, _ := json.Marshal(part_map)
+		digest.Write([]byte("\n"))
+		digest.Write(data)
+	}
+}
+
+// ToolNames maps the tool call ids of the assistant messages to their function names
+func ToolNames(api_request official_types.APIRequest) map[string]string {
+	names := map[string]string{}
+	for _, api_message := range api_request.Messages {
+		for _, call := range api_message.ToolCalls {
+			if call.ID != "" {
+				names[call.ID] = call.Function.Name
+			}
+		}
+	}
+	return names
+}
+
+// SplitHistory returns the number of messages up to and including the last assistant message,
+// the messages after it are the new turn. It returns 0 if there is no earlier reply.
+func SplitHistory(api_request official_types.APIRequest) int {
+	for i := len(api_request.Messages) - 2; i >= 0; i-- {
+		if api_request.Messages[i].Role == "assistant" {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -1,37 +1,80 @@
 package chatgpt
 
 import (
+	"context"
+	"errors"
 	chatgpt_types "freechatgpt/internal/chatgpt"
 	"freechatgpt/internal/tokens"
 	official_types "freechatgpt/typings/official"
-	"regexp"
-	"strings"
 )
 
-var gptsRegexp = regexp.MustCompile(`-gizmo-g-(\w+)`)
+// ErrModelNotFound is returned for models which no account can serve
+var ErrModelNotFound = errors.New("model not found")
 
-func ConvertAPIRequest(api_request official_types.APIRequest, account string, secret *tokens.Secret, deviceId string, proxy string) chatgpt_types.ChatGPTRequest {
+// ModelSlug maps an OpenAI model name to the ChatGPT model serving it
+func ModelSlug(model string) string {
+	return ResolveModel(model).Slug
+}
+
+func ConvertAPIRequest(ctx context.Context, api_request official_types.APIRequest, account string, secret *tokens.Secret, deviceId string, proxy string) (chatgpt_types.ChatGPTRequest, error) {
 	chatgpt_request := chatgpt_types.NewChatGPTRequest()
-	if strings.HasPrefix(api_request.Model, "gpt-4o-mini") || strings.HasPrefix(api_request.Model, "gpt-3.5") {
-		chatgpt_request.Model = "gpt-4o-mini"
-	} else if strings.HasPrefix(api_request.Model, "gpt-4o") {
-		chatgpt_request.Model = "gpt-4o"
-	} else if strings.HasPrefix(api_request.Model, "gpt-4") {
-		chatgpt_request.Model = "gpt-4"
+	route := ResolveModel(api_request.Model)
+	if route.Slug != "" {
+		chatgpt_request.Model = route.Slug
+		// The models are unknown if the model list could not be fetched, let upstream decide then
+		if known := chatgpt_types.KnownModels(); known != nil && !known[chatgpt_request.Model] {
+			return chatgpt_request, ErrModelNotFound
+		}
 	}
-	matches := gptsRegexp.FindStringSubmatch(api_request.Model)
-	if len(matches) == 2 {
-		chatgpt_request.ConversationMode.Kind = "gizmo_interaction"
-		chatgpt_request.ConversationMode.GizmoId = "g-" + matches[1]
+	if route.Mode != "" {
+		chatgpt_request.ConversationMode.Kind = route.Mode
+		chatgpt_request.ConversationMode.GizmoId = route.GizmoID
 	}
 	ifMultimodel := secret.Token != ""
+	if ToolsEnabled(api_request) {
+		chatgpt_request.AddMessage(ctx, "critic", buildToolPrompt(api_request), false, account, secret, deviceId, proxy)
+	}
+	if JSONFormat(api_request) {
+		chatgpt_request.AddMessage(ctx, "critic", buildFormatPrompt(api_request), false, account, secret, deviceId, proxy)
+	}
+	if route.System != "" && !hasSystemMessage(api_request) {
+		chatgpt_request.AddMessage(ctx, "critic", route.System, false, account, secret, deviceId, proxy)
+	}
+	tool_names := map[string]string{}
 	for _, api_message := range api_request.Messages {
-		if api_message.Role == "system" {
+		switch api_message.Role {
+		case "system":
 			api_message.Role = "critic"
+		case "assistant":
+			if api_message.FunctionCall != nil {
+				api_message.ToolCalls = append(api_message.ToolCalls, official_types.ToolCall{Type: "function", Function: *api_message.FunctionCall})
+			}
+			if len(api_message.ToolCalls) != 0 {
+				for _, call := range api_message.ToolCalls {
+					tool_names[call.ID] = call.Function.Name
+				}
+				api_message.Content = formatToolCalls(contentText(api_message.Content), api_message.ToolCalls)
+			}
+		case "tool", "function":
+			name := api_message.Name
+			if name == "" {
+				name = tool_names[api_message.ToolCallID]
+			}
+			api_message.Role = "user"
+			api_message.Content = formatToolResult(api_message.ToolCallID, name, contentText(api_message.Content))
 		}
-		chatgpt_request.AddMessage(api_message.Role, api_message.Content, ifMultimodel, account, secret, deviceId, proxy)
+		chatgpt_request.AddMessage(ctx, api_message.Role, api_message.Content, ifMultimodel, account, secret, deviceId, proxy)
 	}
-	return chatgpt_request
+	return chatgpt_request, nil
+}
+
+func hasSystemMessage(api_request official_types.APIRequest) bool {
+	for _, api_message := range api_request.Messages {
+		if api_message.Role == "system" {
+			return true
+		}
+	}
+	return false
 }
 
 func ConvertTTSAPIRequest(input string) chatgpt_types.ChatGPTRequest {
@@ -0,0 +1,68 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"freechatgpt/internal/jsonschema"
+	official_types "freechatgpt/typings/official"
+	"strings"
+)
+
+// JSONFormat reports whether response_format asks for a JSON reply
+func JSONFormat(api_request official_types.APIRequest) bool {
+	if api_request.ResponseFormat == nil {
+		return false
+	}
+	return api_request.ResponseFormat.Type == "json_object" || api_request.ResponseFormat.Type == "json_schema"
+}
+
+// ResponseSchema compiles the schema of a json_schema response_format, other formats have none
+func ResponseSchema(api_request official_types.APIRequest) (*jsonschema.Schema, error) {
+	format := api_request.ResponseFormat
+	if format == nil || format.Type != "json_schema" || format.JSONSchema == nil || format.JSONSchema.Schema == nil {
+		return nil, nil
+	}
+	return jsonschema.Compile(format.JSONSchema.Schema)
+}
+
+// checkResponseFormat returns the problem of response_format, if any
+func checkResponseFormat(api_request official_types.APIRequest) string {
+	format := api_request.ResponseFormat
+	if format == nil {
+		return ""
+	}
+	switch format.Type {
+	case "text", "json_object":
+		return ""
+	case "json_schema":
+		if format.JSONSchema == nil || format.JSONSchema.Name == "" {
+			return "response_format.json_schema.name is required"
+		}
+		if format.JSONSchema.Schema == nil {
+			return "response_format.json_schema.schema is required"
+		}
+		if _, err := ResponseSchema(api_request); err != nil {
+			return "Invalid schema for response_format '" + format.JSONSchema.Name + "': " + err.Error()
+		}
+		return ""
+	}
+	return "response_format.type must be one of text, json_object or json_schema"
+}
+
+func buildFormatPrompt(api_request official_types.APIRequest) string {
+	var prompt strings.Builder
+	prompt.WriteString("# Response format\n\nReply with a single valid JSON value and nothing else: no explanation, no Markdown and no code fences.")
+	format := api_request.ResponseFormat
+	if format.Type != "json_schema" {
+		prompt.WriteString(" The value must be a JSON object.")
+		return prompt.String()
+	}
+	schema, _ := json.MarshalIndent(format.JSONSchema.Schema, "", "  ")
+	prompt.WriteString(" The value must match this JSON Schema named " + format.JSONSchema.Name)
+	if format.JSONSchema.Description != "" {
+		prompt.WriteString(" (" + format.JSONSchema.Description + ")")
+	}
+	prompt.WriteString(":\n")
+	prompt.Write(schema)
+	prompt.WriteString("\n\nInclude every required property and no properties the schema does not allow.")
+	return prompt.String()
+}
@@ -0,0 +1,90 @@
+package chatgpt
+
+import (
+	official_types "freechatgpt/typings/official"
+	"strconv"
+)
+
+// StopSequences returns the stop field as a list, it may be a string or an array.
+func StopSequences(api_request official_types.APIRequest) []string {
+	var stop []string
+	switch v := api_request.Stop.(type) {
+	case string:
+		if v != "" {
+			stop = append(stop, v)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if sequence, ok := item.(string); ok && sequence != "" {
+				stop = append(stop, sequence)
+			}
+		}
+	}
+	return stop
+}
+
+// MaxTokens returns the completion token limit, 0 means no limit.
+func MaxTokens(api_request official_types.APIRequest) int {
+	if api_request.MaxCompletionTokens != nil {
+		return *api_request.MaxCompletionTokens
+	}
+	if api_request.MaxTokens != nil {
+		return *api_request.MaxTokens
+	}
+	return 0
+}
+
+// CheckParams validates the sampling parameters. It returns the offending param and a message,
+// or an empty param if the request is fine. In strict mode parameters which can not be
+// enforced by the gateway are rejected unless they hold their default value.
+func CheckParams(api_request official_types.APIRequest, strict bool, max_choices int) (string, string) {
+	if api_request.N < 0 || api_request.N > max_choices {
+		return "n", "n must be between 1 and " + strconv.Itoa(max_choices)
+	}
+	if max_tokens := MaxTokens(api_request); max_tokens < 0 {
+		return "max_tokens", "max_tokens must be a positive integer"
+	}
+	if api_request.Stop != nil {
+		switch v := api_request.Stop.(type) {
+		case string:
+		case []interface{}:
+			if len(v) > 4 {
+				return "stop", "stop may contain at most 4 sequences"
+			}
+		default:
+			return "stop", "stop must be a string or an array of strings"
+		}
+	}
+	if message := checkResponseFormat(api_request); message != "" {
+		return "response_format", message
+	}
+	if !strict {
+		return "", ""
+	}
+	if api_request.Temperature != nil && *api_request.Temperature != 1 {
+		return "temperature", unsupportedMessage("temperature")
+	}
+	if api_request.TopP != nil && *api_request.TopP != 1 {
+		return "top_p", unsupportedMessage("top_p")
+	}
+	if api_request.PresencePenalty != nil && *api_request.PresencePenalty != 0 {
+		return "presence_penalty", unsupportedMessage("presence_penalty")
+	}
+	if api_request.FrequencyPenalty != nil && *api_request.FrequencyPenalty != 0 {
+		return "frequency_penalty", unsupportedMessage("frequency_penalty")
+	}
+	if api_request.Seed != nil {
+		return "seed", unsupportedMessage("seed")
+	}
+	if len(api_request.LogitBias) != 0 {
+		return "logit_bias", unsupportedMessage("logit_bias")
+	}
+	if api_request.Logprobs {
+		return "logprobs", unsupportedMessage("logprobs")
+	}
+	return "", ""
+}
+
+func unsupportedMessage(param string) string {
+	return param + " is not supported by this endpoint, remove it or disable STRICT_PARAMS"
+}
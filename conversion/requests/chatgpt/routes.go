@@ -0,0 +1,160 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	chatgpt_types "freechatgpt/internal/chatgpt"
+)
+
+// Route maps client model names to an upstream model. Model may contain * wildcards,
+// Slug and GizmoID may refer to the wildcards as $1, $2 or ${1}. A Slug matching another
+// route is resolved again, the first route's mode, accounts and system prompt are kept.
+type Route struct {
+	Model    string   `json:"model"`
+	Slug     string   `json:"slug"`
+	Mode     string   `json:"mode,omitempty"`
+	GizmoID  string   `json:"gizmo_id,omitempty"`
+	Accounts []string `json:"accounts,omitempty"`
+	System   string   `json:"system,omitempty"`
+	pattern  *regexp.Regexp
+}
+
+type routesFile struct {
+	Routes []Route `json:"routes"`
+}
+
+// defaultRoutes are tried after the configured routes and the upstream model slugs
+var defaultRoutes = compileRoutes([]Route{
+	{Model: "*-gizmo-g-*", Slug: "$1", Mode: "gizmo_interaction", GizmoID: "g-$2"},
+	{Model: "gpt-3.5*", Slug: "gpt-4o-mini"},
+	{Model: "gpt-4o-mini*", Slug: "gpt-4o-mini"},
+	{Model: "gpt-4o*", Slug: "gpt-4o"},
+	{Model: "gpt-4*", Slug: "gpt-4"},
+	{Model: "o1-mini*", Slug: "o1-mini"},
+	{Model: "o1*", Slug: "o1"},
+})
+
+var (
+	routes     []Route
+	routesLock sync.RWMutex
+)
+
+func compileRoutes(list []Route) []Route {
+	for i := range list {
+		parts := strings.Split(list[i].Model, "*")
+		for j, part := range parts {
+			parts[j] = regexp.QuoteMeta(part)
+		}
+		list[i].pattern = regexp.MustCompile("^" + strings.Join(parts, "(.*?)") + "$")
+	}
+	return list
+}
+
+// LoadRoutes reads the routing table from path, a missing file clears it
+func LoadRoutes(path string) error {
+	var file routesFile
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &file)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	loaded := compileRoutes(file.Routes)
+	routesLock.Lock()
+	routes = loaded
+	routesLock.Unlock()
+	return nil
+}
+
+// WatchRoutes loads the routing table and reloads it whenever path changes
+func WatchRoutes(path string) {
+	var modified time.Time
+	reload := func() {
+		var mod_time time.Time
+		if stat, err := os.Stat(path); err == nil {
+			mod_time = stat.ModTime()
+		}
+		if mod_time.Equal(modified) {
+			return
+		}
+		modified = mod_time
+		if err := LoadRoutes(path); err != nil {
+			slog.Error("Failed to load model routes", "path", path, "error", err)
+			return
+		}
+		slog.Info("Loaded model routes", "path", path)
+	}
+	reload()
+	go func() {
+		for {
+			time.Sleep(5 * time.Second)
+			reload()
+		}
+	}()
+}
+
+// ResolveModel returns the route of a client model name with the wildcards expanded.
+// Upstream model slugs resolve to themselves unless a configured route matches.
+func ResolveModel(model string) Route {
+	routesLock.RLock()
+	configured := routes
+	routesLock.RUnlock()
+	return resolve(model, configured, 0)
+}
+
+func resolve(model string, configured []Route, depth int) Route {
+	route, ok := matchRoute(model, configured)
+	if !ok {
+		if chatgpt_types.KnownModels()[model] {
+			return Route{Model: model, Slug: model}
+		}
+		route, ok = matchRoute(model, defaultRoutes)
+		if !ok {
+			return Route{Model: model, Slug: model}
+		}
+	}
+	if route.Slug == "" {
+		route.Slug = model
+	}
+	if route.Slug != model && depth < 4 {
+		inner := resolve(route.Slug, configured, depth+1)
+		route.Slug = inner.Slug
+		if route.Mode == "" {
+			route.Mode, route.GizmoID = inner.Mode, inner.GizmoID
+		}
+		if len(route.Accounts) == 0 {
+			route.Accounts = inner.Accounts
+		}
+		if route.System == "" {
+			route.System = inner.System
+		}
+	}
+	return route
+}
+
+func matchRoute(model string, list []Route) (Route, bool) {
+	for _, route := range list {
+		if !route.pattern.MatchString(model) {
+			continue
+		}
+		result := route
+		result.Model = model
+		if route.Slug != "" {
+			result.Slug = route.pattern.ReplaceAllString(model, route.Slug)
+		}
+		if route.GizmoID != "" {
+			result.GizmoID = route.pattern.ReplaceAllString(model, route.GizmoID)
+		}
+		return result, true
+	}
+	return Route{}, false
+}
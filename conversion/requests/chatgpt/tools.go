@@ -0,0 +1,120 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"strings"
+)
+
+// NormalizeTools folds the legacy functions/function_call fields into tools/tool_choice.
+// It returns true when the request used the legacy fields.
+func NormalizeTools(api_request *official_types.APIRequest) bool {
+	if len(api_request.Tools) != 0 || len(api_request.Functions) == 0 {
+		return false
+	}
+	for _, function := range api_request.Functions {
+		api_request.Tools = append(api_request.Tools, official_types.Tool{Type: "function", Function: function})
+	}
+	switch v := api_request.FunctionCall.(type) {
+	case string:
+		api_request.ToolChoice = v
+	case map[string]interface{}:
+		api_request.ToolChoice = map[string]interface{}{"type": "function", "function": v}
+	}
+	return true
+}
+
+// ToolsEnabled reports whether tool definitions should be sent upstream.
+func ToolsEnabled(api_request official_types.APIRequest) bool {
+	if len(api_request.Tools) == 0 {
+		return false
+	}
+	choice, _ := api_request.ToolChoice.(string)
+	return choice != "none"
+}
+
+func buildToolPrompt(api_request official_types.APIRequest) string {
+	var functions []official_types.Function
+	for _, tool := range api_request.Tools {
+		if tool.Type == "" || tool.Type == "function" {
+			functions = append(functions, tool.Function)
+		}
+	}
+	definitions, _ := json.MarshalIndent(functions, "", "  ")
+	var prompt strings.Builder
+	prompt.WriteString("# Tools\n\nYou can call the following functions to help answer the user. Function definitions (parameters are JSON Schema):\n")
+	prompt.Write(definitions)
+	prompt.WriteString("\n\nTo call functions, reply with exactly one block in this format and write nothing after it:\n")
+	prompt.WriteString(official_types.ToolCallsOpen + "\n[{\"name\": \"<function name>\", \"arguments\": {<arguments as a JSON object>}}]\n" + official_types.ToolCallsClose + "\n")
+	if api_request.ParallelToolCalls != nil && !*api_request.ParallelToolCalls {
+		prompt.WriteString("Call at most one function per reply.\n")
+	} else {
+		prompt.WriteString("You may call several functions at once by adding more objects to the array.\n")
+	}
+	prompt.WriteString("Function results are sent back to you inside <tool_result> blocks. If no function is needed, reply normally without the block.")
+	switch v := api_request.ToolChoice.(type) {
+	case string:
+		if v == "required" {
+			prompt.WriteString("\nYou must call at least one function in this reply.")
+		}
+	case map[string]interface{}:
+		function, _ := v["function"].(map[string]interface{})
+		if name, ok := function["name"].(string); ok {
+			prompt.WriteString("\nYou must call the function `" + name + "` in this reply.")
+		}
+	}
+	return prompt.String()
+}
+
+type promptToolCall struct {
+	Name      string      `json:"name"`
+	Arguments interface{} `json:"arguments"`
+}
+
+func formatToolCalls(content string, calls []official_types.ToolCall) string {
+	var prompt_calls []promptToolCall
+	for _, call := range calls {
+		var arguments interface{}
+		if json.Unmarshal([]byte(call.Function.Arguments), &arguments) != nil {
+			arguments = call.Function.Arguments
+		}
+		prompt_calls = append(prompt_calls, promptToolCall{Name: call.Function.Name, Arguments: arguments})
+	}
+	calls_json, _ := json.Marshal(prompt_calls)
+	if content != "" {
+		content += "\n"
+	}
+	return content + official_types.ToolCallsOpen + "\n" + string(calls_json) + "\n" + official_types.ToolCallsClose
+}
+
+func formatToolResult(id string, name string, content string) string {
+	header := "<tool_result"
+	if id != "" {
+		header += ` id="` + id + `"`
+	}
+	if name != "" {
+		header += ` name="` + name + `"`
+	}
+	return header + ">\n" + content + "\n</tool_result>"
+}
+
+// contentText flattens the text parts of a message content.
+func contentText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var texts []string
+		for _, item := range v {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if text, ok := itemMap["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package chatgpt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ExtractJSON returns the JSON value of a reply and its text. Code fences and text around a
+// single object or array are dropped.
+func ExtractJSON(text string) (interface{}, string, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text[3:], "json")
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "```"))
+	}
+	if value, err := decodeJSON(text); err == nil {
+		return value, text, nil
+	}
+	for _, brackets := range []string{"{}", "[]"} {
+		start := strings.IndexByte(text, brackets[0])
+		end := strings.LastIndexByte(text, brackets[1])
+		if start == -1 || end < start {
+			continue
+		}
+		if value, err := decodeJSON(text[start : end+1]); err == nil {
+			return value, text[start : end+1], nil
+		}
+	}
+	if text == "" {
+		return nil, "", errors.New("the reply is empty")
+	}
+	_, err := decodeJSON(text)
+	return nil, "", errors.New("the reply is not valid JSON: " + err.Error())
+}
+
+func decodeJSON(text string) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected text after the JSON value")
+	}
+	return value, nil
+}
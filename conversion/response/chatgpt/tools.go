@@ -0,0 +1,81 @@
+package chatgpt
+
+import (
+	"bytes"
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type parsedToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// ParseToolCalls splits the assistant text into its plain content and the tool calls it requested.
+func ParseToolCalls(text string) (string, []official_types.ToolCall) {
+	start := strings.Index(text, official_types.ToolCallsOpen)
+	if start == -1 {
+		return text, nil
+	}
+	body := text[start+len(official_types.ToolCallsOpen):]
+	if end := strings.Index(body, official_types.ToolCallsClose); end != -1 {
+		body = body[:end]
+	}
+	body = strings.TrimSpace(body)
+	body = strings.TrimPrefix(body, "```json")
+	body = strings.Trim(body, "`\n ")
+	var parsed []parsedToolCall
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		var single parsedToolCall
+		if err := json.Unmarshal([]byte(body), &single); err != nil || single.Name == "" {
+			return text, nil
+		}
+		parsed = []parsedToolCall{single}
+	}
+	var calls []official_types.ToolCall
+	for _, call := range parsed {
+		if call.Name == "" {
+			continue
+		}
+		calls = append(calls, official_types.ToolCall{
+			ID:       "call_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:24],
+			Type:     "function",
+			Function: official_types.FunctionCall{Name: call.Name, Arguments: argumentsString(call.Arguments)},
+		})
+	}
+	if len(calls) == 0 {
+		return text, nil
+	}
+	return strings.TrimSpace(text[:start]), calls
+}
+
+func argumentsString(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "{}"
+	}
+	if raw[0] == '"' {
+		var arguments string
+		if json.Unmarshal(raw, &arguments) == nil {
+			return arguments
+		}
+	}
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, raw) != nil {
+		return string(raw)
+	}
+	return compacted.String()
+}
+
+// PartialToolCallsOpen returns the length of the longest suffix of text that may start a tool calls block.
+func PartialToolCallsOpen(text string) int {
+	for i := len(official_types.ToolCallsOpen) - 1; i > 0; i-- {
+		if strings.HasSuffix(text, official_types.ToolCallsOpen[:i]) {
+			return i
+		}
+	}
+	return 0
+}
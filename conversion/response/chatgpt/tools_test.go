@@ -0,0 +1,64 @@
+package chatgpt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseToolCalls(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		content string
+		// calls are the name(arguments) of the parsed calls
+		calls []string
+	}{
+		{"plain text", "Hello", "Hello", nil},
+		{"single call", `<tool_calls>[{"name":"get_weather","arguments":{"city":"Paris"}}]</tool_calls>`, "", []string{`get_weather({"city":"Paris"})`}},
+		{"object instead of array", `<tool_calls>{"name":"get_weather","arguments":{"city":"Paris"}}</tool_calls>`, "", []string{`get_weather({"city":"Paris"})`}},
+		{"text before", "Let me check.\n<tool_calls>[{\"name\":\"a\",\"arguments\":{}}]</tool_calls>", "Let me check.", []string{"a({})"}},
+		{"code fence", "<tool_calls>\n```json\n[{\"name\":\"a\",\"arguments\":{\"x\": 1}}]\n```\n</tool_calls>", "", []string{`a({"x":1})`}},
+		{"string arguments", `<tool_calls>[{"name":"a","arguments":"{\"x\":1}"}]</tool_calls>`, "", []string{`a({"x":1})`}},
+		{"missing arguments", `<tool_calls>[{"name":"a"}]</tool_calls>`, "", []string{"a({})"}},
+		{"several calls", `<tool_calls>[{"name":"a","arguments":{}},{"name":"b","arguments":{}}]</tool_calls>`, "", []string{"a({})", "b({})"}},
+		{"unclosed", `<tool_calls>[{"name":"a","arguments":{}}]`, "", []string{"a({})"}},
+		{"invalid JSON", `<tool_calls>[{"name":</tool_calls>`, `<tool_calls>[{"name":</tool_calls>`, nil},
+		{"no name", `<tool_calls>[{"arguments":{}}]</tool_calls>`, `<tool_calls>[{"arguments":{}}]</tool_calls>`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, calls := ParseToolCalls(test.text)
+			if content != test.content {
+				t.Errorf("content %q, want %q", content, test.content)
+			}
+			var got []string
+			for _, call := range calls {
+				if call.Type != "function" || !strings.HasPrefix(call.ID, "call_") {
+					t.Errorf("call %+v", call)
+				}
+				got = append(got, call.Function.Name+"("+call.Function.Arguments+")")
+			}
+			if strings.Join(got, " ") != strings.Join(test.calls, " ") {
+				t.Errorf("calls %v, want %v", got, test.calls)
+			}
+		})
+	}
+}
+
+func TestPartialToolCallsOpen(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"Hello", 0},
+		{"Hello <", 1},
+		{"Hello <tool_", 6},
+		{"<tool_calls", 11},
+		{"<tool_calls>", 0},
+	}
+	for _, test := range tests {
+		if got := PartialToolCallsOpen(test.text); got != test.want {
+			t.Errorf("PartialToolCallsOpen(%q) = %d, want %d", test.text, got, test.want)
+		}
+	}
+}
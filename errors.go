@@ -0,0 +1,51 @@
+package main
+
+import (
+	"freechatgpt/typings/anthropic"
+	official_types "freechatgpt/typings/official"
+
+	"github.com/gin-gonic/gin"
+)
+
+// abortWithError responds with an OpenAI error object. Once a stream has begun the error is
+// sent as an SSE event instead, which the OpenAI SDKs raise as an APIError.
+func abortWithError(c *gin.Context, err error) {
+	api_err := official_types.AsAPIError(err)
+	c.Set("error", api_err)
+	if c.GetBool("anthropic") {
+		abortWithAnthropicError(c, api_err)
+		return
+	}
+	if c.Writer.Written() {
+		c.Writer.WriteString("data: " + api_err.String() + "\n\n")
+		c.Writer.Flush()
+		c.Abort()
+		return
+	}
+	if api_err.RetryAfter != "" {
+		c.Header("Retry-After", api_err.RetryAfter)
+	}
+	c.AbortWithStatusJSON(api_err.Status, official_types.ErrorResponse{Error: api_err})
+}
+
+func invalidJSONError(err error) *official_types.APIError {
+	return official_types.InvalidRequestError("", "Request must be proper JSON: "+err.Error())
+}
+
+// anthropicDialect makes abortWithError answer in the format of the Anthropic API
+func anthropicDialect(c *gin.Context) {
+	c.Set("anthropic", true)
+}
+
+func abortWithAnthropicError(c *gin.Context, api_err *official_types.APIError) {
+	if c.Writer.Written() {
+		c.Writer.WriteString(anthropic.StreamEvent{Type: "error", Error: anthropic.NewError(api_err)}.String())
+		c.Writer.Flush()
+		c.Abort()
+		return
+	}
+	if api_err.RetryAfter != "" {
+		c.Header("Retry-After", api_err.RetryAfter)
+	}
+	c.AbortWithStatusJSON(api_err.Status, anthropic.ErrorResponse{Type: "error", Error: anthropic.NewError(api_err)})
+}
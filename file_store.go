@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"freechatgpt/internal/fileutil"
+	official_types "freechatgpt/typings/official"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const filesFile = "files.json"
+
+// storedFile is a file uploaded through /v1/files, its content is kept in the files directory
+type storedFile struct {
+	File *official_types.File `json:"file"`
+	Mime string               `json:"mime"`
+	// Key is the ID of the API key which uploaded the file, only that key can use it
+	Key string `json:"key,omitempty"`
+}
+
+type FileStore struct {
+	lock  sync.Mutex
+	files map[string]*storedFile
+	dir   string
+}
+
+var fileStore = &FileStore{files: map[string]*storedFile{}}
+
+var errFileNotFound = errors.New("file not found")
+
+// Start loads files.json, the content of the files is kept in dir
+func (s *FileStore) Start(dir string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dir = dir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		slog.Error("Failed to create the files directory", "path", dir, "error", err)
+	}
+	data, err := os.ReadFile(filesFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		slog.Error("Failed to load stored files", "path", filesFile, "error", err)
+	}
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id))
+}
+
+// Create stores data as a new file of key
+func (s *FileStore) Create(data []byte, filename string, mime string, purpose string, key string) (*official_types.File, error) {
+	file := official_types.NewFile(filename, purpose, len(data))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := fileutil.WriteAtomic(s.path(file.ID), data, 0600); err != nil {
+		return nil, err
+	}
+	s.files[file.ID] = &storedFile{File: file, Mime: mime, Key: key}
+	s.save()
+	return file, nil
+}
+
+// Get returns the file id uploaded with key
+func (s *FileStore) Get(id string, key string) *official_types.File {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.files[id]
+	if stored == nil || stored.Key != key {
+		return nil
+	}
+	return stored.File
+}
+
+// List returns the files of key with purpose, or all of them, the newest first
+func (s *FileStore) List(key string, purpose string) []*official_types.File {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	files := []*official_types.File{}
+	for _, stored := range s.files {
+		if stored.Key == key && (purpose == "" || stored.File.Purpose == purpose) {
+			files = append(files, stored.File)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt != files[j].CreatedAt {
+			return files[i].CreatedAt > files[j].CreatedAt
+		}
+		return files[i].ID > files[j].ID
+	})
+	return files
+}
+
+// Content returns the content and mime type of the file id uploaded with key
+func (s *FileStore) Content(id string, key string) ([]byte, string, error) {
+	if s.Get(id, key) == nil {
+		return nil, "", errFileNotFound
+	}
+	data, mime, _, err := s.Open(id)
+	return data, mime, err
+}
+
+// Open returns the content, mime type and name of the file id. It serves chat messages, which
+// are checked against the key of the request before.
+func (s *FileStore) Open(id string) ([]byte, string, string, error) {
+	s.lock.Lock()
+	stored := s.files[id]
+	s.lock.Unlock()
+	if stored == nil {
+		return nil, "", "", errFileNotFound
+	}
+	data, err := os.ReadFile(s.path(id))
+	return data, stored.Mime, stored.File.Filename, err
+}
+
+// Delete removes the file id uploaded with key, it returns false if there is none
+func (s *FileStore) Delete(id string, key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.files[id]
+	if stored == nil || stored.Key != key {
+		return false
+	}
+	delete(s.files, id)
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove a file", "id", id, "error", err)
+	}
+	s.save()
+	return true
+}
+
+// save writes the file list to files.json
+func (s *FileStore) save() {
+	data, err := json.Marshal(s.files)
+	if err == nil {
+		err = fileutil.WriteAtomic(filesFile, data, 0600)
+	}
+	if err != nil {
+		slog.Error("Failed to save stored files", "path", filesFile, "error", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	official_types "freechatgpt/typings/official"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFileSize is the largest file chatgpt.com accepts
+const maxFileSize = 512 << 20
+
+func fileNotFoundError(id string) *official_types.APIError {
+	api_err := official_types.NewAPIError(404, "invalid_request_error", nil, "No such File object: "+id)
+	api_err.Param = "id"
+	return api_err
+}
+
+// checkFiles rejects chat requests referring to files the API key of the request did not upload
+func checkFiles(c *gin.Context, api_request official_types.APIRequest) *official_types.APIError {
+	for _, id := range api_request.FileIDs() {
+		if fileStore.Get(id, requestKeyID(c)) == nil {
+			return official_types.InvalidRequestError("messages", "File '"+id+"' not found, upload it through /v1/files first")
+		}
+	}
+	return nil
+}
+
+// fileMime guesses the mime type of an upload from its name, then from its content
+func fileMime(filename string, data []byte) string {
+	mime_type := mime.TypeByExtension(filepath.Ext(filename))
+	if mime_type == "" {
+		mime_type = http.DetectContentType(data)
+	}
+	if idx := strings.Index(mime_type, ";"); idx != -1 {
+		mime_type = mime_type[:idx]
+	}
+	return mime_type
+}
+
+// createFileHandler stores an uploaded file. It is uploaded to an account once a chat message
+// refers to it, and only once per account.
+func createFileHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxFileSize+1<<20)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		abortWithError(c, official_types.InvalidRequestError("file", "Request must has proper file: "+err.Error()))
+		return
+	}
+	defer file.Close()
+	purpose := c.Request.FormValue("purpose")
+	if !containsString(official_types.FilePurposes, purpose) {
+		abortWithError(c, official_types.InvalidRequestError("purpose", "purpose must be one of "+strings.Join(official_types.FilePurposes, ", ")))
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxFileSize+1))
+	if err != nil {
+		abortWithError(c, official_types.InvalidRequestError("file", "Unable to read the file: "+err.Error()))
+		return
+	}
+	if len(data) > maxFileSize {
+		abortWithError(c, official_types.NewAPIError(413, "invalid_request_error", nil, "File is larger than "+strconv.Itoa(maxFileSize>>20)+" MB"))
+		return
+	}
+	if len(data) == 0 {
+		abortWithError(c, official_types.InvalidRequestError("file", "File is empty"))
+		return
+	}
+	filename := filepath.Base(header.Filename)
+	stored, err := fileStore.Create(data, filename, fileMime(filename, data), purpose, requestKeyID(c))
+	if err != nil {
+		abortWithError(c, official_types.ServerError("Unable to store the file: "+err.Error()))
+		return
+	}
+	c.JSON(200, stored)
+}
+
+func listFilesHandler(c *gin.Context) {
+	files := fileStore.List(requestKeyID(c), c.Query("purpose"))
+	if c.Query("order") == "asc" {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+	if after := c.Query("after"); after != "" {
+		for i, file := range files {
+			if file.ID == after {
+				files = files[i+1:]
+				break
+			}
+		}
+	}
+	has_more := false
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 && limit < len(files) {
+		files, has_more = files[:limit], true
+	}
+	c.JSON(200, official_types.NewFileList(files, has_more))
+}
+
+func getFileHandler(c *gin.Context) {
+	file := fileStore.Get(c.Param("id"), requestKeyID(c))
+	if file == nil {
+		abortWithError(c, fileNotFoundError(c.Param("id")))
+		return
+	}
+	c.JSON(200, file)
+}
+
+func fileContentHandler(c *gin.Context) {
+	data, mime_type, err := fileStore.Content(c.Param("id"), requestKeyID(c))
+	if err == errFileNotFound {
+		abortWithError(c, fileNotFoundError(c.Param("id")))
+		return
+	}
+	if err != nil {
+		abortWithError(c, official_types.ServerError("Unable to read the file: "+err.Error()))
+		return
+	}
+	c.Data(200, mime_type, data)
+}
+
+func deleteFileHandler(c *gin.Context) {
+	if !fileStore.Delete(c.Param("id"), requestKeyID(c)) {
+		abortWithError(c, fileNotFoundError(c.Param("id")))
+		return
+	}
+	c.JSON(200, gin.H{"id": c.Param("id"), "object": "file", "deleted": true})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setFiles gives a test an empty file store in a temporary directory, files.json is written there
+func setFiles(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	saved := fileStore
+	fileStore = &FileStore{files: map[string]*storedFile{}}
+	fileStore.Start(filepath.Join(dir, "files"))
+	t.Cleanup(func() {
+		fileStore = saved
+		os.Chdir(cwd)
+	})
+}
+
+// uploadFile sends a multipart upload with the key, an empty filename leaves the file out
+func uploadFile(t *testing.T, key string, filename string, content string, purpose string) (*httptest.ResponseRecorder, *official_types.File) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if filename != "" {
+		part, _ := form.CreateFormFile("file", filename)
+		part.Write([]byte(content))
+	}
+	form.WriteField("purpose", purpose)
+	form.Close()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	request.Header.Set("Authorization", "Bearer "+key)
+	newRouter().ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		return recorder, nil
+	}
+	var file official_types.File
+	if err := json.Unmarshal(recorder.Body.Bytes(), &file); err != nil {
+		t.Fatal(err)
+	}
+	return recorder, &file
+}
+
+func TestCreateFile(t *testing.T) {
+	setFiles(t)
+	setKeys(t, map[string]*APIKey{"alice": {ID: "alice"}})
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		purpose  string
+		status   int
+		param    string
+	}{
+		{"text", "notes.txt", "Hello", "user_data", 200, ""},
+		{"path in the name", "../../notes.txt", "Hello", "assistants", 200, ""},
+		{"no file", "", "", "user_data", 400, "file"},
+		{"empty file", "empty.txt", "", "user_data", 400, "file"},
+		{"unknown purpose", "notes.txt", "Hello", "training", 400, "purpose"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, file := uploadFile(t, "alice", test.filename, test.content, test.purpose)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", recorder.Code, test.status, recorder.Body.String())
+			}
+			if test.status != 200 {
+				var body struct {
+					Error official_types.APIError `json:"error"`
+				}
+				json.Unmarshal(recorder.Body.Bytes(), &body)
+				if body.Error.Param != test.param {
+					t.Errorf("error %+v, want param %q", body.Error, test.param)
+				}
+				return
+			}
+			if file.Object != "file" || file.Filename != "notes.txt" || file.Bytes != len(test.content) || file.Purpose != test.purpose {
+				t.Errorf("file %+v", file)
+			}
+			if _, err := os.Stat(fileStore.path(file.ID)); err != nil {
+				t.Errorf("content not stored: %v", err)
+			}
+		})
+	}
+}
+
+func TestFiles(t *testing.T) {
+	setFiles(t)
+	setKeys(t, map[string]*APIKey{"alice": {ID: "alice"}, "bob": {ID: "bob"}})
+	_, notes := uploadFile(t, "alice", "notes.txt", "Hello", "user_data")
+	_, image := uploadFile(t, "alice", "pixel.png", "\x89PNG\r\n\x1a\n", "vision")
+	_, other := uploadFile(t, "bob", "other.txt", "Bye", "user_data")
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		status int
+		// body is the content of a download, or the IDs of a list
+		body string
+		ids  []string
+	}{
+		{"list", http.MethodGet, "/v1/files", "alice", 200, "", []string{notes.ID, image.ID}},
+		{"list by purpose", http.MethodGet, "/v1/files?purpose=vision", "alice", 200, "", []string{image.ID}},
+		{"list of another key", http.MethodGet, "/v1/files", "bob", 200, "", []string{other.ID}},
+		{"get", http.MethodGet, "/v1/files/" + notes.ID, "alice", 200, "", nil},
+		{"get of another key", http.MethodGet, "/v1/files/" + notes.ID, "bob", 404, "", nil},
+		{"content", http.MethodGet, "/v1/files/" + notes.ID + "/content", "alice", 200, "Hello", nil},
+		{"content of another key", http.MethodGet, "/v1/files/" + notes.ID + "/content", "bob", 404, "", nil},
+		{"delete of another key", http.MethodDelete, "/v1/files/" + notes.ID, "bob", 404, "", nil},
+		{"delete", http.MethodDelete, "/v1/files/" + notes.ID, "alice", 200, "", nil},
+		{"get deleted", http.MethodGet, "/v1/files/" + notes.ID, "alice", 404, "", nil},
+		{"content deleted", http.MethodGet, "/v1/files/" + notes.ID + "/content", "alice", 404, "", nil},
+		{"list after delete", http.MethodGet, "/v1/files", "alice", 200, "", []string{image.ID}},
+	}
+	for _, test := range tests {
+		recorder, api_err := sendWithKey(t, test.method, test.path, "Bearer "+test.key, "")
+		if recorder.Code != test.status {
+			t.Fatalf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+		}
+		if test.status == 404 && api_err.Param != "id" {
+			t.Errorf("%s: error %+v", test.name, api_err)
+		}
+		if test.body != "" && recorder.Body.String() != test.body {
+			t.Errorf("%s: content %q, want %q", test.name, recorder.Body.String(), test.body)
+		}
+		if test.ids == nil {
+			continue
+		}
+		var list official_types.FileList
+		json.Unmarshal(recorder.Body.Bytes(), &list)
+		got := map[string]bool{}
+		for _, file := range list.Data {
+			got[file.ID] = true
+		}
+		if len(list.Data) != len(test.ids) {
+			t.Errorf("%s: listed %d files, want %d", test.name, len(list.Data), len(test.ids))
+		}
+		for _, id := range test.ids {
+			if !got[id] {
+				t.Errorf("%s: %s not listed", test.name, id)
+			}
+		}
+	}
+	if _, err := os.Stat(fileStore.path(notes.ID)); !os.IsNotExist(err) {
+		t.Errorf("content of a deleted file left: %v", err)
+	}
+}
+
+func TestListFilesPages(t *testing.T) {
+	setFiles(t)
+	setKeys(t, map[string]*APIKey{"alice": {ID: "alice"}})
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		uploadFile(t, "alice", name, name, "user_data")
+	}
+	list := func(query string) official_types.FileList {
+		recorder, _ := sendWithKey(t, http.MethodGet, "/v1/files"+query, "Bearer alice", "")
+		var list official_types.FileList
+		json.Unmarshal(recorder.Body.Bytes(), &list)
+		return list
+	}
+	all := list("")
+	if len(all.Data) != 3 || all.HasMore || *all.FirstID != all.Data[0].ID || *all.LastID != all.Data[2].ID {
+		t.Fatalf("list %+v", all)
+	}
+	tests := []struct {
+		query   string
+		ids     []string
+		hasMore bool
+	}{
+		{"?limit=2", []string{all.Data[0].ID, all.Data[1].ID}, true},
+		{"?after=" + all.Data[0].ID, []string{all.Data[1].ID, all.Data[2].ID}, false},
+		{"?after=" + all.Data[0].ID + "&limit=1", []string{all.Data[1].ID}, true},
+		{"?order=asc", []string{all.Data[2].ID, all.Data[1].ID, all.Data[0].ID}, false},
+	}
+	for _, test := range tests {
+		page := list(test.query)
+		if len(page.Data) != len(test.ids) || page.HasMore != test.hasMore {
+			t.Errorf("%s: page %+v, want %v", test.query, page, test.ids)
+			continue
+		}
+		for i, file := range page.Data {
+			if file.ID != test.ids[i] {
+				t.Errorf("%s: file %d is %s, want %s", test.query, i, file.ID, test.ids[i])
+			}
+		}
+	}
+}
+
+func TestChatCompletionFileAccess(t *testing.T) {
+	setFiles(t)
+	setKeys(t, map[string]*APIKey{"alice": {ID: "alice"}, "bob": {ID: "bob"}})
+	_, notes := uploadFile(t, "alice", "notes.txt", "Hello", "user_data")
+	body := `{"model":"gpt-4o-mini","messages":[{"role":"user","content":[{"type":"text","text":"Summarize"},{"type":"file","file":{"file_id":"` + notes.ID + `"}}]}]}`
+	tests := []struct {
+		key    string
+		status int
+	}{
+		{"alice", 200},
+		{"bob", 400},
+	}
+	for _, test := range tests {
+		recorder, api_err := sendWithKey(t, http.MethodPost, "/v1/chat/completions", "Bearer "+test.key, body)
+		if recorder.Code != test.status {
+			t.Fatalf("%s: status %d, want %d: %+v", test.key, recorder.Code, test.status, api_err)
+		}
+		if test.status == 400 && api_err.Param != "messages" {
+			t.Errorf("%s: error %+v", test.key, api_err)
+		}
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	setFiles(t)
+	file, err := fileStore.Create([]byte("Hello"), "notes.txt", "text/plain", "user_data", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A restart finds the file in files.json
+	reloaded := &FileStore{files: map[string]*storedFile{}}
+	reloaded.Start(fileStore.dir)
+	data, mime_type, err := reloaded.Content(file.ID, "alice")
+	if err != nil || string(data) != "Hello" || mime_type != "text/plain" {
+		t.Errorf("reloaded content %q, %q, %v", data, mime_type, err)
+	}
+}
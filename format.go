@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	chatgpt_response_converter "freechatgpt/conversion/response/chatgpt"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/jsonschema"
+	"freechatgpt/internal/tokenizer"
+	"freechatgpt/internal/tokens"
+	official_types "freechatgpt/typings/official"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFormatRetries is how often a reply which does not match response_format is asked again
+const maxFormatRetries = 2
+
+// choiceWriter is the writer of one choice, it can be retried until something was written
+type choiceWriter interface {
+	completionWriter
+	Written() bool
+	Reset()
+}
+
+// formatWriter holds back a reply until it matches response_format, only the JSON is passed on
+type formatWriter struct {
+	*limitWriter
+	// schema is nil for json_object, tools lets tool calls pass without a check
+	schema *jsonschema.Schema
+	tools  bool
+	text   strings.Builder
+	reason string
+}
+
+func (w *formatWriter) WriteDelta(text string) error {
+	w.text.WriteString(text)
+	return nil
+}
+
+func (w *formatWriter) Finish(reason string) error {
+	w.reason = reason
+	return nil
+}
+
+// Check passes the reply on if it matches response_format and returns the problem otherwise.
+// An APIError can not be fixed by asking again.
+func (w *formatWriter) Check() error {
+	text := w.text.String()
+	if w.tools {
+		if _, calls := chatgpt_response_converter.ParseToolCalls(text); len(calls) != 0 {
+			return w.pass(text)
+		}
+	}
+	value, text, err := chatgpt_response_converter.ExtractJSON(text)
+	if err != nil {
+		return err
+	}
+	if w.schema == nil {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return errors.New("the reply must be a JSON object")
+		}
+	} else if err := w.schema.Validate(value); err != nil {
+		return err
+	}
+	// A cut JSON document is useless, a reply which does not fit is an error instead
+	if w.maxTokens > 0 {
+		if count := tokenizer.Count(w.model, text); count > w.maxTokens {
+			return official_types.InvalidRequestError("max_tokens", "The JSON reply needs "+strconv.Itoa(count)+" tokens, more than max_tokens allows ("+strconv.Itoa(w.maxTokens)+")")
+		}
+	}
+	if idx, sequence := firstStop(text, w.stop); idx != -1 {
+		return official_types.InvalidRequestError("stop", "The JSON reply contains the stop sequence "+strconv.Quote(sequence))
+	}
+	return w.pass(text)
+}
+
+func (w *formatWriter) pass(text string) error {
+	if err := w.limitWriter.WriteDelta(text); err != nil && err != errChoiceDone {
+		return official_types.AsAPIError(err)
+	}
+	if err := w.limitWriter.Finish(w.reason); err != nil && err != errChoiceDone {
+		return official_types.AsAPIError(err)
+	}
+	return nil
+}
+
+// Reset forgets the reply before it is asked again or retried
+func (w *formatWriter) Reset() {
+	w.text.Reset()
+	w.reason = ""
+	w.limitWriter.Reset()
+}
+
+// checkFormat passes on a reply which matches response_format. Other replies are asked again, in
+// the same upstream conversation or with the whole history when there is none, up to
+// maxFormatRetries times.
+func checkFormat(ctx context.Context, c *gin.Context, log *slog.Logger, writer *formatWriter, original_request official_types.APIRequest, account string, secret tokens.Secret, proxy_url string, position chatgpt.ContinueInfo) (chatgpt.ContinueInfo, error) {
+	for retry := 0; ; retry++ {
+		problem := writer.Check()
+		if problem == nil {
+			return position, nil
+		}
+		if api_err, ok := problem.(*official_types.APIError); ok {
+			return position, api_err
+		}
+		if retry == maxFormatRetries {
+			return position, official_types.UpstreamError(502, "invalid_response_format", "The reply did not match response_format after "+strconv.Itoa(retry+1)+" attempts: "+problem.Error())
+		}
+		log.Info("Reply does not match response_format, asking again", "error", problem)
+		followup := official_types.APIRequest{Model: original_request.Model, ResponseFormat: original_request.ResponseFormat}
+		var resume *chatgpt.ConversationInfo
+		if position.ConversationID != "" {
+			resume = &chatgpt.ConversationInfo{ContinueInfo: position}
+		} else {
+			followup = original_request
+			// The reply and the correction must not be appended to the messages of the request
+			followup.Messages = followup.Messages[:len(followup.Messages):len(followup.Messages)]
+			followup.AddAssistantMessage(writer.text.String(), nil)
+		}
+		followup.AddMessage("user", "Your reply is not valid: "+problem.Error()+".\nReply again with only the corrected JSON and no other text.")
+		writer.Reset()
+		var err error
+		_, position, err = runChoice(ctx, c, log, followup, account, secret, proxy_url, resume, writer)
+		if err != nil {
+			return position, err
+		}
+	}
+}
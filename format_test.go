@@ -0,0 +1,76 @@
+package main
+
+import (
+	"freechatgpt/internal/jsonschema"
+	official_types "freechatgpt/typings/official"
+	"strings"
+	"testing"
+)
+
+func TestFormatWriterCheck(t *testing.T) {
+	schema, err := jsonschema.Compile(map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"name"},
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		schema    *jsonschema.Schema
+		reply     string
+		stop      []string
+		maxTokens int
+		// want is the text passed on, or the start of the problem
+		want     string
+		apiError string
+	}{
+		{"json object", nil, `{"a": 1}`, nil, 0, `{"a": 1}`, ""},
+		{"code fence", nil, "Sure:\n```json\n{\"a\": 1}\n```", nil, 0, `{"a": 1}`, ""},
+		{"not an object", nil, `[1]`, nil, 0, "the reply must be a JSON object", ""},
+		{"not json", nil, `hello`, nil, 0, "the reply is not valid JSON", ""},
+		{"schema", schema, `{"name": "Ann"}`, nil, 0, `{"name": "Ann"}`, ""},
+		{"schema mismatch", schema, `{"age": 3}`, nil, 0, `$: missing required property "name"`, ""},
+		{"fits max_tokens", schema, `{"name": "Ann"}`, nil, 100, `{"name": "Ann"}`, ""},
+		{"exceeds max_tokens", schema, `{"name": "Ann"}`, nil, 2, "", "max_tokens"},
+		{"contains stop", schema, `{"name": "Ann"}`, []string{"Ann"}, 0, "", "stop"},
+		{"stop outside the JSON", schema, "```json\n{\"name\": \"Ann\"}\n```", []string{"```"}, 0, `{"name": "Ann"}`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			collected := &collectWriter{}
+			writer := &formatWriter{
+				limitWriter: &limitWriter{completionWriter: collected, model: "gpt-4o", stop: test.stop, maxTokens: test.maxTokens},
+				schema:      test.schema,
+			}
+			writer.WriteDelta(test.reply)
+			writer.Finish("stop")
+			problem := writer.Check()
+			if test.apiError != "" {
+				api_err, ok := problem.(*official_types.APIError)
+				if !ok || api_err.Type != "invalid_request_error" || api_err.Param != test.apiError {
+					t.Fatalf("problem %v, want an invalid_request_error of %s", problem, test.apiError)
+				}
+				if collected.text.Len() != 0 {
+					t.Errorf("passed on %q", collected.text.String())
+				}
+				return
+			}
+			if collected.text.Len() == 0 {
+				if problem == nil || !strings.HasPrefix(problem.Error(), test.want) {
+					t.Fatalf("problem %v, want %q", problem, test.want)
+				}
+				return
+			}
+			if problem != nil {
+				t.Fatalf("unexpected problem: %v", problem)
+			}
+			if collected.text.String() != test.want || collected.reason != "stop" {
+				t.Errorf("passed on %q finishing with %q, want %q", collected.text.String(), collected.reason, test.want)
+			}
+		})
+	}
+}
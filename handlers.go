@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
 	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
+	chatgpt_response_converter "freechatgpt/conversion/response/chatgpt"
 	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/logging"
 	"freechatgpt/internal/tokens"
+	"freechatgpt/internal/tracing"
 	official_types "freechatgpt/typings/official"
+	"log/slog"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	http "github.com/bogdanfinn/fhttp"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var (
@@ -40,9 +52,10 @@ func tokensHandler(c *gin.Context) {
 		c.String(400, "tokens not provided")
 		return
 	}
-	ACCESS_TOKENS = tokens.NewAccessToken(request_tokens)
+	ACCESS_TOKENS.Replace(request_tokens)
 	ACCESS_TOKENS.Save()
-	validAccounts = ACCESS_TOKENS.GetKeys()
+	accountPool.Reset(request_tokens)
+	go refreshModels()
 	c.String(200, "tokens updated")
 }
 func optionsHandler(c *gin.Context) {
@@ -55,152 +68,283 @@ func optionsHandler(c *gin.Context) {
 	})
 }
 
-func simulateModel(c *gin.Context) {
-	c.JSON(200, gin.H{
-		"object": "list",
-		"data": []gin.H{
-			{
-				"id":       "gpt-3.5-turbo",
-				"object":   "model",
-				"created":  1688888888,
-				"owned_by": "chatgpt-to-api",
-			},
-			{
-				"id":       "gpt-4",
-				"object":   "model",
-				"created":  1688888888,
-				"owned_by": "chatgpt-to-api",
-			},
-			{
-				"id":       "gpt-4o",
-				"object":   "model",
-				"created":  1688888888,
-				"owned_by": "chatgpt-to-api",
-			},
-			{
-				"id":       "gpt-4o-mini",
-				"object":   "model",
-				"created":  1688888888,
-				"owned_by": "chatgpt-to-api",
-			},
-			{
-				"id":       "o1",
-				"object":   "model",
-				"created":  1688888888,
-				"owned_by": "chatgpt-to-api",
-			},
-			{
-				"id":       "o1-mini",
-				"object":   "model",
-				"created":  1688888888,
-				"owned_by": "chatgpt-to-api",
-			},
-		},
-	})
-}
-
 func generateUUID(name string) string {
 	return uuid.NewSHA1(uuidNamespace, []byte(name)).String()
 }
+
+// deviceID is the device requests of account send upstream. Anonymous requests through one proxy
+// share a device and with it one pooled client.
+func deviceID(account string, proxy_url string) string {
+	if account == "" {
+		return generateUUID("anonymous " + proxy_url)
+	}
+	return generateUUID(account)
+}
+
+// maxChoices limits the upstream conversations one request can fan out to
+const maxChoices = 8
+
 func nightmare(c *gin.Context) {
 	var original_request official_types.APIRequest
-	err := c.BindJSON(&original_request)
+	err := c.ShouldBindJSON(&original_request)
 	if err != nil {
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "Request must be proper JSON",
-			"type":    "invalid_request_error",
-			"param":   nil,
-			"code":    err.Error(),
-		}})
+		abortWithError(c, invalidJSONError(err))
 		return
 	}
+	if param, message := chatgpt_request_converter.CheckParams(original_request, STRICT_PARAMS, maxChoices); param != "" {
+		abortWithError(c, official_types.InvalidRequestError(param, message))
+		return
+	}
+	c.Set("usage_model", original_request.Model)
+	if err := checkKeyModel(c, original_request.Model); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := checkFiles(c, original_request); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	legacy_functions := chatgpt_request_converter.NormalizeTools(&original_request)
+	use_tools := chatgpt_request_converter.ToolsEnabled(original_request)
+	use_bard := isBardModel(original_request.Model)
+	if use_bard && use_tools {
+		abortWithError(c, official_types.InvalidRequestError("tools", "tools are not supported by "+original_request.Model))
+		return
+	}
+	use_json := chatgpt_request_converter.JSONFormat(original_request)
+	if use_bard && use_json {
+		abortWithError(c, official_types.InvalidRequestError("response_format", "response_format is not supported by "+original_request.Model))
+		return
+	}
+	schema, _ := chatgpt_request_converter.ResponseSchema(original_request)
+	stop := chatgpt_request_converter.StopSequences(original_request)
+	max_tokens := chatgpt_request_converter.MaxTokens(original_request)
+	n := original_request.N
+	if n == 0 {
+		n = 1
+	}
 
-	account, secret := getSecret()
-	var proxy_url string
-	if len(proxies) == 0 {
-		proxy_url = ""
+	route := chatgpt_request_converter.ResolveModel(original_request.Model)
+	meta := official_types.NewCompletionMeta(original_request.Model)
+	if !use_bard && route.Slug != "" {
+		// Report the model the request is routed to until upstream names it
+		meta.SetModel(route.Slug)
+	}
+	var lock sync.Mutex
+	var attempts int32
+	limits := make([]*limitWriter, n)
+	chunk_writers := make([]*chunkWriter, n)
+	collected := make([]*collectWriter, n)
+	choice_writers := make([]choiceWriter, n)
+	for i := range limits {
+		var writer completionWriter
+		if original_request.Stream {
+			chunk_writer := &chunkWriter{c: c, meta: meta, index: i, lock: &lock, onFirstWrite: func() {
+				c.Header(attemptsHeader, strconv.Itoa(int(atomic.LoadInt32(&attempts))))
+			}}
+			chunk_writers[i] = chunk_writer
+			if use_tools {
+				writer = &toolCallWriter{chunkWriter: chunk_writer, legacy: legacy_functions}
+			} else {
+				writer = chunk_writer
+			}
+		} else {
+			collected[i] = &collectWriter{}
+			writer = collected[i]
+		}
+		limits[i] = &limitWriter{completionWriter: writer, model: original_request.Model, stop: stop, maxTokens: max_tokens}
+		choice_writers[i] = limits[i]
+		if use_json {
+			// JSON replies are checked before anything is sent
+			choice_writers[i] = &formatWriter{limitWriter: limits[i], schema: schema, tools: use_tools}
+		}
+	}
+	var resume_from resumer
+	if ENABLE_CONVERSATION_CACHE && n == 1 {
+		resume_from = resumeConversation
+	}
+	errs := make([]error, n)
+	prompt_tokens := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range limits {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer recoverChoice(c, &errs[i])
+			if use_bard {
+				errs[i] = withRetries(limits[i], &attempts, func(try int) error {
+					var err error
+					prompt_tokens[i], err = runBardChoice(c, original_request, n == 1 && try == 0, limits[i])
+					if err != nil {
+						logging.From(c).Warn("Gemini request failed", "attempt", try+1, "error", err)
+					}
+					return err
+				})
+			} else {
+				var info *chatgpt.ConversationInfo
+				prompt_tokens[i], info, errs[i] = serveChoice(c, original_request, route, resume_from, choice_writers[i], &attempts)
+				if resume_from != nil && errs[i] == nil {
+					saveConversation(original_request, info, limits[i].emitted.String(), use_tools)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Set("attempts", int(attempts))
+	if !c.Writer.Written() {
+		c.Header(attemptsHeader, strconv.Itoa(int(attempts)))
+	}
+	for _, err := range errs {
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	completion_tokens := 0
+	for _, limit := range limits {
+		completion_tokens += limit.CompletionTokens()
+	}
+	chargeTokens(c, prompt_tokens[0], completion_tokens)
+	if !original_request.Stream {
+		if collected[0].model != "" {
+			meta.SetModel(collected[0].model)
+		}
+		completion := official_types.NewChatCompletion(meta, "")
+		completion.Usage = official_types.Usage{
+			PromptTokens:     prompt_tokens[0],
+			CompletionTokens: completion_tokens,
+			TotalTokens:      prompt_tokens[0] + completion_tokens,
+		}
+		completion.Choices = nil
+		for i, writer := range collected {
+			content := writer.text.String()
+			choice := official_types.Choice{Index: i, Message: official_types.Msg{Role: "assistant", Content: content}, FinishReason: writer.reason}
+			if use_tools {
+				var tool_calls []official_types.ToolCall
+				choice.Message.Content, tool_calls = chatgpt_response_converter.ParseToolCalls(content)
+				if len(tool_calls) != 0 {
+					if legacy_functions {
+						choice.Message.FunctionCall = &tool_calls[0].Function
+						choice.FinishReason = "function_call"
+					} else {
+						choice.Message.ToolCalls = tool_calls
+						choice.FinishReason = "tool_calls"
+					}
+				}
+			}
+			completion.Choices = append(completion.Choices, choice)
+		}
+		c.JSON(200, completion)
 	} else {
-		proxy_url = proxies[0]
-		// Push used proxy to the back of the list
-		proxies = append(proxies[1:], proxies[0])
+		if original_request.StreamOptions != nil && original_request.StreamOptions.IncludeUsage {
+			usage_chunk := official_types.UsageChunk(chunk_writers[0].meta, prompt_tokens[0], completion_tokens)
+			c.Writer.WriteString("data: " + usage_chunk.String() + "\n\n")
+		}
+		c.String(200, "data: [DONE]\n\n")
 	}
+}
+
+// runChoice sends one upstream conversation and writes its text to writer, or continues the resume
+// conversation if set. It returns the prompt tokens and the position of the reply.
+func runChoice(ctx context.Context, c *gin.Context, log *slog.Logger, original_request official_types.APIRequest, account string, secret tokens.Secret, proxy_url string, resume *chatgpt.ConversationInfo, writer completionWriter) (int, chatgpt.ContinueInfo, error) {
 	uid := uuid.NewString()
-	var deviceId string
-	if account == "" {
-		deviceId = uid
-		chatgpt.SetOAICookie(deviceId)
-	} else {
-		deviceId = generateUUID(account)
-		chatgpt.SetOAICookie(deviceId)
+	deviceId := deviceID(account, proxy_url)
+	// Convert the chat request to a ChatGPT request, uploading its files
+	convert_ctx, span := tracing.Start(ctx, "chatgpt.ConvertAPIRequest")
+	translated_request, err := chatgpt_request_converter.ConvertAPIRequest(convert_ctx, original_request, account, &secret, deviceId, proxy_url)
+	if err == chatgpt_request_converter.ErrModelNotFound {
+		err = official_types.ModelNotFoundError(original_request.Model)
 	}
-	chat_require, p := chatgpt.CheckRequire(&secret, deviceId, proxy_url)
-	if chat_require == nil {
-		c.JSON(500, gin.H{"error": "unable to check chat requirement"})
-		return
+	tracing.End(span, err)
+	if err != nil {
+		return 0, chatgpt.ContinueInfo{}, err
 	}
-	var proofToken string
-	if chat_require.Proof.Required {
-		proofToken = chatgpt.CalcProofToken(chat_require, proxy_url)
+	prompt_tokens := translated_request.CountTokens(original_request.Model)
+	if resume != nil {
+		translated_request.ConversationID = resume.ConversationID
+		translated_request.ParentMessageID = resume.ParentID
 	}
-	var turnstileToken string
-	if chat_require.Turnstile.Required {
-		turnstileToken = chatgpt.ProcessTurnstile(chat_require.Turnstile.DX, p)
-	}
-	// Convert the chat request to a ChatGPT request
-	translated_request := chatgpt_request_converter.ConvertAPIRequest(original_request, account, &secret, deviceId, proxy_url)
 
-	response, err := chatgpt.POSTconversation(translated_request, &secret, deviceId, chat_require.Token, proofToken, turnstileToken, proxy_url)
+	response, err := postConversation(ctx, log, translated_request, &secret, deviceId, proxy_url)
 	if err != nil {
-		c.JSON(500, gin.H{
-			"error": "error sending request",
-		})
-		return
+		return 0, chatgpt.ContinueInfo{}, err
 	}
 	defer response.Body.Close()
-	if chatgpt.Handle_request_error(c, response) {
-		return
-	}
-	var full_response string
-	for i := 3; i > 0; i-- {
-		var continue_info *chatgpt.ContinueInfo
-		var response_part string
-		response_part, continue_info = chatgpt.Handler(c, response, &secret, proxy_url, deviceId, uid, original_request.Stream)
-		full_response += response_part
-		if continue_info == nil {
+	var position chatgpt.ContinueInfo
+	var need_continue bool
+	// A reply cut by max_tokens is continued up to two times
+	for round := 0; ; round++ {
+		_, span := tracing.Start(ctx, "chatgpt.Handler", attribute.Int("chatgpt.round", round))
+		_, position, need_continue, err = chatgpt.Handler(c, response, &secret, proxy_url, deviceId, uid, writer)
+		tracing.End(span, err)
+		if err != nil {
+			return prompt_tokens, position, err
+		}
+		if !need_continue || round == 2 {
 			break
 		}
-		println("Continuing conversation")
+		log.Info("Continuing conversation", "conversation_id", position.ConversationID)
 		translated_request.Messages = nil
 		translated_request.Action = "continue"
-		translated_request.ConversationID = continue_info.ConversationID
-		translated_request.ParentMessageID = continue_info.ParentID
-		chat_require, _ = chatgpt.CheckRequire(&secret, deviceId, proxy_url)
-		if chat_require.Proof.Required {
-			proofToken = chatgpt.CalcProofToken(chat_require, proxy_url)
-		}
-		if chat_require.Turnstile.Required {
-			turnstileToken = chatgpt.ProcessTurnstile(chat_require.Turnstile.DX, p)
-		}
-		response, err = chatgpt.POSTconversation(translated_request, &secret, deviceId, chat_require.Token, proofToken, turnstileToken, proxy_url)
+		translated_request.ConversationID = position.ConversationID
+		translated_request.ParentMessageID = position.ParentID
+		continue_ctx, span := tracing.Start(ctx, "chatgpt.continue", attribute.Int("chatgpt.round", round+1))
+		response, err = postConversation(continue_ctx, log, translated_request, &secret, deviceId, proxy_url)
+		tracing.End(span, err)
 		if err != nil {
-			c.JSON(500, gin.H{
-				"error": "error sending request",
-			})
-			return
+			return prompt_tokens, position, err
 		}
 		defer response.Body.Close()
-		if chatgpt.Handle_request_error(c, response) {
-			return
-		}
 	}
-	if c.Writer.Status() != 200 {
-		return
+	finish_reason := "stop"
+	if need_continue {
+		finish_reason = "length"
 	}
-	if !original_request.Stream {
-		c.JSON(200, official_types.NewChatCompletion(full_response))
-	} else {
-		c.String(200, "data: [DONE]\n\n")
+	log.Debug("Conversation finished", "finish_reason", finish_reason)
+	return prompt_tokens, position, writer.Finish(finish_reason)
+}
+
+// postConversation checks the chat requirements, solves their proof of work and turnstile and
+// sends request. It returns the response once upstream accepted it.
+func postConversation(ctx context.Context, log *slog.Logger, request chatgpt.ChatGPTRequest, secret *tokens.Secret, deviceId string, proxy_url string) (*http.Response, error) {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "chatgpt.CheckRequire")
+	chat_require, p, err := chatgpt.Upstream.CheckRequire(secret, deviceId, proxy_url)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Checked chat requirements", "duration", time.Since(start), "proof", chat_require.Proof.Required, "turnstile", chat_require.Turnstile.Required)
+	var proofToken string
+	if chat_require.Proof.Required {
+		_, span := tracing.Start(ctx, "chatgpt.ProofToken", attribute.String("chatgpt.difficulty", chat_require.Proof.Difficulty))
+		proofToken = chatgpt.Upstream.ProofToken(chat_require, proxy_url)
+		span.End()
+	}
+	var turnstileToken string
+	if chat_require.Turnstile.Required {
+		_, span := tracing.Start(ctx, "chatgpt.ProcessTurnstile")
+		turnstileToken = chatgpt.ProcessTurnstile(chat_require.Turnstile.DX, p)
+		span.End()
+	}
+	start = time.Now()
+	_, span = tracing.Start(ctx, "chatgpt.POSTconversation")
+	response, err := chatgpt.Upstream.POSTconversation(request, secret, deviceId, chat_require.Token, proofToken, turnstileToken, proxy_url)
+	if err != nil {
+		err = official_types.UpstreamError(502, "upstream_unreachable", "Unable to reach chatgpt.com: "+err.Error())
+		tracing.End(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+	log.Debug("Conversation started", "status", response.StatusCode, "duration", time.Since(start))
+	if response.StatusCode != 200 {
+		err := chatgpt.Read_request_error(response)
+		response.Body.Close()
+		tracing.End(span, err)
+		return nil, err
 	}
+	tracing.End(span, nil)
+	return response, nil
 }
 
 var ttsFmtMap = map[string]string{
@@ -232,53 +376,38 @@ var ttsVoiceMap = map[string]string{
 
 func tts(c *gin.Context) {
 	var original_request official_types.TTSAPIRequest
-	err := c.BindJSON(&original_request)
+	err := c.ShouldBindJSON(&original_request)
 	if err != nil {
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "Request must be proper JSON",
-			"type":    "invalid_request_error",
-			"param":   nil,
-			"code":    err.Error(),
-		}})
+		abortWithError(c, invalidJSONError(err))
 		return
 	}
-
-	account, secret := getSecret()
-	var proxy_url string
-	if len(proxies) == 0 {
-		proxy_url = ""
-	} else {
-		proxy_url = proxies[0]
-		// Push used proxy to the back of the list
-		proxies = append(proxies[1:], proxies[0])
-	}
-	var deviceId = generateUUID(account)
-	chatgpt.SetOAICookie(deviceId)
-	chat_require, p := chatgpt.CheckRequire(&secret, deviceId, proxy_url)
-	if chat_require == nil {
-		c.JSON(500, gin.H{"error": "unable to check chat requirement"})
+	c.Set("usage_model", original_request.Model)
+	if err := checkKeyModel(c, original_request.Model); err != nil {
+		abortWithError(c, err)
 		return
 	}
-	var proofToken string
-	if chat_require.Proof.Required {
-		proofToken = chatgpt.CalcProofToken(chat_require, proxy_url)
-	}
-	var turnstileToken string
-	if chat_require.Turnstile.Required {
-		turnstileToken = chatgpt.ProcessTurnstile(chat_require.Turnstile.DX, p)
+
+	lease, _ := accountPool.Acquire("", nil, nil)
+	if lease == nil {
+		abortWithError(c, official_types.UpstreamError(503, "no_account_available", "No account is available"))
+		return
 	}
+	defer lease.Release(nil)
+	account, secret := lease.Account, lease.Secret
+	c.Set("usage_account", account)
+	proxy_url := proxyPool.Next(account)
+	log := logging.From(c).With("account", account, "proxy", redactProxy(proxy_url))
+	ctx := tracing.Tag(c.Request.Context(), attribute.String("chatgpt.account", account), attribute.String("chatgpt.proxy", redactProxy(proxy_url)), attribute.String("chatgpt.model", original_request.Model))
+	var deviceId = deviceID(account, proxy_url)
 	// Convert the chat request to a ChatGPT request
 	translated_request := chatgpt_request_converter.ConvertTTSAPIRequest(original_request.Input)
 
-	response, err := chatgpt.POSTconversation(translated_request, &secret, deviceId, chat_require.Token, proofToken, turnstileToken, proxy_url)
+	response, err := postConversation(ctx, log, translated_request, &secret, deviceId, proxy_url)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "error sending request"})
+		abortWithError(c, err)
 		return
 	}
 	defer response.Body.Close()
-	if chatgpt.Handle_request_error(c, response) {
-		return
-	}
 	msgId, convId := chatgpt.HandlerTTS(response, original_request.Input)
 	format := ttsFmtMap[original_request.Format]
 	if format == "" {
@@ -288,51 +417,54 @@ func tts(c *gin.Context) {
 	if voice == "" {
 		voice = "cove"
 	}
-	apiUrl := "https://chatgpt.com/backend-api/synthesize?message_id=" + msgId + "&conversation_id=" + convId + "&voice=" + voice + "&format=" + format
-	data := chatgpt.GetTTS(&secret, deviceId, apiUrl, proxy_url)
+	_, span := tracing.Start(ctx, "chatgpt.Synthesize", attribute.String("chatgpt.voice", voice))
+	data := chatgpt.Upstream.Synthesize(&secret, deviceId, msgId, convId, voice, format, proxy_url)
+	span.End()
+	log.Debug("Synthesized speech", "conversation_id", convId, "voice", voice, "format", format, "bytes", len(data))
 	if data != nil {
 		c.Data(200, ttsTypeMap[format], data)
 	} else {
-		c.JSON(500, gin.H{"error": "synthesize error"})
+		abortWithError(c, official_types.UpstreamError(502, "upstream_error", "chatgpt.com failed to synthesize the speech"))
 	}
-	chatgpt.RemoveConversation(&secret, deviceId, convId, proxy_url)
+	chatgpt.Upstream.RemoveConversation(&secret, deviceId, convId, proxy_url)
 }
 
 func stt(c *gin.Context) {
 	file, header, err := c.Request.FormFile("file")
 	if err != nil {
-		println(err.Error())
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "Request must has proper file",
-			"type":    "invalid_request_error",
-			"param":   nil,
-			"code":    err.Error(),
-		}})
+		abortWithError(c, official_types.InvalidRequestError("file", "Request must has proper file: "+err.Error()))
 		return
 	}
 	defer file.Close()
+	c.Set("usage_model", c.Request.FormValue("model"))
+	if err := checkKeyModel(c, c.Request.FormValue("model")); err != nil {
+		abortWithError(c, err)
+		return
+	}
 	lang := c.Request.FormValue("language")
 
-	account, secret := getSecret()
-	if account == "" {
-		c.JSON(500, gin.H{"error": "Logined user only"})
+	lease, _ := accountPool.Acquire("", nil, nil)
+	if lease == nil {
+		abortWithError(c, official_types.UpstreamError(503, "no_account_available", "No account is available"))
 		return
 	}
-	var proxy_url string
-	if len(proxies) == 0 {
-		proxy_url = ""
-	} else {
-		proxy_url = proxies[0]
-		// Push used proxy to the back of the list
-		proxies = append(proxies[1:], proxies[0])
+	defer lease.Release(nil)
+	account, secret := lease.Account, lease.Secret
+	c.Set("usage_account", account)
+	if account == "" {
+		abortWithError(c, official_types.UpstreamError(503, "login_required", "Transcription needs a logged in account, add accounts to accounts.txt"))
+		return
 	}
-	var deviceId = generateUUID(account)
-	chatgpt.SetOAICookie(deviceId)
+	proxy_url := proxyPool.Next(account)
+	var deviceId = deviceID(account, proxy_url)
 
-	data := chatgpt.GetSTT(file, header, lang, &secret, deviceId, proxy_url)
+	_, span := tracing.Start(c.Request.Context(), "chatgpt.Transcribe", attribute.String("chatgpt.account", account), attribute.String("chatgpt.proxy", redactProxy(proxy_url)), attribute.String("chatgpt.model", c.Request.FormValue("model")))
+	data := chatgpt.Upstream.Transcribe(file, header, lang, &secret, deviceId, proxy_url)
+	span.End()
+	logging.From(c).Debug("Transcribed audio", "account", account, "proxy", redactProxy(proxy_url), "bytes", len(data))
 	if data != nil {
 		c.Data(200, "application/json", data)
 	} else {
-		c.JSON(500, gin.H{"error": "transcribe error"})
+		abortWithError(c, official_types.UpstreamError(502, "upstream_error", "chatgpt.com failed to transcribe the audio"))
 	}
 }
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/tokens"
+	official_types "freechatgpt/typings/official"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/gin-gonic/gin"
+)
+
+// recordedReply is the assistant text of fixtures/default.sse
+const recordedReply = "Hello! This is a recorded reply from the mock backend. How can I help you today?"
+
+const weatherFunction = `{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}`
+
+const weatherTool = `{"type":"function","function":` + weatherFunction + `}`
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	chatgpt.Upstream = chatgpt.NewMockBackend("")
+	MAX_ATTEMPTS = 1
+	os.Exit(m.Run())
+}
+
+// post sends a JSON request to a server replaying the mock backend
+func post(t *testing.T, path string, body string) *http.Response {
+	t.Helper()
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+	response, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+// postChat sends a chat completion request which must succeed
+func postChat(t *testing.T, body string) *http.Response {
+	t.Helper()
+	response := post(t, "/v1/chat/completions", body)
+	if response.StatusCode != 200 {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	return response
+}
+
+// readChunks decodes the server-sent chunks of a stream until [DONE]
+func readChunks(t *testing.T, response *http.Response) []official_types.ChatCompletionChunk {
+	t.Helper()
+	var chunks []official_types.ChatCompletionChunk
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			return chunks
+		}
+		var chunk official_types.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	t.Fatal("stream ended without [DONE]")
+	return nil
+}
+
+// replay serves the conversations of the mock backend from the fixtures in dir
+func replay(t *testing.T, dir string) {
+	t.Helper()
+	upstream := chatgpt.Upstream
+	chatgpt.Upstream = chatgpt.NewMockBackend(dir)
+	t.Cleanup(func() { chatgpt.Upstream = upstream })
+}
+
+func TestChatCompletion(t *testing.T) {
+	response := postChat(t, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello"}]}`)
+	var completion official_types.ChatCompletion
+	if err := json.NewDecoder(response.Body).Decode(&completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("got %d choices", len(completion.Choices))
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Content != recordedReply {
+		t.Errorf("content %q, want %q", choice.Message.Content, recordedReply)
+	}
+	if choice.FinishReason != "stop" {
+		t.Errorf("finish_reason %v, want stop", choice.FinishReason)
+	}
+	if completion.Model != "gpt-4o-mini" {
+		t.Errorf("model %q, want gpt-4o-mini", completion.Model)
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	response := postChat(t, `{"model":"gpt-4o-mini","stream":true,"messages":[{"role":"user","content":"Hello"}]}`)
+	if content_type := response.Header.Get("Content-Type"); !strings.HasPrefix(content_type, "text/event-stream") {
+		t.Errorf("content type %q", content_type)
+	}
+	var text strings.Builder
+	var finish_reason interface{}
+	for _, chunk := range readChunks(t, response) {
+		for _, choice := range chunk.Choices {
+			text.WriteString(choice.Delta.Content)
+			if choice.FinishReason != nil {
+				finish_reason = choice.FinishReason
+			}
+		}
+	}
+	if text.String() != recordedReply {
+		t.Errorf("content %q, want %q", text.String(), recordedReply)
+	}
+	if finish_reason != "stop" {
+		t.Errorf("finish_reason %v, want stop", finish_reason)
+	}
+}
+
+func TestChatCompletionToolCalls(t *testing.T) {
+	replay(t, "testdata/tool_call")
+	tests := []struct {
+		name    string
+		request string
+		stream  bool
+		finish  string
+	}{
+		{"tools", `"tools":[` + weatherTool + `]`, false, "tool_calls"},
+		{"tools stream", `"tools":[` + weatherTool + `]`, true, "tool_calls"},
+		{"functions", `"functions":[` + weatherFunction + `]`, false, "function_call"},
+		{"functions stream", `"functions":[` + weatherFunction + `]`, true, "function_call"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := postChat(t, `{"model":"gpt-4o","stream":`+strconv.FormatBool(test.stream)+`,`+test.request+`,"messages":[{"role":"user","content":"Weather in Paris?"}]}`)
+			var content, name, arguments strings.Builder
+			var finish_reason interface{}
+			if test.stream {
+				for _, chunk := range readChunks(t, response) {
+					for _, choice := range chunk.Choices {
+						content.WriteString(choice.Delta.Content)
+						for _, call := range choice.Delta.ToolCalls {
+							name.WriteString(call.Function.Name)
+							arguments.WriteString(call.Function.Arguments)
+						}
+						if call := choice.Delta.FunctionCall; call != nil {
+							name.WriteString(call.Name)
+							arguments.WriteString(call.Arguments)
+						}
+						if choice.FinishReason != nil {
+							finish_reason = choice.FinishReason
+						}
+					}
+				}
+			} else {
+				var completion official_types.ChatCompletion
+				if err := json.NewDecoder(response.Body).Decode(&completion); err != nil {
+					t.Fatal(err)
+				}
+				message := completion.Choices[0].Message
+				content.WriteString(message.Content)
+				for _, call := range message.ToolCalls {
+					name.WriteString(call.Function.Name)
+					arguments.WriteString(call.Function.Arguments)
+				}
+				if call := message.FunctionCall; call != nil {
+					name.WriteString(call.Name)
+					arguments.WriteString(call.Arguments)
+				}
+				finish_reason = completion.Choices[0].FinishReason
+			}
+			if name.String() != "get_weather" || arguments.String() != `{"city":"Paris"}` {
+				t.Errorf("call %s(%s)", name.String(), arguments.String())
+			}
+			if content.String() != "" {
+				t.Errorf("content %q", content.String())
+			}
+			if finish_reason != test.finish {
+				t.Errorf("finish_reason %v, want %s", finish_reason, test.finish)
+			}
+		})
+	}
+}
+
+// panicBackend panics while sending a conversation
+type panicBackend struct {
+	*chatgpt.MockBackend
+}
+
+func (panicBackend) POSTconversation(message chatgpt.ChatGPTRequest, secret *tokens.Secret, deviceId string, chat_token string, proofToken string, turnstileToken string, proxy string) (*fhttp.Response, error) {
+	panic("broken backend")
+}
+
+func TestChatCompletionChoicePanics(t *testing.T) {
+	upstream := chatgpt.Upstream
+	chatgpt.Upstream = panicBackend{chatgpt.NewMockBackend("")}
+	t.Cleanup(func() { chatgpt.Upstream = upstream })
+	response := post(t, "/v1/chat/completions", `{"model":"gpt-4o-mini","n":2,"messages":[{"role":"user","content":"Hello"}]}`)
+	var body struct {
+		Error official_types.APIError `json:"error"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 500 || body.Error.Type != "server_error" {
+		t.Errorf("status %d, error %+v", response.StatusCode, body.Error)
+	}
+}
+
+func TestChatCompletionLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		// texts are the contents of the choices in order
+		texts  []string
+		finish string
+	}{
+		{"n", `"n":2`, []string{recordedReply, recordedReply}, "stop"},
+		{"stop", `"stop":"."`, []string{"Hello! This is a recorded reply from the mock backend"}, "stop"},
+		{"stop list", `"stop":["recorded","mock"]`, []string{"Hello! This is a "}, "stop"},
+		{"max_tokens", `"max_tokens":2`, []string{"Hello!"}, "length"},
+		{"max_completion_tokens", `"max_completion_tokens":2`, []string{"Hello!"}, "length"},
+		{"n with max_tokens", `"n":3,"max_tokens":1`, []string{"Hello", "Hello", "Hello"}, "length"},
+	}
+	for _, test := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(test.name+" stream "+strconv.FormatBool(stream), func(t *testing.T) {
+				response := postChat(t, `{"model":"gpt-4o-mini","stream":`+strconv.FormatBool(stream)+`,`+test.params+`,"messages":[{"role":"user","content":"Hello"}]}`)
+				texts := make([]string, len(test.texts))
+				finish := make([]interface{}, len(test.texts))
+				if stream {
+					for _, chunk := range readChunks(t, response) {
+						for _, choice := range chunk.Choices {
+							if choice.Index >= len(texts) {
+								t.Fatalf("unexpected choice %d", choice.Index)
+							}
+							texts[choice.Index] += choice.Delta.Content
+							if choice.FinishReason != nil {
+								finish[choice.Index] = choice.FinishReason
+							}
+						}
+					}
+				} else {
+					var completion official_types.ChatCompletion
+					if err := json.NewDecoder(response.Body).Decode(&completion); err != nil {
+						t.Fatal(err)
+					}
+					if len(completion.Choices) != len(texts) {
+						t.Fatalf("got %d choices, want %d", len(completion.Choices), len(texts))
+					}
+					for i, choice := range completion.Choices {
+						if choice.Index != i {
+							t.Errorf("choice %d has index %d", i, choice.Index)
+						}
+						texts[i], finish[i] = choice.Message.Content, choice.FinishReason
+					}
+				}
+				for i := range texts {
+					if texts[i] != test.texts[i] || finish[i] != test.finish {
+						t.Errorf("choice %d is %q finishing with %v, want %q with %s", i, texts[i], finish[i], test.texts[i], test.finish)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestChatCompletionInvalidLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		param  string
+	}{
+		{"n above the limit", `"n":9`, "n"},
+		{"negative n", `"n":-1`, "n"},
+		{"negative max_tokens", `"max_tokens":-1`, "max_tokens"},
+		{"too many stop sequences", `"stop":["a","b","c","d","e"]`, "stop"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := post(t, "/v1/chat/completions", `{"model":"gpt-4o-mini",`+test.params+`,"messages":[{"role":"user","content":"Hello"}]}`)
+			var body struct {
+				Error official_types.APIError `json:"error"`
+			}
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != 400 || body.Error.Param != test.param {
+				t.Errorf("status %d, error %+v", response.StatusCode, body.Error)
+			}
+		})
+	}
+}
+
+// deviceBackend records the device and proxy of every conversation
+type deviceBackend struct {
+	*chatgpt.MockBackend
+	lock    sync.Mutex
+	devices map[string]string
+}
+
+func (b *deviceBackend) CheckRequire(secret *tokens.Secret, deviceId string, proxy string) (*chatgpt.ChatRequire, string, error) {
+	b.lock.Lock()
+	b.devices[proxy] = deviceId
+	b.lock.Unlock()
+	return b.MockBackend.CheckRequire(secret, deviceId, proxy)
+}
+
+func TestAnonymousDevices(t *testing.T) {
+	proxies := []string{"http://p1:1", "http://p2:1"}
+	proxyPool.Load(proxies)
+	t.Cleanup(func() { proxyPool.Load(nil) })
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/v1/chat/completions", `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello"}]}`},
+		{"/v1/audio/speech", `{"model":"tts-1","input":"Hello","voice":"alloy"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			backend := &deviceBackend{MockBackend: chatgpt.NewMockBackend(""), devices: map[string]string{}}
+			upstream := chatgpt.Upstream
+			chatgpt.Upstream = backend
+			t.Cleanup(func() { chatgpt.Upstream = upstream })
+			for range proxies {
+				if response := post(t, test.path, test.body); response.StatusCode != 200 {
+					t.Fatalf("status %d", response.StatusCode)
+				}
+			}
+			if len(backend.devices) != len(proxies) {
+				t.Fatalf("devices %v, want one per proxy", backend.devices)
+			}
+			for _, proxy_url := range proxies {
+				if backend.devices[proxy_url] != deviceID("", proxy_url) {
+					t.Errorf("device of %s is %q, want %q", proxy_url, backend.devices[proxy_url], deviceID("", proxy_url))
+				}
+			}
+			if backend.devices[proxies[0]] == backend.devices[proxies[1]] {
+				t.Errorf("proxies share the device %s", backend.devices[proxies[0]])
+			}
+		})
+	}
+}
+
+func TestDeviceID(t *testing.T) {
+	tests := []struct {
+		account_a, proxy_a string
+		account_b, proxy_b string
+		same               bool
+	}{
+		{"a@b.c", "http://p1:1", "a@b.c", "http://p2:1", true},
+		{"a@b.c", "", "d@e.f", "", false},
+		{"", "http://p1:1", "", "http://p1:1", true},
+		{"", "http://p1:1", "", "http://p2:1", false},
+		{"", "", "", "http://p1:1", false},
+	}
+	for _, test := range tests {
+		a, b := deviceID(test.account_a, test.proxy_a), deviceID(test.account_b, test.proxy_b)
+		if (a == b) != test.same {
+			t.Errorf("deviceID(%q, %q) = %s and deviceID(%q, %q) = %s, same %v", test.account_a, test.proxy_a, a, test.account_b, test.proxy_b, b, test.same)
+		}
+	}
+}
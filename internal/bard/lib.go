@@ -2,47 +2,45 @@ package bard
 
 // By @mosajjal at https://github.com/mosajjal/bard-cli/blob/main/bard/bard.go
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tidwall/gjson"
-	"k8s.io/apimachinery/pkg/util/rand"
-
-	nhttp "net/http"
 
 	http "github.com/bogdanfinn/fhttp"
 	tls_client "github.com/bogdanfinn/tls-client"
-	resty "github.com/go-resty/resty/v2"
+	"github.com/bogdanfinn/tls-client/profiles"
 )
 
 var (
 	jar     = tls_client.NewCookieJar()
 	options = []tls_client.HttpClientOption{
 		tls_client.WithTimeoutSeconds(360),
-		tls_client.WithClientProfile(tls_client.Safari_IOS_15_5),
+		tls_client.WithClientProfile(profiles.Safari_IOS_15_5),
 		tls_client.WithNotFollowRedirects(),
 		tls_client.WithCookieJar(jar), // create cookieJar instance and pass it as argument
 		// Disable SSL verification
 		tls_client.WithInsecureSkipVerify(),
 	}
-	client, _    = tls_client.NewHttpClient(tls_client.NewNoopLogger(), options...)
-	http_proxy   = os.Getenv("http_proxy")
-	resty_client = resty.New()
+	client, _  = tls_client.NewHttpClient(tls_client.NewNoopLogger(), options...)
+	http_proxy = os.Getenv("http_proxy")
 )
 
 var headers map[string]string = map[string]string{
-	"Host":          "bard.google.com",
+	"Host":          "gemini.google.com",
 	"X-Same-Domain": "1",
 	"User-Agent":    "Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.4472.114 Safari/537.36",
 	"Content-Type":  "application/x-www-form-urlencoded;charset=UTF-8",
-	"Origin":        "https://bard.google.com",
-	"Referer":       "https://bard.google.com/",
+	"Origin":        "https://gemini.google.com",
+	"Referer":       "https://gemini.google.com/",
 }
 
 func init() {
@@ -51,7 +49,7 @@ func init() {
 	}
 }
 
-const bardURL string = "https://bard.google.com/_/BardChatUi/data/assistant.lamda.BardFrontendService/StreamGenerate"
+const bardURL string = "https://gemini.google.com/_/BardChatUi/data/assistant.lamda.BardFrontendService/StreamGenerate"
 
 type Answer struct {
 	Content string `json:"content"`
@@ -69,7 +67,8 @@ type Bard struct {
 	LastInteractionTime time.Time
 }
 
-// New creates a new Bard AI instance. Cookie is the __Secure-1PSID cookie from Google
+// New creates a new Bard AI instance. Cookie is the __Secure-1PSID cookie from Google,
+// or a cookie header such as "__Secure-1PSID=...; __Secure-1PSIDTS=..."
 func New(cookie string) (*Bard, error) {
 	b := &Bard{
 		Cookie: cookie,
@@ -78,15 +77,28 @@ func New(cookie string) (*Bard, error) {
 	return b, err
 }
 
+func (b *Bard) addCookies(req *http.Request) {
+	if !strings.Contains(b.Cookie, "=") {
+		req.AddCookie(&http.Cookie{
+			Name:  "__Secure-1PSID",
+			Value: b.Cookie,
+		})
+		return
+	}
+	for _, pair := range strings.Split(b.Cookie, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && name != "" {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+	}
+}
+
 func (b *Bard) getSNlM0e() error {
-	req, _ := http.NewRequest("GET", "https://bard.google.com/", nil)
+	req, _ := http.NewRequest("GET", "https://gemini.google.com/app", nil)
 	for k, v := range headers {
 		req.Header.Add(k, v)
 	}
-	req.AddCookie(&http.Cookie{
-		Name:  "__Secure-1PSID",
-		Value: b.Cookie,
-	})
+	b.addCookies(req)
 	// in response text, the value shows. in python:
 	r := regexp.MustCompile(`SNlM0e\":\"(.*?)\"`)
 	resp, err := client.Do(req)
@@ -108,70 +120,76 @@ func (b *Bard) Ask(prompt string) (*Answer, error) {
 	b.LastInteractionTime = time.Now()
 
 	// req paramters for the actual request
-	reqParams := map[string]string{
-		"bl":     "boq_assistant-bard-web-server_20230606.12_p0",
-		"_reqid": fmt.Sprintf("%d", rand.IntnRange(100000, 999999)),
-		"rt":     "c",
+	reqParams := url.Values{
+		"bl":     {"boq_assistant-bard-web-server_20240519.16_p0"},
+		"_reqid": {strconv.Itoa(100000 + rand.Intn(900000))},
+		"rt":     {"c"},
 	}
 
-	req := fmt.Sprintf(`[null, "[[\"%s\"], null, [\"%s\", \"%s\", \"%s\"]]"]`,
-		//prompt, b.answer.ConversationID, b.answer.ResponseID, b.answer.ChoiceID)
-		prompt, b.ConversationID, b.ResponseID, b.ChoiceID)
+	inner, _ := json.Marshal([]interface{}{
+		[]string{prompt},
+		nil,
+		[]string{b.ConversationID, b.ResponseID, b.ChoiceID},
+	})
+	req, _ := json.Marshal([]interface{}{nil, string(inner)})
 
-	reqData := map[string]string{
-		"f.req": string(req),
-		"at":    b.SNlM0e,
+	reqData := url.Values{
+		"f.req": {string(req)},
+		"at":    {b.SNlM0e},
 	}
-	resty_client.SetHeaders(headers)
-	resty_client.SetCookie(&nhttp.Cookie{
-		Name:  "__Secure-1PSID",
-		Value: b.Cookie,
-	})
-	resty_client.SetBaseURL(bardURL)
-	resty_client.SetTimeout(60 * time.Second)
-	resty_client.SetFormData(reqData)
-	resty_client.SetQueryParams(reqParams)
-	resty_client.SetDoNotParseResponse(true)
-	resp, err := resty_client.R().Post("")
+	request, err := http.NewRequest(http.MethodPost, bardURL+"?"+reqParams.Encode(), strings.NewReader(reqData.Encode()))
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode() != 200 {
-		// curl, _ := http2curl.GetCurlCommand(resp.Request.EnableTrace().RawRequest)
-		// fmt.Println(curl)
-		return nil, fmt.Errorf("status code is not 200: %d", resp.StatusCode())
+	for k, v := range headers {
+		request.Header.Set(k, v)
 	}
-
-	// this is the Go version
-	buf := new(bytes.Buffer)
-	_, _ = buf.ReadFrom(resp.RawResponse.Body)
-
-	respLines := strings.Split(buf.String(), "\n")
-	respJSON := respLines[3]
-
-	var fullRes [][]interface{}
-	err = json.Unmarshal([]byte(respJSON), &fullRes)
+	b.addCookies(request)
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status code is not 200: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	// get the main answer
-	res, ok := fullRes[0][2].(string)
-	if !ok {
+	// the answer is the last "wrb.fr" envelope holding a payload
+	var res string
+	for _, line := range strings.Split(string(body), "\n") {
+		if !strings.HasPrefix(line, `[["wrb.fr"`) {
+			continue
+		}
+		var fullRes [][]interface{}
+		if json.Unmarshal([]byte(line), &fullRes) != nil || len(fullRes) == 0 || len(fullRes[0]) < 3 {
+			continue
+		}
+		if payload, ok := fullRes[0][2].(string); ok {
+			res = payload
+		}
+	}
+	if res == "" {
 		return nil, fmt.Errorf("failed to get answer from bard")
 	}
 
 	answer := Answer{}
 
-	answer.Content = gjson.Get(res, "0.0").String()
 	b.ConversationID = gjson.Get(res, "1.0").String()
 	b.ResponseID = gjson.Get(res, "1.1").String()
 	choices := gjson.Get(res, "4").Array()
+	if len(choices) == 0 {
+		return nil, fmt.Errorf("bard returned no choices")
+	}
 	answer.Choices = make([]string, len(choices))
 	for i, choice := range choices {
-		answer.Choices[i] = choice.Array()[0].String()
+		answer.Choices[i] = choice.Get("1.0").String()
 	}
-	b.ChoiceID = choices[0].Array()[0].String()
+	answer.Content = answer.Choices[0]
+	b.ChoiceID = choices[0].Get("0").String()
 
 	return &answer, nil
 }
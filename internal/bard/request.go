@@ -1,9 +1,13 @@
 package bard
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type BardCache struct {
 	Bards map[string]*Bard
+	lock  sync.Mutex
 }
 
 var cache *BardCache
@@ -19,3 +23,16 @@ func init() {
 		}
 	}()
 }
+
+// GetBard returns the Bard holding the conversation with the hash, or nil
+func GetBard(hash string) *Bard {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.Bards[hash]
+}
+
+func SetBard(hash string, b *Bard) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.Bards[hash] = b
+}
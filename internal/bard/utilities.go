@@ -15,6 +15,8 @@ func HashConversation(conversation []string) string {
 }
 
 func GarbageCollectCache(cache *BardCache) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 	for k, v := range cache.Bards {
 		if time.Since(v.LastInteractionTime) > time.Minute*5 {
 			delete(cache.Bards, k)
@@ -23,6 +25,8 @@ func GarbageCollectCache(cache *BardCache) {
 }
 
 func UpdateBardHash(old_hash, hash string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 	if _, ok := cache.Bards[old_hash]; ok {
 		cache.Bards[hash] = cache.Bards[old_hash]
 		delete(cache.Bards, old_hash)
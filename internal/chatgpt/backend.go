@@ -0,0 +1,39 @@
+package chatgpt
+
+import (
+	"freechatgpt/internal/tokens"
+	"mime/multipart"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/xqdoo00o/OpenAIAuth/auth"
+)
+
+// Backend is the upstream serving conversations, files and audio
+type Backend interface {
+	// CheckRequire returns the sentinel requirements and the proof sent with them, or an *official.APIError
+	CheckRequire(secret *tokens.Secret, deviceId string, proxy string) (*ChatRequire, string, error)
+	POSTconversation(message ChatGPTRequest, secret *tokens.Secret, deviceId string, chat_token string, proofToken string, turnstileToken string, proxy string) (*http.Response, error)
+	RemoveConversation(secret *tokens.Secret, deviceId string, id string, proxy string)
+	// UploadFile returns the id of the uploaded file or an empty string
+	UploadFile(data []byte, mime string, name string, isImg bool, secret *tokens.Secret, deviceId string, proxy string) string
+	// FileTokens returns the token size of an uploaded retrieval file
+	FileTokens(fileid string, secret *tokens.Secret, deviceId string, proxy string) int
+	Synthesize(secret *tokens.Secret, deviceId string, msgId string, convId string, voice string, format string, proxy string) []byte
+	// GetModels lists the models the account can use
+	GetModels(secret *tokens.Secret, deviceId string, proxy string) ([]ModelInfo, error)
+	Transcribe(file multipart.File, header *multipart.FileHeader, lang string, secret *tokens.Secret, deviceId string, proxy string) []byte
+	// ProofToken solves the proof of work of the chat requirements
+	ProofToken(require *ChatRequire, proxy string) string
+	// URLAttribution returns the site name shown for a citation of url or an empty string
+	URLAttribution(secret *tokens.Secret, deviceId string, url string, proxy string) string
+	// ImageSource returns the download URL of a generated image or an empty string
+	ImageSource(url string, secret *tokens.Secret, deviceId string, proxy string) string
+	// Login renews the session of the account, signing in again if needed, and returns its secret
+	Login(email string, password string, proxy string) (tokens.Secret, *auth.Error)
+}
+
+// WebBackend talks to the chatgpt.com website
+type WebBackend struct{}
+
+// Upstream serves all requests, replace it to run against another backend
+var Upstream Backend = WebBackend{}
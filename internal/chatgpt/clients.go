@@ -0,0 +1,94 @@
+package chatgpt
+
+import (
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+	"github.com/bogdanfinn/tls-client/profiles"
+)
+
+// clientIdle is how long an unused client is kept
+const clientIdle = 10 * time.Minute
+
+// clientKey identifies a client, requests of one device through one proxy share its connections and cookies
+type clientKey struct {
+	proxy    string
+	deviceId string
+}
+
+type pooledClient struct {
+	client   tls_client.HttpClient
+	lastUsed time.Time
+}
+
+var (
+	clients        = map[clientKey]*pooledClient{}
+	clientsLock    sync.Mutex
+	clientProfiles []profiles.ClientProfile
+)
+
+func init() {
+	// CLIENT_PROFILE may list several profiles, each device keeps one of them
+	for _, name := range strings.Split(os.Getenv("CLIENT_PROFILE"), ",") {
+		if profile, ok := profiles.MappedTLSClients[strings.TrimSpace(name)]; ok {
+			clientProfiles = append(clientProfiles, profile)
+		}
+	}
+	if len(clientProfiles) == 0 {
+		clientProfiles = []profiles.ClientProfile{profiles.Okhttp4Android13}
+	}
+	go evictClients()
+}
+
+// getClient returns the client of a device and proxy, with its own cookie jar holding the oai-did cookie
+func getClient(proxy string, deviceId string) (tls_client.HttpClient, error) {
+	key := clientKey{proxy: proxy, deviceId: deviceId}
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	if pooled, ok := clients[key]; ok {
+		pooled.lastUsed = time.Now()
+		return pooled.client, nil
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(deviceId))
+	options := []tls_client.HttpClientOption{
+		tls_client.WithCookieJar(tls_client.NewCookieJar()),
+		tls_client.WithRandomTLSExtensionOrder(),
+		tls_client.WithTimeoutSeconds(600),
+		tls_client.WithClientProfile(clientProfiles[hash.Sum32()%uint32(len(clientProfiles))]),
+	}
+	if proxy != "" {
+		options = append(options, tls_client.WithProxyUrl(proxy))
+	}
+	client, err := tls_client.NewHttpClient(tls_client.NewNoopLogger(), options...)
+	if err != nil {
+		return nil, err
+	}
+	if deviceId != "" {
+		client.SetCookies(hostURL, []*http.Cookie{{
+			Name:  "oai-did",
+			Value: deviceId,
+		}})
+	}
+	clients[key] = &pooledClient{client: client, lastUsed: time.Now()}
+	return client, nil
+}
+
+func evictClients() {
+	for {
+		time.Sleep(time.Minute)
+		clientsLock.Lock()
+		for key, pooled := range clients {
+			if time.Since(pooled.lastUsed) > clientIdle {
+				pooled.client.CloseIdleConnections()
+				delete(clients, key)
+			}
+		}
+		clientsLock.Unlock()
+	}
+}
@@ -0,0 +1,37 @@
+package chatgpt
+
+import "testing"
+
+func TestGetClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		proxy  string
+		device string
+		// shared is whether the client is the one of the first request
+		shared bool
+	}{
+		{"same device and proxy", "http://p1:1", "device-a", true},
+		{"other proxy", "http://p2:1", "device-a", false},
+		{"other device", "http://p1:1", "device-b", false},
+		{"direct", "", "device-a", false},
+	}
+	first, err := getClient("http://p1:1", "device-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := getClient(test.proxy, test.device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (client == first) != test.shared {
+				t.Errorf("shared %v, want %v", client == first, test.shared)
+			}
+			cookies := client.GetCookies(hostURL)
+			if len(cookies) != 1 || cookies[0].Name != "oai-did" || cookies[0].Value != test.device {
+				t.Errorf("cookies %v, want the oai-did of %s", cookies, test.device)
+			}
+		})
+	}
+}
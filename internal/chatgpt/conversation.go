@@ -0,0 +1,115 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"freechatgpt/internal/fileutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConversationInfo is the upstream conversation a message history was sent to
+type ConversationInfo struct {
+	Account    string `json:"account"`
+	TeamUserID string `json:"team_uid,omitempty"`
+	ContinueInfo
+	// ToolNames maps the tool call ids of the conversation to their function names
+	ToolNames map[string]string `json:"tool_names,omitempty"`
+	LastUsed  int64             `json:"last_used"`
+}
+
+type ConversationCache struct {
+	Conversations map[string]*ConversationInfo
+	lock          sync.Mutex
+	dirty         bool
+}
+
+var conversationCache = &ConversationCache{
+	Conversations: make(map[string]*ConversationInfo),
+}
+
+// StartConversationCache loads conversations.json and evicts entries unused for longer than ttl
+func StartConversationCache(ttl time.Duration) {
+	loadConversations("conversations.json")
+	go func() {
+		for {
+			GarbageCollectConversations(ttl)
+			SaveConversations()
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// loadConversations replaces the cached conversations with the ones saved at path. A file which can
+// not be decoded, holds null or null entries leaves no broken entries behind.
+func loadConversations(path string) {
+	conversations := make(map[string]*ConversationInfo)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &conversations); err != nil {
+			slog.Error("Failed to load conversations", "path", path, "error", err)
+			conversations = make(map[string]*ConversationInfo)
+		}
+	}
+	if conversations == nil {
+		conversations = make(map[string]*ConversationInfo)
+	}
+	for hash, info := range conversations {
+		if info == nil {
+			delete(conversations, hash)
+		}
+	}
+	conversationCache.lock.Lock()
+	conversationCache.Conversations = conversations
+	conversationCache.lock.Unlock()
+}
+
+func GetConversation(hash string) *ConversationInfo {
+	conversationCache.lock.Lock()
+	defer conversationCache.lock.Unlock()
+	info := conversationCache.Conversations[hash]
+	if info == nil {
+		return nil
+	}
+	info.LastUsed = time.Now().Unix()
+	result := *info
+	return &result
+}
+
+func SetConversation(hash string, info ConversationInfo) {
+	conversationCache.lock.Lock()
+	defer conversationCache.lock.Unlock()
+	info.LastUsed = time.Now().Unix()
+	conversationCache.Conversations[hash] = &info
+	conversationCache.dirty = true
+}
+
+func GarbageCollectConversations(ttl time.Duration) {
+	conversationCache.lock.Lock()
+	defer conversationCache.lock.Unlock()
+	for k, v := range conversationCache.Conversations {
+		if time.Since(time.Unix(v.LastUsed, 0)) > ttl {
+			delete(conversationCache.Conversations, k)
+			conversationCache.dirty = true
+		}
+	}
+}
+
+// SaveConversations writes the conversations to conversations.json if they changed
+func SaveConversations() {
+	conversationCache.lock.Lock()
+	defer conversationCache.lock.Unlock()
+	if !conversationCache.dirty {
+		return
+	}
+	data, err := json.Marshal(conversationCache.Conversations)
+	if err == nil {
+		err = fileutil.WriteAtomic("conversations.json", data, 0600)
+	}
+	if err != nil {
+		slog.Error("Failed to save conversations", "path", "conversations.json", "error", err)
+		return
+	}
+	conversationCache.dirty = false
+}
@@ -0,0 +1,40 @@
+package chatgpt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConversations(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		loaded  int
+	}{
+		{"missing", "", 0},
+		{"null", `null`, 0},
+		{"truncated", `{"a": {"conversation_id": "c1"`, 0},
+		{"null entry", `{"a": null, "b": {"conversation_id": "c2", "parent_id": "p2"}}`, 1},
+		{"saved", `{"a": {"conversation_id": "c1"}, "b": {"conversation_id": "c2"}}`, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "conversations.json")
+			if test.content != "" {
+				if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			loadConversations(path)
+			if got := len(conversationCache.Conversations); got != test.loaded {
+				t.Errorf("loaded %d conversations, want %d", got, test.loaded)
+			}
+			SetConversation("new", ConversationInfo{ContinueInfo: ContinueInfo{ConversationID: "c3"}})
+			if info := GetConversation("new"); info == nil || info.ConversationID != "c3" {
+				t.Errorf("stored conversation %+v", info)
+			}
+			GarbageCollectConversations(0)
+		})
+	}
+}
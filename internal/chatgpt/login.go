@@ -0,0 +1,27 @@
+package chatgpt
+
+import (
+	"freechatgpt/internal/tokens"
+	"log/slog"
+
+	"github.com/xqdoo00o/OpenAIAuth/auth"
+)
+
+// Login renews the session from the saved cookies of the account and signs in with the password
+// once they no longer work. The cookies are saved for the next renewal.
+func (WebBackend) Login(email string, password string, proxy string) (tokens.Secret, *auth.Error) {
+	authenticator := auth.NewAuthenticator(email, password, proxy)
+	if err := authenticator.RenewWithCookies(); err != nil {
+		authenticator.ResetCookies()
+		if err := authenticator.Begin(); err != nil {
+			return tokens.Secret{}, err
+		}
+	}
+	puid, _ := authenticator.GetPUID()
+	teamUserID, _ := authenticator.GetTeamUserID()
+	secret := tokens.Secret{Token: authenticator.GetAccessToken(), PUID: puid, TeamUserID: teamUserID}
+	if err := authenticator.SaveCookies(); err != nil {
+		slog.Warn("Failed to save cookies", "account", email, "error", err.Details)
+	}
+	return secret, nil
+}
@@ -0,0 +1,139 @@
+package chatgpt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"freechatgpt/internal/tokens"
+	"io"
+	"mime/multipart"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/google/uuid"
+	"github.com/xqdoo00o/OpenAIAuth/auth"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+var modelSlugRegexp = regexp.MustCompile(`"model_slug":\s*"[^"]*"`)
+
+// MockBackend replays recorded conversation streams without any network access. A stream is read
+// from <dir>/<model>.sse, then <dir>/default.sse, then the embedded fixtures/default.sse.
+type MockBackend struct {
+	Dir string
+}
+
+func NewMockBackend(dir string) *MockBackend {
+	return &MockBackend{Dir: dir}
+}
+
+func (b *MockBackend) fixture(name string) []byte {
+	if b.Dir != "" {
+		if data, err := os.ReadFile(filepath.Join(b.Dir, filepath.Base(name))); err == nil {
+			return data
+		}
+	}
+	data, _ := fixtures.ReadFile("fixtures/" + name)
+	return data
+}
+
+func (b *MockBackend) CheckRequire(secret *tokens.Secret, deviceId string, proxy string) (*ChatRequire, string, error) {
+	return &ChatRequire{Token: "mock-requirements-token"}, "", nil
+}
+
+func (b *MockBackend) POSTconversation(message ChatGPTRequest, secret *tokens.Secret, deviceId string, chat_token string, proofToken string, turnstileToken string, proxy string) (*http.Response, error) {
+	var body []byte
+	if len(message.Messages) != 0 && message.Messages[len(message.Messages)-1].Author.Role == "assistant" {
+		// Prefilled assistant messages (used by speech) are echoed back
+		body = echoStream(message)
+	} else {
+		body = b.fixture(message.Model + ".sse")
+		if body == nil {
+			body = b.fixture("default.sse")
+			// Upstream replies with the slug of the requested model
+			body = modelSlugRegexp.ReplaceAll(body, []byte(`"model_slug":"`+message.Model+`"`))
+		}
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// echoStream replies with the prefilled assistant message
+func echoStream(message ChatGPTRequest) []byte {
+	last := message.Messages[len(message.Messages)-1]
+	event, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"id":        uuid.NewString(),
+			"author":    last.Author,
+			"content":   last.Content,
+			"recipient": "all",
+		},
+		"conversation_id": uuid.NewString(),
+	})
+	return []byte("data: " + string(event) + "\n\ndata: [DONE]\n\n")
+}
+
+func (b *MockBackend) RemoveConversation(secret *tokens.Secret, deviceId string, id string, proxy string) {
+}
+
+func (b *MockBackend) UploadFile(data []byte, mime string, name string, isImg bool, secret *tokens.Secret, deviceId string, proxy string) string {
+	hash := sha1.Sum(data)
+	return "file-mock" + hex.EncodeToString(hash[:])[:16]
+}
+
+func (b *MockBackend) FileTokens(fileid string, secret *tokens.Secret, deviceId string, proxy string) int {
+	return 0
+}
+
+func (b *MockBackend) Synthesize(secret *tokens.Secret, deviceId string, msgId string, convId string, voice string, format string, proxy string) []byte {
+	if data := b.fixture("speech." + format); data != nil {
+		return data
+	}
+	return []byte("mock " + format + " audio")
+}
+
+func (b *MockBackend) Transcribe(file multipart.File, header *multipart.FileHeader, lang string, secret *tokens.Secret, deviceId string, proxy string) []byte {
+	if data := b.fixture("transcription.json"); data != nil {
+		return data
+	}
+	return []byte(`{"text":"mock transcription of ` + filepath.Base(header.Filename) + `"}`)
+}
+
+func (b *MockBackend) GetModels(secret *tokens.Secret, deviceId string, proxy string) ([]ModelInfo, error) {
+	var result modelsResponse
+	err := json.Unmarshal(b.fixture("models.json"), &result)
+	return result.Models, err
+}
+
+func (b *MockBackend) ProofToken(require *ChatRequire, proxy string) string {
+	return "gAAAAABmock-proof"
+}
+
+// URLAttribution names a cited site by its host
+func (b *MockBackend) URLAttribution(secret *tokens.Secret, deviceId string, url string, proxy string) string {
+	if u, err := neturl.Parse(url); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// ImageSource serves generated images from their download endpoint
+func (b *MockBackend) ImageSource(url string, secret *tokens.Secret, deviceId string, proxy string) string {
+	return url
+}
+
+// Login signs in every account with a token naming it
+func (b *MockBackend) Login(email string, password string, proxy string) (tokens.Secret, *auth.Error) {
+	return tokens.Secret{Token: "mock-token-" + email}, nil
+}
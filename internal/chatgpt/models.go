@@ -0,0 +1,164 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"errors"
+	"freechatgpt/internal/tokens"
+	"strconv"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+// ModelInfo is a model entry of https://chatgpt.com/backend-api/models
+type ModelInfo struct {
+	Slug            string   `json:"slug"`
+	MaxTokens       int      `json:"max_tokens"`
+	Title           string   `json:"title"`
+	Tags            []string `json:"tags"`
+	ProductFeatures struct {
+		Attachments *struct {
+			Type                  string   `json:"type"`
+			AcceptedMimeTypes     []string `json:"accepted_mime_types"`
+			ImageMimeTypes        []string `json:"image_mime_types"`
+			CanAcceptAllMimeTypes bool     `json:"can_accept_all_mime_types"`
+		} `json:"attachments,omitempty"`
+	} `json:"product_features"`
+}
+
+func (m ModelInfo) SupportsImages() bool {
+	return m.ProductFeatures.Attachments != nil && len(m.ProductFeatures.Attachments.ImageMimeTypes) != 0
+}
+
+func (m ModelInfo) SupportsFiles() bool {
+	attachments := m.ProductFeatures.Attachments
+	return attachments != nil && (attachments.CanAcceptAllMimeTypes || len(attachments.AcceptedMimeTypes) != 0)
+}
+
+type modelsResponse struct {
+	Models []ModelInfo `json:"models"`
+}
+
+func (WebBackend) GetModels(secret *tokens.Secret, deviceId string, proxy string) ([]ModelInfo, error) {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	var apiUrl string
+	if secret.Token == "" {
+		apiUrl = "https://chatgpt.com/backend-anon/models?iim=false"
+	} else {
+		apiUrl = "https://chatgpt.com/backend-api/models?history_and_training_disabled=false"
+	}
+	request, err := newRequest(http.MethodGet, apiUrl, nil, secret, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("models request failed with status " + strconv.Itoa(response.StatusCode))
+	}
+	var result modelsResponse
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Models, nil
+}
+
+// PlanModels are the models an account can use with one plan
+type PlanModels struct {
+	Account string
+	Plan    string
+	Models  []ModelInfo
+}
+
+type ModelCache struct {
+	// Plans is keyed by account and plan
+	Plans   map[string]PlanModels
+	Updated time.Time
+	lock    sync.RWMutex
+}
+
+var modelCache = &ModelCache{
+	Plans: make(map[string]PlanModels),
+}
+
+// SetPlanModels records the models of an account plan, an empty list forgets the plan
+func SetPlanModels(account string, plan string, models []ModelInfo) {
+	modelCache.lock.Lock()
+	defer modelCache.lock.Unlock()
+	key := account + "/" + plan
+	if len(models) == 0 {
+		delete(modelCache.Plans, key)
+	} else {
+		modelCache.Plans[key] = PlanModels{Account: account, Plan: plan, Models: models}
+	}
+	modelCache.Updated = time.Now()
+}
+
+// RetainPlanModels forgets the plans of accounts not in accounts
+func RetainPlanModels(accounts map[string]bool) {
+	modelCache.lock.Lock()
+	defer modelCache.lock.Unlock()
+	for key, plan := range modelCache.Plans {
+		if !accounts[plan.Account] {
+			delete(modelCache.Plans, key)
+		}
+	}
+}
+
+// AllPlanModels returns the cached plans
+func AllPlanModels() []PlanModels {
+	modelCache.lock.RLock()
+	defer modelCache.lock.RUnlock()
+	plans := make([]PlanModels, 0, len(modelCache.Plans))
+	for _, plan := range modelCache.Plans {
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+func ModelsUpdated() time.Time {
+	modelCache.lock.RLock()
+	defer modelCache.lock.RUnlock()
+	return modelCache.Updated
+}
+
+// PlanServes reports whether the plan of account lists slug. Without a model list of the plan
+// upstream decides.
+func PlanServes(account string, plan string, slug string) bool {
+	modelCache.lock.RLock()
+	defer modelCache.lock.RUnlock()
+	models, ok := modelCache.Plans[account+"/"+plan]
+	if !ok {
+		return true
+	}
+	for _, model := range models.Models {
+		if model.Slug == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownModels returns the slugs any account can serve, or nil if no model list was fetched
+func KnownModels() map[string]bool {
+	modelCache.lock.RLock()
+	defer modelCache.lock.RUnlock()
+	if len(modelCache.Plans) == 0 {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, plan := range modelCache.Plans {
+		for _, model := range plan.Models {
+			known[model.Slug] = true
+		}
+	}
+	return known
+}
@@ -2,11 +2,16 @@ package chatgpt
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"freechatgpt/internal/metrics"
+	"freechatgpt/internal/tokenizer"
 	"freechatgpt/internal/tokens"
+	"freechatgpt/internal/tracing"
 	"image"
 	"io"
 	"mime"
@@ -25,6 +30,7 @@ import (
 	_ "golang.org/x/image/webp"
 
 	http "github.com/bogdanfinn/fhttp"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/google/uuid"
 )
@@ -51,12 +57,27 @@ type chatgpt_author struct {
 type Image_url struct {
 	Url string `json:"url"`
 }
+type File_part struct {
+	FileID   string `json:"file_id,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
 type Original_multimodel struct {
 	Type  string    `json:"type"`
 	Text  string    `json:"text,omitempty"`
 	Image Image_url `json:"image_url,omitempty"`
+	File  File_part `json:"file,omitempty"`
+}
+
+// FileSource holds the files uploaded through the Files API
+type FileSource interface {
+	// Open returns the content, mime type and name of a file
+	Open(file_id string) ([]byte, string, string, error)
 }
 
+// Files resolves the file_id of file content parts, nil when the Files API is not served
+var Files FileSource
+
 type ChatGPTConvMode struct {
 	Kind    string `json:"kind"`
 	GizmoId string `json:"gizmo_id,omitempty"`
@@ -239,8 +260,9 @@ func NewChatGPTRequest() ChatGPTRequest {
 }
 
 func processUrl(urlstr string, account string, secret *tokens.Secret, deviceId string, proxy string) *FileResult {
-	if proxy != "" {
-		client.SetProxy(proxy)
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return nil
 	}
 	u, err := url.Parse(urlstr)
 	if err != nil {
@@ -266,33 +288,7 @@ func processUrl(urlstr string, account string, secret *tokens.Secret, deviceId s
 	if err != nil {
 		return nil
 	}
-	hasher := sha1.New()
-	hasher.Write(binary)
-	hash := account + secret.TeamUserID + hex.EncodeToString(hasher.Sum(nil))
-	if fileHashPool[hash] != nil && time.Now().Unix() < fileHashPool[hash].Upload+2592000 {
-		return fileHashPool[hash]
-	}
-	isImg := strings.HasPrefix(mimeType, "image")
-	var bounds [2]int
-	if isImg {
-		img, _, _ := image.Decode(bytes.NewReader(binary))
-		if img != nil {
-			bounds[0] = img.Bounds().Dx()
-			bounds[1] = img.Bounds().Dy()
-		}
-	}
-	fileid := uploadBinary(binary, mimeType, fileName, isImg, secret, deviceId, proxy)
-	if fileid == "" {
-		return nil
-	} else {
-		tokenSize := 0
-		if !isImg && retrievalMime[mimeType] {
-			tokenSize = getRetrievalToken(fileid, 10, secret, deviceId, proxy)
-		}
-		result := FileResult{Mime: mimeType, Filename: fileName, Filesize: len(binary), Fileid: fileid, Isimage: isImg, Bounds: bounds, TokenSize: tokenSize, Upload: time.Now().Unix()}
-		fileHashPool[hash] = &result
-		return &result
-	}
+	return processBinary(binary, mimeType, fileName, account, secret, deviceId, proxy)
 }
 func processDataUrl(data string, account string, secret *tokens.Secret, deviceId string, proxy string) *FileResult {
 	commaIndex := strings.Index(data, ",")
@@ -300,12 +296,6 @@ func processDataUrl(data string, account string, secret *tokens.Secret, deviceId
 	if err != nil {
 		return nil
 	}
-	hasher := sha1.New()
-	hasher.Write(binary)
-	hash := account + secret.TeamUserID + hex.EncodeToString(hasher.Sum(nil))
-	if fileHashPool[hash] != nil && time.Now().Unix() < fileHashPool[hash].Upload+2592000 {
-		return fileHashPool[hash]
-	}
 	startIdx := strings.Index(data, ":")
 	endIdx := strings.Index(data, ";")
 	mimeType := data[startIdx+1 : endIdx]
@@ -321,6 +311,45 @@ func processDataUrl(data string, account string, secret *tokens.Secret, deviceId
 		index := strings.Index(mimeType, "/")
 		fileName = "file." + mimeType[index+1:]
 	}
+	return processBinary(binary, mimeType, fileName, account, secret, deviceId, proxy)
+}
+
+// processFilePart uploads a file of the Files API or the inline file_data of a file content part
+func processFilePart(part File_part, account string, secret *tokens.Secret, deviceId string, proxy string) *FileResult {
+	if part.FileID == "" {
+		// file_data is a data URL
+		if !strings.HasPrefix(part.FileData, "data:") || !strings.Contains(part.FileData, ";") {
+			return nil
+		}
+		result := processDataUrl(part.FileData, account, secret, deviceId, proxy)
+		if result != nil && part.Filename != "" {
+			named := *result
+			named.Filename = part.Filename
+			return &named
+		}
+		return result
+	}
+	if Files == nil {
+		return nil
+	}
+	binary, mimeType, fileName, err := Files.Open(part.FileID)
+	if err != nil {
+		return nil
+	}
+	return processBinary(binary, mimeType, fileName, account, secret, deviceId, proxy)
+}
+
+// processBinary uploads a file to the account, a file already uploaded to it within 30 days is
+// reused
+func processBinary(binary []byte, mimeType string, fileName string, account string, secret *tokens.Secret, deviceId string, proxy string) *FileResult {
+	hasher := sha1.New()
+	hasher.Write(binary)
+	hash := account + secret.TeamUserID + hex.EncodeToString(hasher.Sum(nil))
+	if fileHashPool[hash] != nil && time.Now().Unix() < fileHashPool[hash].Upload+2592000 {
+		metrics.FileCache(true)
+		return fileHashPool[hash]
+	}
+	metrics.FileCache(false)
 	isImg := strings.HasPrefix(mimeType, "image")
 	var bounds [2]int
 	if isImg {
@@ -330,22 +359,23 @@ func processDataUrl(data string, account string, secret *tokens.Secret, deviceId
 			bounds[1] = img.Bounds().Dy()
 		}
 	}
-	fileid := uploadBinary(binary, mimeType, fileName, isImg, secret, deviceId, proxy)
+	fileid := Upstream.UploadFile(binary, mimeType, fileName, isImg, secret, deviceId, proxy)
 	if fileid == "" {
 		return nil
 	} else {
 		tokenSize := 0
 		if !isImg && retrievalMime[mimeType] {
-			tokenSize = getRetrievalToken(fileid, 10, secret, deviceId, proxy)
+			tokenSize = Upstream.FileTokens(fileid, secret, deviceId, proxy)
 		}
 		result := FileResult{Mime: mimeType, Filename: fileName, Filesize: len(binary), Fileid: fileid, Isimage: isImg, Bounds: bounds, TokenSize: tokenSize, Upload: time.Now().Unix()}
 		fileHashPool[hash] = &result
 		return &result
 	}
 }
-func uploadBinary(data []byte, mime string, name string, isImg bool, secret *tokens.Secret, deviceId string, proxy string) string {
-	if proxy != "" {
-		client.SetProxy(proxy)
+func (WebBackend) UploadFile(data []byte, mime string, name string, isImg bool, secret *tokens.Secret, deviceId string, proxy string) string {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return ""
 	}
 	var fileCase string
 	if isImg {
@@ -403,9 +433,14 @@ func uploadBinary(data []byte, mime string, name string, isImg bool, secret *tok
 	}
 	return fileResp.File_id
 }
+func (WebBackend) FileTokens(fileid string, secret *tokens.Secret, deviceId string, proxy string) int {
+	return getRetrievalToken(fileid, 10, secret, deviceId, proxy)
+}
+
 func getRetrievalToken(fileid string, retry int, secret *tokens.Secret, deviceId string, proxy string) int {
-	if proxy != "" {
-		client.SetProxy(proxy)
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return 0
 	}
 	request, err := newRequest(http.MethodGet, "https://chatgpt.com/backend-api/files/"+fileid, nil, secret, deviceId)
 	if err != nil {
@@ -433,7 +468,7 @@ func getRetrievalToken(fileid string, retry int, secret *tokens.Secret, deviceId
 		}
 	}
 }
-func (c *ChatGPTRequest) AddMessage(role string, content interface{}, multimodal bool, account string, secret *tokens.Secret, deviceId string, proxy string) {
+func (c *ChatGPTRequest) AddMessage(ctx context.Context, role string, content interface{}, multimodal bool, account string, secret *tokens.Secret, deviceId string, proxy string) {
 	parts := []interface{}{}
 	var metadatas Chatgpt_metadata
 	msgType := "text"
@@ -451,29 +486,39 @@ func (c *ChatGPTRequest) AddMessage(role string, content interface{}, multimodal
 			if itemtype == "text" {
 				text, _ := itemMap["text"].(string)
 				items = append(items, Original_multimodel{Type: itemtype, Text: text})
+			} else if itemtype == "file" {
+				fileMap, _ := itemMap["file"].(map[string]interface{})
+				file_id, _ := fileMap["file_id"].(string)
+				file_data, _ := fileMap["file_data"].(string)
+				filename, _ := fileMap["filename"].(string)
+				items = append(items, Original_multimodel{Type: itemtype, File: File_part{FileID: file_id, FileData: file_data, Filename: filename}})
 			} else {
 				imageMap, _ := itemMap["image_url"].(map[string]interface{})
-				items = append(items, Original_multimodel{Type: itemtype, Image: Image_url{Url: imageMap["url"].(string)}})
+				url, _ := imageMap["url"].(string)
+				items = append(items, Original_multimodel{Type: itemtype, Image: Image_url{Url: url}})
 			}
 		}
 		for _, item := range items {
-			if item.Type == "image_url" {
+			if item.Type == "image_url" || item.Type == "file" {
 				if !multimodal {
 					continue
 				}
 				data := item.Image.Url
 				var result *FileResult
-				if strings.HasPrefix(data, "data:") {
+				_, span := tracing.Start(ctx, "chatgpt.UploadFile", attribute.Bool("file.data_url", strings.HasPrefix(data, "data:")), attribute.String("file.file_id", item.File.FileID))
+				if item.Type == "file" {
+					result = processFilePart(item.File, account, secret, deviceId, proxy)
+				} else if strings.HasPrefix(data, "data:") {
 					result = processDataUrl(data, account, secret, deviceId, proxy)
-					if result == nil {
-						continue
-					}
 				} else {
 					result = processUrl(data, account, secret, deviceId, proxy)
-					if result == nil {
-						continue
-					}
 				}
+				if result == nil {
+					tracing.End(span, errors.New("unable to upload the file"))
+					continue
+				}
+				span.SetAttributes(attribute.String("file.id", result.Fileid), attribute.String("file.mime", result.Mime), attribute.Int("file.size", result.Filesize))
+				tracing.End(span, nil)
 				if result.Isimage {
 					msgType = "multimodal_text"
 					parts = append(parts, ImgPart{Asset_pointer: "file-service://" + result.Fileid, Content_type: "image_asset_pointer", Size_bytes: result.Filesize, Width: result.Bounds[0], Height: result.Bounds[1]})
@@ -498,6 +543,26 @@ func (c *ChatGPTRequest) AddMessage(role string, content interface{}, multimodal
 	c.Messages = append(c.Messages, msg)
 }
 
+// CountTokens returns the prompt tokens of the request messages for model
+func (c *ChatGPTRequest) CountTokens(model string) int {
+	count := tokenizer.ReplyPriming
+	for _, msg := range c.Messages {
+		var texts []string
+		for _, part := range msg.Content.Parts {
+			if text, ok := part.(string); ok {
+				texts = append(texts, text)
+			}
+		}
+		count += tokenizer.CountMessage(model, msg.Author.Role, strings.Join(texts, "\n"))
+		if msg.Metadata != nil {
+			for _, attachment := range msg.Metadata.Attachments {
+				count += attachment.TokenSize
+			}
+		}
+	}
+	return count
+}
+
 func (c *ChatGPTRequest) AddAssistantMessage(input string) {
 	var msg = chatgpt_message{
 		ID:       uuid.New(),
@@ -6,9 +6,11 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"freechatgpt/internal/metrics"
 	"freechatgpt/internal/tokens"
 	"freechatgpt/typings"
 	chatgpt_types "freechatgpt/typings/chatgpt"
+	official_types "freechatgpt/typings/official"
 	"io"
 	"math"
 	"math/rand"
@@ -24,19 +26,14 @@ import (
 
 	"github.com/PuerkitoBio/goquery"
 	http "github.com/bogdanfinn/fhttp"
-	tls_client "github.com/bogdanfinn/tls-client"
-	"github.com/bogdanfinn/tls-client/profiles"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/sha3"
 
 	chatgpt_response_converter "freechatgpt/conversion/response/chatgpt"
-
-	official_types "freechatgpt/typings/official"
 )
 
 var (
-	client              tls_client.HttpClient
 	hostURL, _          = url.Parse("https://chatgpt.com")
 	API_REVERSE_PROXY   = os.Getenv("API_REVERSE_PROXY")
 	FILES_REVERSE_PROXY = os.Getenv("FILES_REVERSE_PROXY")
@@ -60,23 +57,10 @@ func init() {
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 	cachedHardware = screens[rand.Intn(3)]
 
-	envClientProfileStr := os.Getenv("CLIENT_PROFILE")
-	var clientProfile profiles.ClientProfile
-	if profile, ok := profiles.MappedTLSClients[envClientProfileStr]; ok {
-		clientProfile = profile
-	} else {
-		clientProfile = profiles.Okhttp4Android13
-	}
 	envUserAgent := os.Getenv("UA")
 	if envUserAgent != "" {
 		userAgent = envUserAgent
 	}
-	client, _ = tls_client.NewHttpClient(tls_client.NewNoopLogger(), []tls_client.HttpClientOption{
-		tls_client.WithCookieJar(tls_client.NewCookieJar()),
-		tls_client.WithRandomTLSExtensionOrder(),
-		tls_client.WithTimeoutSeconds(600),
-		tls_client.WithClientProfile(clientProfile),
-	}...)
 }
 
 func newRequest(method string, url string, body io.Reader, secret *tokens.Secret, deviceId string) (*http.Request, error) {
@@ -100,13 +84,6 @@ func newRequest(method string, url string, body io.Reader, secret *tokens.Secret
 	return request, nil
 }
 
-func SetOAICookie(uuid string) {
-	client.GetCookieJar().SetCookies(hostURL, []*http.Cookie{{
-		Name:  "oai-did",
-		Value: uuid,
-	}})
-}
-
 type ProofWork struct {
 	Difficulty string `json:"difficulty,omitempty"`
 	Required   bool   `json:"required"`
@@ -118,12 +95,13 @@ func getParseTime() string {
 	now = now.In(timeLocation)
 	return now.Format(timeLayout) + " GMT+0800 (中国标准时间)"
 }
-func GetDpl(proxy string) {
+func getDpl(proxy string) {
 	if cachedId != "" {
 		return
 	}
-	if proxy != "" {
-		client.SetProxy(proxy)
+	client, err := getClient(proxy, "")
+	if err != nil {
+		return
 	}
 	cachedId = "prod-a696433ddfe0489db6696cae8c5778c2128f26e8"
 	request, err := http.NewRequest(http.MethodGet, "https://chatgpt.com/?oai-dm=1", nil)
@@ -164,14 +142,15 @@ func getConfig() []interface{} {
 	timeNum := (float64(time.Since(startTime).Nanoseconds()) + rand.Float64()) / 1e6
 	return []interface{}{cachedHardware, getParseTime(), int64(4294705152), 0, userAgent, script, cachedId, "en-US", "en-US", 0, "webkitGetUserMedia−function webkitGetUserMedia() { [native code] }", "location", "ontransitionend", timeNum, cachedSid, "", cachedCore, float64(startTime.UnixMicro()) / 1e3}
 }
-func CalcProofToken(require *ChatRequire, proxy string) string {
+func (WebBackend) ProofToken(require *ChatRequire, proxy string) string {
 	proof := generateAnswer(require.Proof.Seed, require.Proof.Difficulty, proxy)
 	return "gAAAAAB" + proof
 }
 
 func generateAnswer(seed string, diff string, proxy string) string {
-	GetDpl(proxy)
+	getDpl(proxy)
 	timeStart := time.Now()
+	defer metrics.ObserveUpstream("proof_of_work", timeStart)
 	config := getConfig()
 	diffLen := len(diff)
 	hasher := sha3.New512()
@@ -200,9 +179,10 @@ type ChatRequire struct {
 	ForceLogin bool `json:"force_login,omitempty"`
 }
 
-func CheckRequire(secret *tokens.Secret, deviceId string, proxy string) (*ChatRequire, string) {
-	if proxy != "" {
-		client.SetProxy(proxy)
+func (WebBackend) CheckRequire(secret *tokens.Secret, deviceId string, proxy string) (*ChatRequire, string, error) {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return nil, "", official_types.UpstreamError(502, "upstream_unreachable", "Unable to reach chatgpt.com: "+err.Error())
 	}
 	if cachedRequireProof == "" {
 		cachedRequireProof = "gAAAAAC" + generateAnswer(strconv.FormatFloat(rand.Float64(), 'f', -1, 64), "0", proxy)
@@ -216,23 +196,28 @@ func CheckRequire(secret *tokens.Secret, deviceId string, proxy string) (*ChatRe
 	}
 	request, err := newRequest(http.MethodPost, apiUrl, body, secret, deviceId)
 	if err != nil {
-		return nil, ""
+		return nil, "", official_types.ServerError(err.Error())
 	}
 	request.Header.Set("Content-Type", "application/json")
+	start := time.Now()
 	response, err := client.Do(request)
 	if err != nil {
-		return nil, ""
+		return nil, "", official_types.UpstreamError(502, "upstream_unreachable", "Unable to reach chatgpt.com: "+err.Error())
 	}
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, "", Read_request_error(response)
+	}
 	var require ChatRequire
 	err = json.NewDecoder(response.Body).Decode(&require)
 	if err != nil {
-		return nil, ""
+		return nil, "", official_types.UpstreamError(502, "upstream_error", "Unable to check chat requirement")
 	}
+	metrics.ObserveUpstream("chat_requirements", start)
 	if require.ForceLogin {
-		return nil, ""
+		return nil, "", official_types.UpstreamError(503, "login_required", "chatgpt.com requires a logged in account, add accounts to accounts.txt")
 	}
-	return &require, cachedRequireProof
+	return &require, cachedRequireProof, nil
 }
 
 var urlAttrMap = make(map[string]string)
@@ -242,7 +227,11 @@ type urlAttr struct {
 	Attribution string `json:"attribution"`
 }
 
-func getURLAttribution(secret *tokens.Secret, deviceId string, url string) string {
+func (WebBackend) URLAttribution(secret *tokens.Secret, deviceId string, url string, proxy string) string {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return ""
+	}
 	request, err := newRequest(http.MethodPost, "https://chatgpt.com/backend-api/attributions", bytes.NewBuffer([]byte(`{"urls":["`+url+`"]}`)), secret, deviceId)
 	if err != nil {
 		return ""
@@ -261,9 +250,10 @@ func getURLAttribution(secret *tokens.Secret, deviceId string, url string) strin
 	return attr.Attribution
 }
 
-func POSTconversation(message ChatGPTRequest, secret *tokens.Secret, deviceId string, chat_token string, proofToken string, turnstileToken string, proxy string) (*http.Response, error) {
-	if proxy != "" {
-		client.SetProxy(proxy)
+func (WebBackend) POSTconversation(message ChatGPTRequest, secret *tokens.Secret, deviceId string, chat_token string, proofToken string, turnstileToken string, proxy string) (*http.Response, error) {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return &http.Response{}, err
 	}
 	var apiUrl string
 	if secret.Token == "" {
@@ -296,40 +286,69 @@ func POSTconversation(message ChatGPTRequest, secret *tokens.Secret, deviceId st
 	}
 	request.Header.Set("Origin", "https://chatgpt.com")
 	request.Header.Set("Referer", "https://chatgpt.com/")
+	start := time.Now()
 	response, err := client.Do(request)
 	if err != nil {
 		return &http.Response{}, err
 	}
+	metrics.ObserveUpstream("conversation_first_byte", start)
 	return response, err
 }
 
-// Returns whether an error was handled
-func Handle_request_error(c *gin.Context, response *http.Response) bool {
-	if response.StatusCode != 200 {
-		// Try read response body as JSON
-		var error_response map[string]interface{}
-		err := json.NewDecoder(response.Body).Decode(&error_response)
-		if err != nil {
-			// Read response body
-			body, _ := io.ReadAll(response.Body)
-			c.JSON(500, gin.H{"error": gin.H{
-				"message": "Unknown error",
-				"type":    "internal_server_error",
-				"param":   nil,
-				"code":    "500",
-				"details": string(body),
-			}})
-			return true
+// Read_request_error maps a failed upstream response to an OpenAI error. Failures the client
+// can not fix, like an expired account token or a Cloudflare challenge, are server errors.
+func Read_request_error(response *http.Response) *official_types.APIError {
+	body, _ := io.ReadAll(response.Body)
+	var error_response struct {
+		Detail interface{} `json:"detail"`
+	}
+	var detail string
+	if json.Unmarshal(body, &error_response) == nil {
+		switch v := error_response.Detail.(type) {
+		case string:
+			detail = v
+		case map[string]interface{}:
+			if message, ok := v["message"].(string); ok {
+				detail = message
+			} else if code, ok := v["code"].(string); ok {
+				detail = code
+			}
+		}
+	}
+	switch response.StatusCode {
+	case http.StatusUnauthorized:
+		return official_types.UpstreamError(503, "upstream_token_expired", "The access token of the upstream account has expired or was revoked")
+	case http.StatusTooManyRequests:
+		err := official_types.RateLimitError("Rate limit reached for the upstream account, try again later")
+		if detail != "" {
+			err.Message += ": " + detail
 		}
-		c.JSON(response.StatusCode, gin.H{"error": gin.H{
-			"message": error_response["detail"],
-			"type":    response.Status,
-			"param":   nil,
-			"code":    "error",
-		}})
-		return true
-	}
-	return false
+		err.RetryAfter = response.Header.Get("Retry-After")
+		return err
+	case http.StatusForbidden:
+		if response.Header.Get("Cf-Mitigated") == "challenge" || bytes.Contains(body, []byte("cf_chl")) || bytes.Contains(body, []byte("Just a moment")) {
+			return official_types.UpstreamError(502, "upstream_cloudflare", "chatgpt.com blocked the request with a Cloudflare challenge, check the proxy")
+		}
+		message := "chatgpt.com rejected the request"
+		if detail != "" {
+			message += ": " + detail
+		}
+		return official_types.UpstreamError(502, "upstream_forbidden", message)
+	case http.StatusNotFound:
+		message := "chatgpt.com could not find the conversation"
+		if detail != "" {
+			message = detail
+		}
+		return official_types.UpstreamError(502, "upstream_not_found", message)
+	}
+	if detail == "" {
+		detail = "Unknown error"
+	}
+	status := http.StatusBadGateway
+	if response.StatusCode == http.StatusServiceUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	return official_types.UpstreamError(status, "upstream_error", "chatgpt.com returned "+response.Status+": "+detail)
 }
 
 type ContinueInfo struct {
@@ -337,69 +356,59 @@ type ContinueInfo struct {
 	ParentID       string `json:"parent_id"`
 }
 
+// StreamWriter receives the assistant text decoded by Handler.
+// Returning an error from WriteDelta stops reading the upstream stream.
+type StreamWriter interface {
+	WriteDelta(text string) error
+	// SetModel is called with the upstream model slug before the first delta
+	SetModel(slug string)
+}
+
 type fileInfo struct {
 	DownloadURL string `json:"download_url"`
 	Status      string `json:"status"`
 }
 
-func GetImageSource(wg *sync.WaitGroup, url string, prompt string, secret *tokens.Secret, deviceId string, idx int, imgSource []string) {
-	defer wg.Done()
+func (WebBackend) ImageSource(url string, secret *tokens.Secret, deviceId string, proxy string) string {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return ""
+	}
 	request, err := newRequest(http.MethodGet, url, nil, secret, deviceId)
 	if err != nil {
-		return
+		return ""
 	}
 	response, err := client.Do(request)
 	if err != nil {
-		return
+		return ""
 	}
 	defer response.Body.Close()
 	var file_info fileInfo
 	err = json.NewDecoder(response.Body).Decode(&file_info)
 	if err != nil || file_info.Status != "success" {
-		return
+		return ""
 	}
-	// if strings.HasPrefix(file_info.DownloadURL, "http") {
-	imgSource[idx] = "[![image](" + file_info.DownloadURL + " \"" + prompt + "\")](" + file_info.DownloadURL + ")"
-	// } else {
-	// 	req, err := newRequest(http.MethodGet, "https://chatgpt.com"+file_info.DownloadURL, nil, secret, deviceId)
-	// 	req.Header.Set("Accept", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8")
-	// 	if err != nil {
-	// 		return
-	// 	}
-	// 	client.SetFollowRedirect(false)
-	// 	resp, err := client.Do(req)
-	// 	if err != nil {
-	// 		return
-	// 	}
-	// 	defer resp.Body.Close()
-	// 	redirURL := resp.Header.Get("Location")
-	// 	if redirURL != "" {
-	// 		imgSource[idx] = "[![image](" + redirURL + " \"" + prompt + "\")](" + redirURL + ")"
-	// 	}
-	// }
+	return file_info.DownloadURL
 }
 
-func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, proxy string, deviceId string, uuid string, stream bool) (string, *ContinueInfo) {
+// Handler writes the assistant text of response to writer. It returns the full text, the position of
+// the last assistant message, whether the reply was cut by max_tokens and should be continued, and
+// the error if upstream failed while streaming.
+func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, proxy string, deviceId string, uuid string, writer StreamWriter) (string, ContinueInfo, bool, error) {
 	max_tokens := false
+	stopped := false
+	defer metrics.ObserveUpstream("conversation_stream", time.Now())
 
 	// Create a bufio.Reader from the response body
 	reader := bufio.NewReader(response.Body)
 
-	// Read the response byte by byte until a newline character is encountered
-	if stream {
-		// Response content type is text/event-stream
-		c.Header("Content-Type", "text/event-stream")
-	} else {
-		// Response content type is application/json
-		c.Header("Content-Type", "application/json")
-	}
-	var finish_reason string
 	var previous_text typings.StringStruct
 	var original_response chatgpt_types.ChatGPTResponse
-	var isRole = true
 	var imgSource []string
 	var convId string
 	var msgId string
+	var modelSlug string
+	var position ContinueInfo
 
 	for {
 		var line string
@@ -409,7 +418,7 @@ func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, pro
 			if err == io.EOF {
 				break
 			}
-			return "", nil
+			return "", ContinueInfo{}, false, official_types.UpstreamError(502, "upstream_interrupted", "The upstream stream was interrupted: "+err.Error())
 		}
 		if len(line) < 6 {
 			continue
@@ -425,8 +434,7 @@ func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, pro
 				continue
 			}
 			if original_response.Error != nil {
-				c.JSON(500, gin.H{"error": original_response.Error})
-				return "", nil
+				return "", ContinueInfo{}, false, streamError(original_response.Error)
 			}
 			if original_response.Message.ID == "" {
 				continue
@@ -457,6 +465,10 @@ func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, pro
 			if original_response.Message.EndTurn != nil && !original_response.Message.EndTurn.(bool) {
 				msgId = ""
 			}
+			position = ContinueInfo{
+				ConversationID: convId,
+				ParentID:       original_response.Message.ID,
+			}
 			if len(original_response.Message.Metadata.Citations) != 0 {
 				r := []rune(original_response.Message.Content.Parts[0].(string))
 				offset := 0
@@ -466,7 +478,7 @@ func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, pro
 					baseURL := u.Scheme + "://" + u.Host + "/"
 					attr := urlAttrMap[baseURL]
 					if attr == "" {
-						attr = getURLAttribution(secret, deviceId, baseURL)
+						attr = Upstream.URLAttribution(secret, deviceId, baseURL, proxy)
 						if attr != "" {
 							urlAttrMap[baseURL] = attr
 						}
@@ -477,7 +489,7 @@ func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, pro
 					offset += len(r) - rl
 				}
 			}
-			response_string := ""
+			delta := ""
 			if original_response.Message.Content.ContentType == "multimodal_text" {
 				apiUrl := "https://chatgpt.com/backend-api/files/"
 				if FILES_REVERSE_PROXY != "" {
@@ -494,40 +506,34 @@ func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, pro
 					}
 					url := apiUrl + strings.Split(dalle_content.AssetPointer, "//")[1] + "/download"
 					wg.Add(1)
-					go GetImageSource(&wg, url, dalle_content.Metadata.Dalle.Prompt, secret, deviceId, index, imgSource)
+					go func(index int, url string, prompt string) {
+						defer wg.Done()
+						if source := Upstream.ImageSource(url, secret, deviceId, proxy); source != "" {
+							imgSource[index] = "[![image](" + source + " \"" + prompt + "\")](" + source + ")"
+						}
+					}(index, url, dalle_content.Metadata.Dalle.Prompt)
 				}
 				wg.Wait()
-				translated_response := official_types.NewChatCompletionChunk(strings.Join(imgSource, "") + "\n")
-				if isRole {
-					translated_response.Choices[0].Delta.Role = original_response.Message.Author.Role
-				}
-				response_string = "data: " + translated_response.String() + "\n\n"
+				delta = strings.Join(imgSource, "") + "\n"
+			} else {
+				delta = chatgpt_response_converter.ConvertToDelta(&original_response, &previous_text)
 			}
-			if response_string == "" {
-				response_string = chatgpt_response_converter.ConvertToString(&original_response, &previous_text, isRole)
+			if modelSlug == "" && original_response.Message.Metadata.ModelSlug != "" {
+				modelSlug = original_response.Message.Metadata.ModelSlug
+				writer.SetModel(modelSlug)
 			}
-			if isRole && response_string != "" {
-				isRole = false
-			}
-			if stream && response_string != "" {
-				_, err = c.Writer.WriteString(response_string)
+			if delta != "" {
+				err = writer.WriteDelta(delta)
 				if err != nil {
-					return "", nil
+					stopped = true
+					break
 				}
 			}
-			// Flush the response writer buffer to ensure that the client receives each line as it's written
-			c.Writer.Flush()
 
 			if original_response.Message.Metadata.FinishDetails != nil {
 				if original_response.Message.Metadata.FinishDetails.Type == "max_tokens" {
 					max_tokens = true
 				}
-				finish_reason = original_response.Message.Metadata.FinishDetails.Type
-			}
-		} else {
-			if stream {
-				final_line := official_types.StopChunk(finish_reason)
-				c.Writer.WriteString("data: " + final_line.String() + "\n\n")
 			}
 		}
 	}
@@ -536,13 +542,20 @@ func Handler(c *gin.Context, response *http.Response, secret *tokens.Secret, pro
 		respText += "\n"
 	}
 	respText += previous_text.Text
-	if !max_tokens {
-		return respText, nil
+	return respText, position, max_tokens && !stopped, nil
+}
+
+// streamError maps the error event of a conversation stream
+func streamError(upstream_error interface{}) *official_types.APIError {
+	message, ok := upstream_error.(string)
+	if !ok {
+		detail, _ := json.Marshal(upstream_error)
+		message = string(detail)
 	}
-	return respText, &ContinueInfo{
-		ConversationID: original_response.ConversationID,
-		ParentID:       original_response.Message.ID,
+	if strings.Contains(strings.ToLower(message), "limit") {
+		return official_types.RateLimitError(message)
 	}
+	return official_types.UpstreamError(502, "upstream_error", message)
 }
 
 func HandlerTTS(response *http.Response, input string) (string, string) {
@@ -596,11 +609,13 @@ func HandlerTTS(response *http.Response, input string) (string, string) {
 	return "", ""
 }
 
-func GetTTS(secret *tokens.Secret, deviceId string, url string, proxy string) []byte {
-	if proxy != "" {
-		client.SetProxy(proxy)
+func (WebBackend) Synthesize(secret *tokens.Secret, deviceId string, msgId string, convId string, voice string, format string, proxy string) []byte {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return nil
 	}
-	request, err := newRequest(http.MethodGet, url, nil, secret, deviceId)
+	apiUrl := "https://chatgpt.com/backend-api/synthesize?message_id=" + msgId + "&conversation_id=" + convId + "&voice=" + voice + "&format=" + format
+	request, err := newRequest(http.MethodGet, apiUrl, nil, secret, deviceId)
 	if err != nil {
 		return nil
 	}
@@ -629,9 +644,10 @@ func generateRandomString(n int) string {
 	return string(bytes)
 }
 
-func GetSTT(file multipart.File, header *multipart.FileHeader, lang string, secret *tokens.Secret, deviceId string, proxy string) []byte {
-	if proxy != "" {
-		client.SetProxy(proxy)
+func (WebBackend) Transcribe(file multipart.File, header *multipart.FileHeader, lang string, secret *tokens.Secret, deviceId string, proxy string) []byte {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return nil
 	}
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
@@ -673,9 +689,10 @@ func GetSTT(file multipart.File, header *multipart.FileHeader, lang string, secr
 	return body
 }
 
-func RemoveConversation(secret *tokens.Secret, deviceId string, id string, proxy string) {
-	if proxy != "" {
-		client.SetProxy(proxy)
+func (WebBackend) RemoveConversation(secret *tokens.Secret, deviceId string, id string, proxy string) {
+	client, err := getClient(proxy, deviceId)
+	if err != nil {
+		return
 	}
 	url := "https://chatgpt.com/backend-api/conversation/" + id
 	request, err := newRequest(http.MethodPatch, url, bytes.NewBuffer([]byte(`{"is_visible":false}`)), secret, deviceId)
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"reflect"
 	"strconv"
@@ -122,7 +123,7 @@ func toStr(input any) string {
 	} else if inputArray, ok := input.([]string); ok {
 		output = strings.Join(inputArray, ",")
 	} else {
-		fmt.Printf("Type of input is: %s\n", reflect.TypeOf(input))
+		slog.Debug("Turnstile: unexpected input type", "type", reflect.TypeOf(input))
 	}
 	return output
 }
@@ -136,7 +137,7 @@ func getFuncMap() FloatMap {
 		tstr := toStr(processMap[t])
 		res, err := porcessTurnstileToken(estr, tstr)
 		if err != nil {
-			fmt.Println(err)
+			slog.Debug("Turnstile failed", "error", err)
 		}
 		processMap[e] = res
 		return nil
@@ -191,7 +192,7 @@ func getFuncMap() FloatMap {
 				processMap[e] = res
 			}
 		} else {
-			fmt.Println("func type 6 error")
+			slog.Debug("Turnstile: func type 6 error")
 		}
 		return nil
 	})
@@ -206,7 +207,7 @@ func getFuncMap() FloatMap {
 			nstr := nv.(string)
 			processMap[e] = tstr + "." + nstr
 		} else {
-			fmt.Println("func type 24 error")
+			slog.Debug("Turnstile: func type 24 error")
 		}
 		return nil
 	})
@@ -283,11 +284,11 @@ func getFuncMap() FloatMap {
 			var tokenList turnTokenList
 			err := json.Unmarshal([]byte(tv.(string)), &tokenList)
 			if err != nil {
-				fmt.Println(err)
+				slog.Debug("Turnstile failed", "error", err)
 			}
 			processMap[e] = tokenList
 		} else {
-			fmt.Println("func type 14 error")
+			slog.Debug("Turnstile: func type 14 error")
 		}
 		return nil
 	})
@@ -297,7 +298,7 @@ func getFuncMap() FloatMap {
 		tv := processMap[t]
 		tres, err := json.Marshal(tv)
 		if err != nil {
-			fmt.Println(err)
+			slog.Debug("Turnstile failed", "error", err)
 		}
 		processMap[e] = string(tres)
 		return nil
@@ -308,7 +309,7 @@ func getFuncMap() FloatMap {
 		estr := toStr(ev)
 		decoded, err := base64.StdEncoding.DecodeString(estr)
 		if err != nil {
-			fmt.Println(err)
+			slog.Debug("Turnstile failed", "error", err)
 		}
 		processMap[e] = string(decoded)
 		return nil
@@ -340,7 +341,7 @@ func getFuncMap() FloatMap {
 			case FuncType:
 				nv(o...)
 			default:
-				fmt.Println("func type 20 error")
+				slog.Debug("Turnstile: func type 20 error")
 			}
 		}
 		return nil
@@ -377,7 +378,7 @@ func ProcessTurnstile(dx, p string) string {
 	var tokenList turnTokenList
 	err := json.Unmarshal([]byte(tokens), &tokenList)
 	if err != nil {
-		fmt.Println(err)
+		slog.Debug("Turnstile failed", "error", err)
 	}
 	var res string
 	processMap := getFuncMap()
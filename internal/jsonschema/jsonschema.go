@@ -0,0 +1,377 @@
+// Package jsonschema validates JSON values against the subset of JSON Schema used by structured
+// outputs: types, enum, const, properties, required, additionalProperties, items, the length and
+// range keywords, pattern, anyOf, oneOf, allOf, not and local $ref.
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema is a compiled schema
+type Schema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// Compile checks a decoded schema, its patterns must compile and its references must resolve
+func Compile(schema interface{}) (*Schema, error) {
+	switch schema.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, errors.New("schema must be an object")
+	}
+	s := &Schema{root: schema, patterns: map[string]*regexp.Regexp{}}
+	if err := s.check(schema, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) check(node interface{}, path string) error {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok {
+			if _, err := s.resolve(ref); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		if pattern, ok := v["pattern"].(string); ok {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern %q", path, pattern)
+			}
+			s.patterns[pattern] = compiled
+		}
+		for key, child := range v {
+			switch key {
+			case "enum", "const", "required", "examples", "default", "description", "title":
+				continue
+			case "properties", "patternProperties", "$defs", "definitions", "dependentSchemas":
+				// The keys are names, which may be the same as a keyword, and every value is a schema
+				if err := s.checkNamed(child, path+"/"+key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.check(child, path+"/"+key); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if err := s.check(child, path+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) checkNamed(node interface{}, path string) error {
+	schemas, ok := node.(map[string]interface{})
+	if !ok {
+		return s.check(node, path)
+	}
+	for name, child := range schemas {
+		if err := s.check(child, path+"/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve looks up a reference within the schema such as #/$defs/item
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference %q, only references within the schema are", ref)
+	}
+	node := s.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+		if node, ok = object[token]; !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// Validate returns an error naming the first part of value which does not match the schema
+func (s *Schema) Validate(value interface{}) error {
+	return s.validate(s.root, value, "$", 0)
+}
+
+func (s *Schema) validate(node interface{}, value interface{}, path string, depth int) error {
+	if depth > 64 {
+		return fmt.Errorf("%s: schema nests too deep", path)
+	}
+	if allowed, ok := node.(bool); ok {
+		if !allowed {
+			return fmt.Errorf("%s: no value is allowed here", path)
+		}
+		return nil
+	}
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+		if err := s.validate(target, value, path, depth+1); err != nil {
+			return err
+		}
+	}
+	if types, ok := schema["type"]; ok && !matchesType(types, value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, typeNames(types), typeOf(value))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if reflect.DeepEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			options, _ := json.Marshal(enum)
+			return fmt.Errorf("%s: must be one of %s", path, options)
+		}
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		expected, _ := json.Marshal(constant)
+		return fmt.Errorf("%s: must be %s", path, expected)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if err := s.validateObject(schema, v, path, depth); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(schema, v, path, depth); err != nil {
+			return err
+		}
+	case string:
+		length := len([]rune(v))
+		if limit, ok := number(schema["minLength"]); ok && float64(length) < limit {
+			return fmt.Errorf("%s: must be at least %v characters long", path, limit)
+		}
+		if limit, ok := number(schema["maxLength"]); ok && float64(length) > limit {
+			return fmt.Errorf("%s: must be at most %v characters long", path, limit)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			compiled := s.patterns[pattern]
+			if compiled == nil {
+				return fmt.Errorf("%s: the pattern %q was not compiled", path, pattern)
+			}
+			if !compiled.MatchString(v) {
+				return fmt.Errorf("%s: must match the pattern %q", path, pattern)
+			}
+		}
+	case float64:
+		if limit, ok := number(schema["minimum"]); ok && v < limit {
+			return fmt.Errorf("%s: must be at least %v", path, limit)
+		}
+		if limit, ok := number(schema["maximum"]); ok && v > limit {
+			return fmt.Errorf("%s: must be at most %v", path, limit)
+		}
+		if limit, ok := number(schema["exclusiveMinimum"]); ok && v <= limit {
+			return fmt.Errorf("%s: must be greater than %v", path, limit)
+		}
+		if limit, ok := number(schema["exclusiveMaximum"]); ok && v >= limit {
+			return fmt.Errorf("%s: must be less than %v", path, limit)
+		}
+		if factor, ok := number(schema["multipleOf"]); ok && factor != 0 && math.Abs(math.Remainder(v, factor)) > 1e-9 {
+			return fmt.Errorf("%s: must be a multiple of %v", path, factor)
+		}
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := s.validate(sub, value, path, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if any, ok := schema["anyOf"].([]interface{}); ok {
+		var first error
+		for _, sub := range any {
+			err := s.validate(sub, value, path, depth+1)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return fmt.Errorf("%s: matches none of anyOf, %w", path, first)
+		}
+	}
+	if one, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range one {
+			if s.validate(sub, value, path, depth+1) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: must match exactly one of oneOf, matches %d", path, matches)
+		}
+	}
+	if not, ok := schema["not"]; ok && s.validate(not, value, path, depth+1) == nil {
+		return fmt.Errorf("%s: must not match the schema in not", path)
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(schema map[string]interface{}, object map[string]interface{}, path string, depth int) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, found := object[key]; !found {
+					return fmt.Errorf("%s: missing required property %q", path, key)
+				}
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := path + "." + key
+		if property, ok := properties[key]; ok {
+			if err := s.validate(property, object[key], child, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if additional, ok := schema["additionalProperties"]; ok {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				return fmt.Errorf("%s: unexpected property %q", path, key)
+			}
+			if err := s.validate(additional, object[key], child, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if limit, ok := number(schema["minProperties"]); ok && float64(len(object)) < limit {
+		return fmt.Errorf("%s: must have at least %v properties", path, limit)
+	}
+	if limit, ok := number(schema["maxProperties"]); ok && float64(len(object)) > limit {
+		return fmt.Errorf("%s: must have at most %v properties", path, limit)
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(schema map[string]interface{}, array []interface{}, path string, depth int) error {
+	if limit, ok := number(schema["minItems"]); ok && float64(len(array)) < limit {
+		return fmt.Errorf("%s: must have at least %v items", path, limit)
+	}
+	if limit, ok := number(schema["maxItems"]); ok && float64(len(array)) > limit {
+		return fmt.Errorf("%s: must have at most %v items", path, limit)
+	}
+	prefix, _ := schema["prefixItems"].([]interface{})
+	for i, item := range array {
+		child := path + "[" + strconv.Itoa(i) + "]"
+		if i < len(prefix) {
+			if err := s.validate(prefix[i], item, child, depth+1); err != nil {
+				return err
+			}
+		} else if items, ok := schema["items"]; ok {
+			if err := s.validate(items, item, child, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if reflect.DeepEqual(array[i], array[j]) {
+					return fmt.Errorf("%s: items %d and %d are equal", path, i, j)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func number(value interface{}) (float64, bool) {
+	v, ok := value.(float64)
+	return v, ok
+}
+
+func matchesType(types interface{}, value interface{}) bool {
+	switch v := types.(type) {
+	case string:
+		return matchesName(v, value)
+	case []interface{}:
+		for _, name := range v {
+			if name, ok := name.(string); ok && matchesName(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesName(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		v, ok := value.(float64)
+		return ok && v == math.Trunc(v)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	}
+	return typeOf(value) == name
+}
+
+func typeNames(types interface{}) string {
+	if list, ok := types.([]interface{}); ok {
+		var names []string
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
@@ -0,0 +1,103 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, text string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", text, err)
+	}
+	return value
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{"object", `{"type":"object"}`, ""},
+		{"true", `true`, ""},
+		{"array", `[]`, "schema must be an object"},
+		{"invalid pattern", `{"type":"string","pattern":"("}`, `#: invalid pattern "("`},
+		{"invalid property pattern", `{"properties":{"title":{"pattern":"["}}}`, `#/properties/title: invalid pattern "["`},
+		{"invalid definition pattern", `{"$defs":{"default":{"pattern":"["}}}`, `#/$defs/default: invalid pattern "["`},
+		{"local ref", `{"$defs":{"item":{"type":"string"}},"items":{"$ref":"#/$defs/item"}}`, ""},
+		{"unresolvable ref", `{"items":{"$ref":"#/$defs/item"}}`, `unresolvable reference`},
+		{"remote ref", `{"$ref":"https://example.com/schema.json"}`, `unsupported reference`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile(decode(t, test.schema))
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		err    string
+	}{
+		{"type", `{"type":"string"}`, `"a"`, ""},
+		{"wrong type", `{"type":"string"}`, `1`, "$: expected string, got number"},
+		{"type list", `{"type":["string","null"]}`, `null`, ""},
+		{"integer", `{"type":"integer"}`, `1.5`, "expected integer"},
+		{"enum", `{"enum":["a","b"]}`, `"c"`, `must be one of ["a","b"]`},
+		{"const", `{"const":3}`, `3`, ""},
+		{"required", `{"type":"object","required":["name"]}`, `{}`, `missing required property "name"`},
+		{"property", `{"properties":{"age":{"type":"integer"}}}`, `{"age":"3"}`, "$.age: expected integer"},
+		{"additional properties", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, `unexpected property "b"`},
+		{"items", `{"items":{"type":"number"}}`, `[1,"2"]`, "$[1]: expected number"},
+		{"min items", `{"minItems":2}`, `[1]`, "at least 2 items"},
+		{"unique items", `{"uniqueItems":true}`, `[1,2,1]`, "items 0 and 2 are equal"},
+		{"max length", `{"maxLength":3}`, `"abcd"`, "at most 3 characters"},
+		{"pattern", `{"pattern":"^[a-z]+$"}`, `"abc"`, ""},
+		{"pattern mismatch", `{"pattern":"^[a-z]+$"}`, `"ABC"`, "must match the pattern"},
+		{"property named title", `{"type":"object","properties":{"title":{"type":"string","pattern":"^[A-Z]"}}}`, `{"title":"Hello"}`, ""},
+		{"property named title mismatch", `{"type":"object","properties":{"title":{"type":"string","pattern":"^[A-Z]"}}}`, `{"title":"hello"}`, "$.title: must match the pattern"},
+		{"property named default", `{"properties":{"default":{"pattern":"^x"}}}`, `{"default":"y"}`, "$.default: must match the pattern"},
+		{"definition named description", `{"$defs":{"description":{"pattern":"^x"}},"$ref":"#/$defs/description"}`, `"y"`, "must match the pattern"},
+		{"pattern outside a schema", `{"default":{"pattern":"^x"},"$ref":"#/default"}`, `"x"`, "was not compiled"},
+		{"minimum", `{"minimum":1}`, `0`, "at least 1"},
+		{"exclusive maximum", `{"exclusiveMaximum":1}`, `1`, "less than 1"},
+		{"multiple of", `{"multipleOf":0.5}`, `1.5`, ""},
+		{"any of", `{"anyOf":[{"type":"string"},{"type":"number"}]}`, `true`, "matches none of anyOf"},
+		{"one of", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, "matches 2"},
+		{"not", `{"not":{"type":"null"}}`, `null`, "must not match"},
+		{"false", `{"properties":{"a":false}}`, `{"a":1}`, "$.a: no value is allowed here"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema, err := Compile(decode(t, test.schema))
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			err = schema.Validate(decode(t, test.value))
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextKey holds the logger of a request in the gin context
+const contextKey = "logger"
+
+const redacted = "[REDACTED]"
+
+// secretKeys are attributes whose values are never logged
+var secretKeys = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"password":      true,
+	"puid":          true,
+	"secret":        true,
+	"cookie":        true,
+	"authorization": true,
+	"api_key":       true,
+}
+
+// secretPattern finds JWTs, bearer tokens and API keys inside messages
+var secretPattern = regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]+|(?i:bearer\s+)\S+|sk-[\w-]{8,}|_puid=[^;\s]+`)
+
+var level = new(slog.LevelVar)
+
+func init() {
+	Setup()
+}
+
+// Setup installs the default logger from LOG_LEVEL (debug, info, warn or error, default info) and
+// LOG_FORMAT (text or json, default text)
+func Setup() {
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level.Set(slog.LevelInfo)
+	}
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// redact hides secret attributes and secrets inside strings
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	if attr.Value.Kind() == slog.KindString {
+		attr.Value = slog.StringValue(Redact(attr.Value.String()))
+	} else if err, ok := attr.Value.Any().(error); ok {
+		attr.Value = slog.StringValue(Redact(err.Error()))
+	}
+	return attr
+}
+
+// Redact hides tokens, API keys and PUIDs in s
+func Redact(s string) string {
+	return secretPattern.ReplaceAllStringFunc(s, func(secret string) string {
+		if strings.HasPrefix(strings.ToLower(secret), "bearer") {
+			return secret[:strings.IndexAny(secret, " \t")+1] + redacted
+		}
+		if strings.HasPrefix(secret, "_puid=") {
+			return "_puid=" + redacted
+		}
+		return redacted
+	})
+}
+
+// From returns the logger of a request, carrying its request ID, or the default logger
+func From(c *gin.Context) *slog.Logger {
+	if c != nil {
+		if value, ok := c.Get(contextKey); ok {
+			return value.(*slog.Logger)
+		}
+	}
+	return slog.Default()
+}
+
+// Set replaces the logger of a request
+func Set(c *gin.Context, log *slog.Logger) {
+	c.Set(contextKey, log)
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "chatgpt_to_api"
+
+// maxModels bounds the model label, clients choose the model name
+const maxModels = 100
+
+var durationBuckets = prometheus.ExponentialBuckets(0.01, 2.5, 12)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests served by route, model and status.",
+	}, []string{"route", "model", "status"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time to serve a request by route, model and status.",
+		Buckets:   durationBuckets,
+	}, []string{"route", "model", "status"})
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Time spent on each step of an upstream conversation: chat_requirements, proof_of_work, conversation_first_byte and conversation_stream.",
+		Buckets:   durationBuckets,
+	}, []string{"step"})
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Access token logins and renewals by result.",
+	}, []string{"result"})
+	fileCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "file_cache_lookups_total",
+		Help:      "Lookups of uploaded files in the file cache by result.",
+	}, []string{"result"})
+
+	models_lock sync.Mutex
+	models      = map[string]bool{}
+)
+
+// modelLabel returns the model, or "other" once maxModels distinct models have been seen
+func modelLabel(model string) string {
+	models_lock.Lock()
+	defer models_lock.Unlock()
+	if models[model] {
+		return model
+	}
+	if len(models) >= maxModels {
+		return "other"
+	}
+	models[model] = true
+	return model
+}
+
+// ObserveRequest counts a served request
+func ObserveRequest(route string, model string, status string, duration time.Duration) {
+	model = modelLabel(model)
+	requests.WithLabelValues(route, model, status).Inc()
+	requestDuration.WithLabelValues(route, model, status).Observe(duration.Seconds())
+}
+
+// ObserveUpstream records the time an upstream step took since start
+func ObserveUpstream(step string, start time.Time) {
+	upstreamDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+}
+
+// TokenRefresh counts a login or renewal of an access token
+func TokenRefresh(ok bool) {
+	if ok {
+		tokenRefreshes.WithLabelValues("success").Inc()
+	} else {
+		tokenRefreshes.WithLabelValues("failure").Inc()
+	}
+}
+
+// FileCache counts a lookup of an uploaded file
+func FileCache(hit bool) {
+	if hit {
+		fileCache.WithLabelValues("hit").Inc()
+	} else {
+		fileCache.WithLabelValues("miss").Inc()
+	}
+}
+
+// Gauge exports the value of read at every scrape
+func Gauge(name string, help string, read func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{Namespace: namespace, Name: name, Help: help}, read)
+}
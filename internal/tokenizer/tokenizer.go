@@ -0,0 +1,68 @@
+package tokenizer
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+var (
+	encodings = map[string]*tiktoken.Tiktoken{}
+	lock      sync.Mutex
+	// model prefixes using o200k_base, everything else uses cl100k_base
+	o200kPrefixes = []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"}
+)
+
+func init() {
+	// Use the embedded BPE ranks instead of downloading them on first use
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// EncodingName returns the encoding used to count tokens of model
+func EncodingName(model string) string {
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+func getEncoding(model string) *tiktoken.Tiktoken {
+	name := EncodingName(model)
+	lock.Lock()
+	defer lock.Unlock()
+	if encoding, ok := encodings[name]; ok {
+		return encoding
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil
+	}
+	encodings[name] = encoding
+	return encoding
+}
+
+// Count returns the number of tokens of text for model
+func Count(model string, text string) int {
+	if text == "" {
+		return 0
+	}
+	encoding := getEncoding(model)
+	if encoding == nil {
+		// Fall back to about four characters per token
+		return (utf8.RuneCountInString(text) + 3) / 4
+	}
+	return len(encoding.Encode(text, nil, nil))
+}
+
+// CountMessage returns the tokens of one chat message, including the per message overhead
+func CountMessage(model string, role string, text string) int {
+	return 3 + Count(model, role) + Count(model, text)
+}
+
+// ReplyPriming is the number of tokens every reply is primed with
+const ReplyPriming = 3
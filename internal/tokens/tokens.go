@@ -1,60 +1,86 @@
-package tokens
-
-import (
-	"encoding/json"
-	"os"
-	"sync"
-)
-
-type Secret struct {
-	Token      string `json:"token"`
-	PUID       string `json:"puid"`
-	TeamUserID string `json:"team_uid,omitempty"`
-}
-type AccessToken struct {
-	tokens map[string]Secret
-	lock   sync.Mutex
-}
-
-func NewAccessToken(tokens map[string]Secret) AccessToken {
-	return AccessToken{
-		tokens: tokens,
-	}
-}
-
-func (a *AccessToken) Set(name string, token string, puid string, tuid string) {
-	a.tokens[name] = Secret{Token: token, PUID: puid, TeamUserID: tuid}
-}
-
-func (a *AccessToken) GetKeys() []string {
-	keys := []string{}
-	for k := range a.tokens {
-		keys = append(keys, k)
-	}
-	return keys
-}
-
-func (a *AccessToken) Delete(name string) {
-	delete(a.tokens, name)
-}
-
-func (a *AccessToken) Save() bool {
-	file, err := os.OpenFile("access_tokens.json", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return false
-	}
-	defer file.Close()
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(a.tokens)
-	return err == nil
-}
-
-func (a *AccessToken) GetSecret(account string) Secret {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-
-	if len(a.tokens) == 0 {
-		return Secret{}
-	}
-	return a.tokens[account]
-}
+package tokens
+
+import (
+	"encoding/json"
+	"freechatgpt/internal/fileutil"
+	"sync"
+)
+
+type Secret struct {
+	Token      string `json:"token"`
+	PUID       string `json:"puid"`
+	TeamUserID string `json:"team_uid,omitempty"`
+}
+type AccessToken struct {
+	tokens map[string]Secret
+	lock   sync.Mutex
+}
+
+func NewAccessToken(tokens map[string]Secret) AccessToken {
+	return AccessToken{
+		tokens: tokens,
+	}
+}
+
+// Replace swaps all tokens at once
+func (a *AccessToken) Replace(tokens map[string]Secret) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.tokens = tokens
+}
+
+func (a *AccessToken) Set(name string, token string, puid string, tuid string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.tokens == nil {
+		a.tokens = map[string]Secret{}
+	}
+	a.tokens[name] = Secret{Token: token, PUID: puid, TeamUserID: tuid}
+}
+
+func (a *AccessToken) GetKeys() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	keys := []string{}
+	for k := range a.tokens {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (a *AccessToken) Delete(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.tokens, name)
+}
+
+func (a *AccessToken) Save() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	data, err := json.Marshal(a.tokens)
+	if err != nil {
+		return false
+	}
+	return fileutil.WriteAtomic("access_tokens.json", append(data, '\n'), 0644) == nil
+}
+
+// GetAll returns a copy of all tokens
+func (a *AccessToken) GetAll() map[string]Secret {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	all := make(map[string]Secret, len(a.tokens))
+	for k, v := range a.tokens {
+		all[k] = v
+	}
+	return all
+}
+
+func (a *AccessToken) GetSecret(account string) Secret {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.tokens) == 0 {
+		return Secret{}
+	}
+	return a.tokens[account]
+}
@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("freechatgpt")
+
+type tagsKey struct{}
+
+// Setup installs the exporter chosen by OTEL_TRACES_EXPORTER. otlp sends spans over OTLP/HTTP to
+// OTEL_EXPORTER_OTLP_ENDPOINT (http://localhost:4318 by default), stdout prints them. Unset or
+// none disables tracing. Inbound W3C trace context is honored either way. The returned function
+// flushes the pending spans.
+func Setup() (func(), error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "", "none":
+		return func() {}, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout", "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return func() {}, errors.New("unknown OTEL_TRACES_EXPORTER " + os.Getenv("OTEL_TRACES_EXPORTER"))
+	}
+	if err != nil {
+		return func() {}, err
+	}
+	service, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName())))
+	if err != nil {
+		service = resource.Default()
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(service))
+	otel.SetTracerProvider(provider)
+	return func() {
+		provider.Shutdown(context.Background())
+	}, nil
+}
+
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "chatgpt-to-api"
+}
+
+// Extract returns ctx with the trace context of inbound headers
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Tag returns ctx with attributes added to every span started from it, such as the account and
+// proxy of an attempt
+func Tag(ctx context.Context, attrs ...attribute.KeyValue) context.Context {
+	tags, _ := ctx.Value(tagsKey{}).([]attribute.KeyValue)
+	return context.WithValue(ctx, tagsKey{}, append(append([]attribute.KeyValue{}, tags...), attrs...))
+}
+
+// Start starts a span carrying the tags of ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tags, _ := ctx.Value(tagsKey{}).([]attribute.KeyValue)
+	return tracer.Start(ctx, name, trace.WithAttributes(append(append([]attribute.KeyValue{}, tags...), attrs...)...))
+}
+
+// StartServer starts the span of an inbound request
+func StartServer(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it failed if err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,213 @@
+package usage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var recordsBucket = []byte("records")
+
+// Record is one finished API request
+type Record struct {
+	Time             time.Time `json:"time"`
+	Endpoint         string    `json:"endpoint"`
+	Key              string    `json:"key,omitempty"`
+	Account          string    `json:"account,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Status           int       `json:"status"`
+	Attempts         int       `json:"attempts"`
+}
+
+// Aggregate sums the records of one group, the fields not grouped by are empty
+type Aggregate struct {
+	Day              string  `json:"day,omitempty"`
+	Key              string  `json:"key,omitempty"`
+	Account          string  `json:"account,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Endpoint         string  `json:"endpoint,omitempty"`
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Attempts         int     `json:"attempts"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+	latency          int64
+}
+
+var GroupFields = []string{"day", "key", "account", "model", "endpoint"}
+
+var (
+	db      *bolt.DB
+	records chan Record
+	done    sync.WaitGroup
+)
+
+// Open opens the store and starts writing records in the background
+func Open(path string) error {
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(recordsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		db = nil
+		return err
+	}
+	records = make(chan Record, 1024)
+	done.Add(1)
+	go write()
+	return nil
+}
+
+// Close writes the pending records and closes the store, records added later are dropped
+func Close() {
+	if db == nil {
+		return
+	}
+	close(records)
+	done.Wait()
+	db.Close()
+	db = nil
+}
+
+// Add queues a record, it is dropped if the store is closed or can not keep up
+func Add(record Record) {
+	if db == nil {
+		return
+	}
+	select {
+	case records <- record:
+	default:
+		slog.Warn("Usage store is falling behind, dropping a record")
+	}
+}
+
+// write stores the queued records, everything queued at a time in one transaction
+func write() {
+	defer done.Done()
+	var sequence uint32
+	for record := range records {
+		batch := []Record{record}
+	drain:
+		for len(batch) < 256 {
+			select {
+			case record, ok := <-records:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, record)
+			default:
+				break drain
+			}
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(recordsBucket)
+			for _, record := range batch {
+				value, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+				sequence++
+				if err := bucket.Put(recordKey(record.Time, sequence), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("Failed to store usage", "error", err)
+		}
+	}
+}
+
+// recordKey orders records by time, the sequence keeps records of the same nanosecond apart
+func recordKey(t time.Time, sequence uint32) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(key[8:], sequence)
+	return key
+}
+
+// Query sums the records from from up to to by the given fields of GroupFields
+func Query(from time.Time, to time.Time, group_by []string) ([]*Aggregate, error) {
+	groups := map[string]*Aggregate{}
+	if db == nil {
+		return []*Aggregate{}, nil
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(recordsBucket).Cursor()
+		end := recordKey(to, 0)
+		for key, value := cursor.Seek(recordKey(from, 0)); key != nil && string(key) < string(end); key, value = cursor.Next() {
+			var record Record
+			if json.Unmarshal(value, &record) != nil {
+				continue
+			}
+			group := Aggregate{}
+			for _, field := range group_by {
+				switch field {
+				case "day":
+					group.Day = record.Time.UTC().Format("2006-01-02")
+				case "key":
+					group.Key = record.Key
+				case "account":
+					group.Account = record.Account
+				case "model":
+					group.Model = record.Model
+				case "endpoint":
+					group.Endpoint = record.Endpoint
+				}
+			}
+			id := strings.Join([]string{group.Day, group.Key, group.Account, group.Model, group.Endpoint}, "\x00")
+			aggregate := groups[id]
+			if aggregate == nil {
+				aggregate = &group
+				groups[id] = aggregate
+			}
+			aggregate.Requests++
+			if record.Status >= 400 {
+				aggregate.Errors++
+			}
+			aggregate.PromptTokens += record.PromptTokens
+			aggregate.CompletionTokens += record.CompletionTokens
+			aggregate.TotalTokens += record.PromptTokens + record.CompletionTokens
+			aggregate.Attempts += record.Attempts
+			aggregate.latency += record.LatencyMs
+		}
+		return nil
+	})
+	list := []*Aggregate{}
+	for _, aggregate := range groups {
+		aggregate.AvgLatencyMs = float64(aggregate.latency) / float64(aggregate.Requests)
+		list = append(list, aggregate)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.TotalTokens != b.TotalTokens {
+			return a.TotalTokens > b.TotalTokens
+		}
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Key+a.Account+a.Model+a.Endpoint < b.Key+b.Account+b.Model+b.Endpoint
+	})
+	return list, err
+}
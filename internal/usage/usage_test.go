@@ -0,0 +1,90 @@
+package usage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTemp opens a store in a temporary directory which is closed after the test
+func openTemp(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "usage.db")
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Close)
+	return path
+}
+
+func TestQuery(t *testing.T) {
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	path := openTemp(t)
+	for _, record := range []Record{
+		{Time: day, Endpoint: "chat", Key: "k1", Account: "a", Model: "gpt-4o", PromptTokens: 10, CompletionTokens: 5, LatencyMs: 100, Status: 200, Attempts: 1},
+		{Time: day, Endpoint: "chat", Key: "k1", Account: "b", Model: "gpt-4o", PromptTokens: 20, CompletionTokens: 10, LatencyMs: 300, Status: 200, Attempts: 2},
+		{Time: day.Add(time.Hour), Endpoint: "responses", Key: "k2", Account: "a", Model: "gpt-4o-mini", PromptTokens: 1, LatencyMs: 50, Status: 429, Attempts: 1},
+		{Time: day.Add(24 * time.Hour), Endpoint: "chat", Key: "k1", Account: "a", Model: "gpt-4o", PromptTokens: 3, CompletionTokens: 4, LatencyMs: 10, Status: 200, Attempts: 1},
+	} {
+		Add(record)
+	}
+	// Closing writes the queued records
+	Close()
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		from     time.Time
+		to       time.Time
+		group_by []string
+		want     []Aggregate
+	}{
+		{"by day", day.Add(-time.Hour), day.Add(48 * time.Hour), []string{"day"}, []Aggregate{
+			{Day: "2024-05-01", Requests: 3, Errors: 1, PromptTokens: 31, CompletionTokens: 15, TotalTokens: 46, Attempts: 4, AvgLatencyMs: 150},
+			{Day: "2024-05-02", Requests: 1, PromptTokens: 3, CompletionTokens: 4, TotalTokens: 7, Attempts: 1, AvgLatencyMs: 10},
+		}},
+		{"by key and model", day, day.Add(48 * time.Hour), []string{"key", "model"}, []Aggregate{
+			{Key: "k1", Model: "gpt-4o", Requests: 3, PromptTokens: 33, CompletionTokens: 19, TotalTokens: 52, Attempts: 4, AvgLatencyMs: 410.0 / 3},
+			{Key: "k2", Model: "gpt-4o-mini", Requests: 1, Errors: 1, PromptTokens: 1, TotalTokens: 1, Attempts: 1, AvgLatencyMs: 50},
+		}},
+		{"by account", day, day.Add(time.Hour), []string{"account"}, []Aggregate{
+			{Account: "b", Requests: 1, PromptTokens: 20, CompletionTokens: 10, TotalTokens: 30, Attempts: 2, AvgLatencyMs: 300},
+			{Account: "a", Requests: 1, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, Attempts: 1, AvgLatencyMs: 100},
+		}},
+		{"by endpoint", day, day.Add(48 * time.Hour), []string{"endpoint"}, []Aggregate{
+			{Endpoint: "chat", Requests: 3, PromptTokens: 33, CompletionTokens: 19, TotalTokens: 52, Attempts: 4, AvgLatencyMs: 410.0 / 3},
+			{Endpoint: "responses", Requests: 1, Errors: 1, PromptTokens: 1, TotalTokens: 1, Attempts: 1, AvgLatencyMs: 50},
+		}},
+		{"empty range", day.Add(-48 * time.Hour), day.Add(-24 * time.Hour), []string{"day"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list, err := Query(test.from, test.to, test.group_by)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != len(test.want) {
+				t.Fatalf("got %d groups, want %d", len(list), len(test.want))
+			}
+			for i, want := range test.want {
+				got := *list[i]
+				got.latency = 0
+				if got != want {
+					t.Errorf("group %d is %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	openTemp(t)
+	Close()
+	// Records of requests which finish during shutdown are dropped
+	Add(Record{Time: time.Now(), Endpoint: "chat"})
+	list, err := Query(time.Time{}, time.Now().Add(time.Hour), []string{"day"})
+	if err != nil || len(list) != 0 {
+		t.Errorf("got %v, %v from a closed store", list, err)
+	}
+}
@@ -1,53 +1,37 @@
 package main
 
 import (
-	"bufio"
+	"freechatgpt/internal/logging"
 	"freechatgpt/internal/tokens"
+	"freechatgpt/internal/tracing"
+	"freechatgpt/internal/usage"
+	"log/slog"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 
+	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
 	chatgpt_types "freechatgpt/internal/chatgpt"
 
 	"github.com/acheong08/endless"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var HOST string
 var PORT string
 var ACCESS_TOKENS tokens.AccessToken
-var proxies []string
+var STRICT_PARAMS bool
+var ENABLE_CONVERSATION_CACHE bool
+var MAX_ATTEMPTS int
 
-func checkProxy() {
-	// first check for proxies.txt
-	proxies = []string{}
-	if _, err := os.Stat("proxies.txt"); err == nil {
-		// Each line is a proxy, put in proxies array
-		file, _ := os.Open("proxies.txt")
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			// Split line by :
-			proxy := scanner.Text()
-			proxy_parts := strings.Split(proxy, ":")
-			if len(proxy_parts) > 1 {
-				proxies = append(proxies, proxy)
-			} else {
-				continue
-			}
-		}
-	}
-	// if no proxies, then check env http_proxy
-	if len(proxies) == 0 {
-		proxy := os.Getenv("http_proxy")
-		if proxy != "" {
-			proxies = append(proxies, proxy)
-		}
-	}
-}
-
-func init() {
+// setup reads the configuration and starts the stores and background jobs, it runs before the
+// server starts
+func setup() {
 	_ = godotenv.Load(".env")
+	logging.Setup()
+	setupAuth()
 
 	HOST = os.Getenv("SERVER_HOST")
 	PORT = os.Getenv("SERVER_PORT")
@@ -57,15 +41,77 @@ func init() {
 	if PORT == "" {
 		PORT = "8080"
 	}
-	checkProxy()
+	STRICT_PARAMS = os.Getenv("STRICT_PARAMS") == "true"
+	ENABLE_CONVERSATION_CACHE = os.Getenv("ENABLE_CONVERSATION_CACHE") == "true"
+	if ENABLE_CONVERSATION_CACHE {
+		ttl, err := time.ParseDuration(os.Getenv("CONVERSATION_CACHE_TTL"))
+		if err != nil || ttl <= 0 {
+			ttl = 24 * time.Hour
+		}
+		chatgpt_types.StartConversationCache(ttl)
+	}
+	responses_ttl, err := time.ParseDuration(os.Getenv("RESPONSES_TTL"))
+	if err != nil || responses_ttl <= 0 {
+		responses_ttl = 30 * 24 * time.Hour
+	}
+	responseStore.Start(responses_ttl)
+	files_dir := os.Getenv("FILES_DIR")
+	if files_dir == "" {
+		files_dir = "files"
+	}
+	fileStore.Start(files_dir)
+	chatgpt_types.Files = fileStore
+	if os.Getenv("BACKEND") == "mock" {
+		chatgpt_types.Upstream = chatgpt_types.NewMockBackend(os.Getenv("MOCK_FIXTURES"))
+	}
+	routes_path := os.Getenv("MODEL_ROUTES")
+	if routes_path == "" {
+		routes_path = "model_routes.json"
+	}
+	chatgpt_request_converter.WatchRoutes(routes_path)
+	MAX_ATTEMPTS, _ = strconv.Atoi(os.Getenv("MAX_ATTEMPTS"))
+	if MAX_ATTEMPTS < 1 {
+		MAX_ATTEMPTS = 3
+	}
+	if strategy := os.Getenv("ACCOUNT_STRATEGY"); strategy != "" {
+		accountPool.SetStrategy(strategy)
+	}
+	usage_db := os.Getenv("USAGE_DB")
+	if usage_db == "" {
+		usage_db = "usage.db"
+	}
+	if err := usage.Open(usage_db); err != nil {
+		slog.Error("Usage is not recorded, unable to open the usage store", "path", usage_db, "error", err)
+	}
+	proxyPool.SetSticky(os.Getenv("PROXY_STICKY") == "true")
+	proxyPool.WatchProxies(proxyCheckInterval())
 	readAccounts()
+	readBardCookies()
 	scheduleTokenPUID()
+	scheduleModels()
 }
+
 func main() {
+	setup()
 	defer chatgpt_types.SaveFileHash()
-	router := gin.Default()
+	defer chatgpt_types.SaveConversations()
+	defer responseStore.Save()
+	defer usage.Close()
+	shutdown, err := tracing.Setup()
+	if err != nil {
+		slog.Error("Tracing is disabled", "error", err)
+	}
+	defer shutdown()
+	endless.ListenAndServe(HOST+":"+PORT, newRouter())
+}
 
+// newRouter registers the middleware and the routes of the server
+func newRouter() *gin.Engine {
+	router := gin.New()
+
+	router.Use(requestID, traceRequest, accessLog, gin.Recovery())
 	router.Use(cors)
+	router.Use(instrument)
 
 	router.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -79,14 +125,53 @@ func main() {
 	/// Admin routes
 	admin_routes.PATCH("/password", passwordHandler)
 	admin_routes.PATCH("/tokens", tokensHandler)
+	admin_routes.GET("/tokens", listTokensHandler)
+	admin_routes.GET("/tokens/:account", getTokenHandler)
+	admin_routes.PUT("/tokens/:account", putTokenHandler)
+	admin_routes.DELETE("/tokens/:account", deleteTokenHandler)
+	admin_routes.GET("/accounts", listAccountsHandler)
+	admin_routes.POST("/accounts", createAccountHandler)
+	admin_routes.GET("/accounts/:email", getAccountHandler)
+	admin_routes.PUT("/accounts/:email", updateAccountHandler)
+	admin_routes.DELETE("/accounts/:email", deleteAccountHandler)
+	admin_routes.GET("/keys", listKeysHandler)
+	admin_routes.POST("/keys", createKeyHandler)
+	admin_routes.GET("/keys/:id", getKeyHandler)
+	admin_routes.PATCH("/keys/:id", updateKeyHandler)
+	admin_routes.DELETE("/keys/:id", deleteKeyHandler)
+	admin_routes.GET("/proxies", proxiesHandler)
+	admin_routes.POST("/proxies", createProxyHandler)
+	admin_routes.DELETE("/proxies/:id", deleteProxyHandler)
+	admin_routes.GET("/usage", usageHandler)
 	/// Public routes
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	router.OPTIONS("/v1/chat/completions", optionsHandler)
-	router.POST("/v1/chat/completions", Authorization, nightmare)
+	router.POST("/v1/chat/completions", meter("chat"), Authorization("chat"), nightmare)
+	router.OPTIONS("/v1/completions", optionsHandler)
+	router.POST("/v1/completions", meter("completions"), Authorization("completions"), completionsHandler)
+	router.OPTIONS("/v1/responses", optionsHandler)
+	router.POST("/v1/responses", meter("responses"), Authorization("responses"), responsesHandler)
+	router.OPTIONS("/v1/responses/:id", optionsHandler)
+	router.GET("/v1/responses/:id", Authorization("responses"), getResponseHandler)
+	router.DELETE("/v1/responses/:id", Authorization("responses"), deleteResponseHandler)
+	router.OPTIONS("/v1/files", optionsHandler)
+	router.POST("/v1/files", Authorization("files"), createFileHandler)
+	router.GET("/v1/files", Authorization("files"), listFilesHandler)
+	router.OPTIONS("/v1/files/:id", optionsHandler)
+	router.GET("/v1/files/:id", Authorization("files"), getFileHandler)
+	router.DELETE("/v1/files/:id", Authorization("files"), deleteFileHandler)
+	router.OPTIONS("/v1/files/:id/content", optionsHandler)
+	router.GET("/v1/files/:id/content", Authorization("files"), fileContentHandler)
+	router.OPTIONS("/v1/messages", optionsHandler)
+	router.POST("/v1/messages", anthropicDialect, meter("messages"), Authorization("messages"), messagesHandler)
 	router.OPTIONS("/v1/audio/speech", optionsHandler)
-	router.POST("/v1/audio/speech", Authorization, tts)
+	router.POST("/v1/audio/speech", meter("speech"), Authorization("speech"), tts)
 	router.OPTIONS("/v1/audio/transcriptions", optionsHandler)
-	router.POST("/v1/audio/transcriptions", Authorization, stt)
+	router.POST("/v1/audio/transcriptions", meter("transcriptions"), Authorization("transcriptions"), stt)
 	router.OPTIONS("/v1/models", optionsHandler)
-	router.GET("/v1/models", Authorization, simulateModel)
-	endless.ListenAndServe(HOST+":"+PORT, router)
+	router.GET("/v1/models", Authorization("models"), modelsHandler)
+	router.OPTIONS("/v1/models/:id", optionsHandler)
+	router.GET("/v1/models/:id", Authorization("models"), modelHandler)
+	return router
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
+	chatgpt_response_converter "freechatgpt/conversion/response/chatgpt"
+	"freechatgpt/typings/anthropic"
+	official_types "freechatgpt/typings/official"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// messageWriter streams a reply as Anthropic Messages API events. message_start is sent with the
+// first event, tool calls are held back and sent as tool_use blocks.
+type messageWriter struct {
+	c       *gin.Context
+	message *anthropic.Response
+	tools   bool
+	toolCallBuffer
+	// index is the index of the next content block, open tells whether a text block is open
+	index int
+	open  bool
+	// reason is the finish reason of the reply, calls whether tool calls were sent
+	reason string
+	calls  bool
+	// onFirstWrite may set response headers before the first event
+	onFirstWrite func()
+}
+
+func (w *messageWriter) send(event anthropic.StreamEvent) error {
+	if !w.c.Writer.Written() {
+		if w.onFirstWrite != nil {
+			w.onFirstWrite()
+		}
+		w.c.Header("Content-Type", "text/event-stream")
+		w.c.Writer.WriteString(anthropic.StreamEvent{Type: "message_start", Message: w.message}.String())
+	}
+	_, err := w.c.Writer.WriteString(event.String())
+	w.c.Writer.Flush()
+	return err
+}
+
+func (w *messageWriter) WriteDelta(text string) error {
+	if w.tools {
+		text = w.Add(text)
+	}
+	if text == "" {
+		return nil
+	}
+	return w.writeText(text)
+}
+
+func (w *messageWriter) writeText(text string) error {
+	index := w.index
+	if !w.open {
+		w.open = true
+		block := anthropic.TextBlock("")
+		if err := w.send(anthropic.StreamEvent{Type: "content_block_start", Index: &index, ContentBlock: &block}); err != nil {
+			return err
+		}
+	}
+	return w.send(anthropic.StreamEvent{Type: "content_block_delta", Index: &index, Delta: anthropic.TextDelta{Type: "text_delta", Text: text}})
+}
+
+func (w *messageWriter) closeBlock() error {
+	index := w.index
+	w.index++
+	w.open = false
+	return w.send(anthropic.StreamEvent{Type: "content_block_stop", Index: &index})
+}
+
+func (w *messageWriter) SetModel(slug string) {
+	w.message.Model = slug
+}
+
+// Written reports whether an event of the request reached the client
+func (w *messageWriter) Written() bool {
+	return w.c.Writer.Written()
+}
+
+func (w *messageWriter) Finish(reason string) error {
+	w.reason = reason
+	var calls []official_types.ToolCall
+	if w.tools {
+		_, calls = chatgpt_response_converter.ParseToolCalls(w.pending)
+		if len(calls) == 0 && w.pending != "" {
+			if err := w.writeText(w.pending); err != nil {
+				return err
+			}
+		}
+	}
+	if w.open {
+		if err := w.closeBlock(); err != nil {
+			return err
+		}
+	}
+	for _, call := range calls {
+		index := w.index
+		block := anthropic.ToolUseBlock(call)
+		input := string(block.Input)
+		block.Input = []byte("{}")
+		if err := w.send(anthropic.StreamEvent{Type: "content_block_start", Index: &index, ContentBlock: &block}); err != nil {
+			return err
+		}
+		if err := w.send(anthropic.StreamEvent{Type: "content_block_delta", Index: &index, Delta: anthropic.InputJSONDelta{Type: "input_json_delta", PartialJSON: input}}); err != nil {
+			return err
+		}
+		if err := w.closeBlock(); err != nil {
+			return err
+		}
+	}
+	w.calls = len(calls) != 0
+	return nil
+}
+
+// messageContent returns the content blocks of a reply which was not streamed
+func messageContent(text string, tools bool) []anthropic.ContentBlock {
+	var calls []official_types.ToolCall
+	if tools {
+		text, calls = chatgpt_response_converter.ParseToolCalls(text)
+	}
+	content := []anthropic.ContentBlock{}
+	if text != "" {
+		content = append(content, anthropic.TextBlock(text))
+	}
+	for _, call := range calls {
+		content = append(content, anthropic.ToolUseBlock(call))
+	}
+	return content
+}
+
+// messagesHandler serves the Anthropic Messages API on top of the chat completion pipeline
+func messagesHandler(c *gin.Context) {
+	var request anthropic.MessagesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	c.Set("usage_model", request.Model)
+	if err := checkKeyModel(c, request.Model); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if isBardModel(request.Model) {
+		abortWithError(c, official_types.InvalidRequestError("model", "The Messages API is not supported by "+request.Model))
+		return
+	}
+	original_request, api_err := request.ChatRequest()
+	if api_err != nil {
+		abortWithError(c, api_err)
+		return
+	}
+	if param, message := chatgpt_request_converter.CheckParams(original_request, STRICT_PARAMS, 1); param != "" {
+		abortWithError(c, official_types.InvalidRequestError(param, message))
+		return
+	}
+	use_tools := chatgpt_request_converter.ToolsEnabled(original_request)
+
+	route := chatgpt_request_converter.ResolveModel(request.Model)
+	model := request.Model
+	if route.Slug != "" {
+		model = route.Slug
+	}
+	message := anthropic.NewResponse(model)
+	var attempts int32
+	var streamer *messageWriter
+	var collected *collectWriter
+	var writer completionWriter
+	if request.Stream {
+		streamer = &messageWriter{c: c, message: message, tools: use_tools, onFirstWrite: func() {
+			c.Header(attemptsHeader, strconv.Itoa(int(atomic.LoadInt32(&attempts))))
+		}}
+		writer = streamer
+	} else {
+		collected = &collectWriter{}
+		writer = collected
+	}
+	limit := &limitWriter{completionWriter: writer, model: request.Model, stop: request.StopSequences, maxTokens: request.MaxTokens}
+	var resume_from resumer
+	if ENABLE_CONVERSATION_CACHE {
+		resume_from = resumeConversation
+	}
+	prompt_tokens, info, err := serveChoice(c, original_request, route, resume_from, limit, &attempts)
+	if resume_from != nil && err == nil {
+		saveConversation(original_request, info, limit.emitted.String(), use_tools)
+	}
+	c.Set("attempts", int(attempts))
+	if !c.Writer.Written() {
+		c.Header(attemptsHeader, strconv.Itoa(int(attempts)))
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	completion_tokens := limit.CompletionTokens()
+	chargeTokens(c, prompt_tokens, completion_tokens)
+	message.Usage = anthropic.Usage{InputTokens: prompt_tokens, OutputTokens: completion_tokens}
+	if !request.Stream {
+		if collected.model != "" {
+			message.Model = collected.model
+		}
+		message.Content = messageContent(limit.emitted.String(), use_tools)
+		tool_use := len(message.Content) != 0 && message.Content[len(message.Content)-1].Type == "tool_use"
+		message.SetStop(anthropic.StopReason(collected.reason, limit.stopSequence, tool_use), limit.stopSequence)
+		c.JSON(200, message)
+		return
+	}
+	message.SetStop(anthropic.StopReason(streamer.reason, limit.stopSequence, streamer.calls), limit.stopSequence)
+	streamer.send(anthropic.StreamEvent{Type: "message_delta", Delta: anthropic.MessageDelta{StopReason: message.StopReason, StopSequence: message.StopSequence}, Usage: &message.Usage})
+	streamer.send(anthropic.StreamEvent{Type: "message_stop"})
+}
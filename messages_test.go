@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/typings/anthropic"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// messageEvent is a streamed event of the Messages API with the delta left undecoded
+type messageEvent struct {
+	Type         string                  `json:"type"`
+	Message      *anthropic.Response     `json:"message"`
+	Index        *int                    `json:"index"`
+	ContentBlock *anthropic.ContentBlock `json:"content_block"`
+	Delta        struct {
+		Type         string  `json:"type"`
+		Text         string  `json:"text"`
+		PartialJSON  string  `json:"partial_json"`
+		StopReason   *string `json:"stop_reason"`
+		StopSequence *string `json:"stop_sequence"`
+	} `json:"delta"`
+	Usage *anthropic.Usage `json:"usage"`
+}
+
+// createMessage sends a request to the Messages API and returns the message, a stream is
+// assembled from its events
+func createMessage(t *testing.T, body string, stream bool) *anthropic.Response {
+	t.Helper()
+	if stream {
+		body = strings.Replace(body, "{", `{"stream":true,`, 1)
+	}
+	response := post(t, "/v1/messages", body)
+	if response.StatusCode != 200 {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	if !stream {
+		var message anthropic.Response
+		if err := json.NewDecoder(response.Body).Decode(&message); err != nil {
+			t.Fatal(err)
+		}
+		return &message
+	}
+	var message *anthropic.Response
+	var types []string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event messageEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		types = append(types, event.Type)
+		switch event.Type {
+		case "message_start":
+			message = event.Message
+		case "content_block_start":
+			// The input of a tool_use block starts as {} and is streamed in full as partial JSON
+			block := *event.ContentBlock
+			if block.Type == "tool_use" {
+				block.Input = nil
+			}
+			message.Content = append(message.Content, block)
+		case "content_block_delta":
+			block := &message.Content[*event.Index]
+			if event.Delta.Type == "text_delta" {
+				text := *block.Text + event.Delta.Text
+				block.Text = &text
+			} else {
+				block.Input = json.RawMessage(string(block.Input) + event.Delta.PartialJSON)
+			}
+		case "message_delta":
+			message.StopReason, message.StopSequence, message.Usage = event.Delta.StopReason, event.Delta.StopSequence, *event.Usage
+		}
+	}
+	if len(types) < 2 || types[0] != "message_start" || types[len(types)-1] != "message_stop" || types[len(types)-2] != "message_delta" {
+		t.Fatalf("events %v", types)
+	}
+	return message
+}
+
+func TestMessages(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		text         string
+		stopReason   string
+		stopSequence string
+	}{
+		{"text", `{"model":"gpt-4o-mini","max_tokens":100,"messages":[{"role":"user","content":"Hello"}]}`, recordedReply, "end_turn", ""},
+		{"system and blocks", `{"model":"gpt-4o-mini","max_tokens":100,"system":[{"type":"text","text":"Be brief."}],"messages":[{"role":"user","content":[{"type":"text","text":"Hello"}]}]}`, recordedReply, "end_turn", ""},
+		{"max_tokens", `{"model":"gpt-4o-mini","max_tokens":2,"messages":[{"role":"user","content":"Hello"}]}`, "Hello!", "max_tokens", ""},
+		{"stop sequence", `{"model":"gpt-4o-mini","max_tokens":100,"stop_sequences":["recorded"],"messages":[{"role":"user","content":"Hello"}]}`, "Hello! This is a ", "stop_sequence", "recorded"},
+	}
+	for _, test := range tests {
+		for _, stream := range []bool{false, true} {
+			name := test.name
+			if stream {
+				name += " stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				message := createMessage(t, test.body, stream)
+				if message.Type != "message" || message.Role != "assistant" || !strings.HasPrefix(message.ID, "msg_") {
+					t.Errorf("message %+v", message)
+				}
+				if len(message.Content) != 1 || message.Content[0].Type != "text" || *message.Content[0].Text != test.text {
+					t.Fatalf("content %+v, want %q", message.Content, test.text)
+				}
+				if message.StopReason == nil || *message.StopReason != test.stopReason {
+					t.Errorf("stop_reason %v, want %s", message.StopReason, test.stopReason)
+				}
+				if (message.StopSequence == nil) != (test.stopSequence == "") || message.StopSequence != nil && *message.StopSequence != test.stopSequence {
+					t.Errorf("stop_sequence %v, want %q", message.StopSequence, test.stopSequence)
+				}
+				if message.Usage.InputTokens == 0 || message.Usage.OutputTokens == 0 {
+					t.Errorf("usage %+v", message.Usage)
+				}
+			})
+		}
+	}
+}
+
+func TestMessagesToolUse(t *testing.T) {
+	replay(t, "testdata/tool_call")
+	body := `{"model":"gpt-4o-mini","max_tokens":100,"tools":[{"name":"get_weather","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}],"messages":[{"role":"user","content":"Weather in Paris?"}]}`
+	for _, stream := range []bool{false, true} {
+		message := createMessage(t, body, stream)
+		last := message.Content[len(message.Content)-1]
+		if last.Type != "tool_use" || last.Name != "get_weather" || string(last.Input) != `{"city":"Paris"}` || last.ID == "" {
+			t.Errorf("stream %v content %+v", stream, message.Content)
+		}
+		if message.StopReason == nil || *message.StopReason != "tool_use" {
+			t.Errorf("stream %v stop_reason %v", stream, message.StopReason)
+		}
+	}
+}
+
+func TestMessagesErrors(t *testing.T) {
+	chatgpt.SetPlanModels("a", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini"}})
+	t.Cleanup(func() { chatgpt.RetainPlanModels(map[string]bool{}) })
+	tests := []struct {
+		name   string
+		body   string
+		key    string
+		status int
+		// error is the type of the Anthropic error
+		error string
+	}{
+		{"missing max_tokens", `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello"}]}`, "", 400, "invalid_request_error"},
+		{"invalid JSON", `{"model":`, "", 400, "invalid_request_error"},
+		{"unsupported block", `{"model":"gpt-4o-mini","max_tokens":10,"messages":[{"role":"user","content":[{"type":"document"}]}]}`, "", 400, "invalid_request_error"},
+		{"unknown model", `{"model":"gpt-nonexistent","max_tokens":10,"messages":[{"role":"user","content":"Hello"}]}`, "", 404, "not_found_error"},
+		{"wrong x-api-key", `{"model":"gpt-4o-mini","max_tokens":10,"messages":[{"role":"user","content":"Hello"}]}`, "guess", 401, "authentication_error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.key != "" {
+				setKeys(t, map[string]*APIKey{"valid": {ID: "valid"}})
+			}
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(test.body))
+			request.Header.Set("x-api-key", test.key)
+			newRouter().ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d", recorder.Code, test.status)
+			}
+			var body anthropic.ErrorResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || body.Type != "error" || body.Error == nil {
+				t.Fatalf("body %q is not an Anthropic error: %v", recorder.Body.String(), err)
+			}
+			if body.Error.Type != test.error || body.Error.Message == "" {
+				t.Errorf("error %+v, want %s", body.Error, test.error)
+			}
+		})
+	}
+}
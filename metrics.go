@@ -0,0 +1,45 @@
+package main
+
+import (
+	"freechatgpt/internal/metrics"
+	official_types "freechatgpt/typings/official"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	metrics.Gauge("accounts_healthy", "Accounts with a unit outside its cooldown.", func() float64 {
+		healthy, _ := accountPool.Healthy()
+		return float64(healthy)
+	})
+	metrics.Gauge("accounts", "Accounts with an access token.", func() float64 {
+		_, all := accountPool.Healthy()
+		return float64(all)
+	})
+	metrics.Gauge("proxies_healthy", "Proxies passing their probes.", func() float64 {
+		healthy, _ := proxyPool.Healthy()
+		return float64(healthy)
+	})
+	metrics.Gauge("proxies", "Proxies in proxies.txt.", func() float64 {
+		_, all := proxyPool.Healthy()
+		return float64(all)
+	})
+}
+
+// instrument counts every request by route, model and status for /metrics
+func instrument(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := c.Writer.Status()
+	// Errors in a stream leave the status at 200
+	if value, ok := c.Get("error"); ok {
+		status = value.(*official_types.APIError).Status
+	}
+	metrics.ObserveRequest(route, c.GetString("usage_model"), strconv.Itoa(status), time.Since(start))
+}
@@ -1,28 +1,37 @@
 package main
 
 import (
-	"bufio"
+	"freechatgpt/internal/logging"
+	"freechatgpt/internal/tracing"
+	official_types "freechatgpt/typings/official"
+	"log/slog"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	gin "github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var ADMIN_PASSWORD string
-var API_KEYS map[string]bool
 
-func init() {
+// setupAuth reads the admin password and loads the API keys
+func setupAuth() {
 	ADMIN_PASSWORD = os.Getenv("ADMIN_PASSWORD")
 	if ADMIN_PASSWORD == "" {
 		ADMIN_PASSWORD = "TotallySecurePassword"
 	}
+	keyStore.Load()
 }
 
 func adminCheck(c *gin.Context) {
 	password := c.Request.Header.Get("Authorization")
 	if password != ADMIN_PASSWORD {
-		c.String(401, "Unauthorized")
-		c.Abort()
+		abortWithError(c, official_types.AuthenticationError("Invalid admin password."))
 		return
 	}
 	c.Next()
@@ -32,36 +41,114 @@ func cors(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Header("Access-Control-Allow-Methods", "*")
 	c.Header("Access-Control-Allow-Headers", "*")
+	c.Header("Access-Control-Expose-Headers", "*")
 	c.Next()
 }
 
-func Authorization(c *gin.Context) {
-	if API_KEYS == nil {
-		API_KEYS = make(map[string]bool)
-		if _, err := os.Stat("api_keys.txt"); err == nil {
-			file, _ := os.Open("api_keys.txt")
-			defer file.Close()
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				key := scanner.Text()
-				if key != "" {
-					API_KEYS["Bearer "+key] = true
-				}
+// requestIDPattern accepts client request IDs that are safe to log and echo
+var requestIDPattern = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+// requestID takes the X-Request-ID of a request or generates one, returns it and attaches it to
+// the logger of the request
+func requestID(c *gin.Context) {
+	id := c.Request.Header.Get("X-Request-ID")
+	if !requestIDPattern.MatchString(id) {
+		id = uuid.NewString()
+	}
+	c.Header("X-Request-ID", id)
+	logging.Set(c, slog.With("request_id", id))
+	c.Next()
+}
+
+// traceRequest starts the span of a request, continuing the W3C trace context of the caller
+func traceRequest(c *gin.Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	ctx := tracing.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracing.StartServer(ctx, c.Request.Method+" "+route,
+		semconv.HTTPRequestMethodKey.String(c.Request.Method),
+		semconv.HTTPRoute(route),
+		semconv.URLPath(c.Request.URL.Path),
+		attribute.String("request_id", c.Writer.Header().Get("X-Request-ID")),
+	)
+	c.Request = c.Request.WithContext(ctx)
+	if span.SpanContext().IsValid() {
+		logging.Set(c, logging.From(c).With("trace_id", span.SpanContext().TraceID().String()))
+	}
+	c.Next()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(c.Writer.Status()))
+	var err error
+	if value, ok := c.Get("error"); ok {
+		err = value.(*official_types.APIError)
+	}
+	tracing.End(span, err)
+}
+
+// accessLog logs every request once it is served
+func accessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	status := c.Writer.Status()
+	attrs := []any{"method", c.Request.Method, "path", c.Request.URL.Path, "status", status, "duration", time.Since(start), "client_ip", c.ClientIP()}
+	if value, ok := c.Get("error"); ok {
+		api_err := value.(*official_types.APIError)
+		status = api_err.Status
+		attrs = append(attrs, "error", api_err.Message)
+	}
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelWarn
+	}
+	logging.From(c).Log(c, level, "Request served", attrs...)
+}
+
+// Authorization checks the API key of a request to endpoint, its expiry and its rate limits.
+// Without keys in api_keys.json the API is open.
+func Authorization(endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if keyStore.Empty() {
+			c.Next()
+			return
+		}
+		authorization := c.Request.Header.Get("Authorization")
+		// Anthropic clients send the key as x-api-key
+		if key := c.Request.Header.Get("x-api-key"); authorization == "" && key != "" {
+			authorization = "Bearer " + key
+		}
+		api_key := keyStore.Lookup(strings.TrimPrefix(authorization, "Bearer "))
+		if api_key == nil || !strings.HasPrefix(authorization, "Bearer ") {
+			if authorization == "" {
+				abortWithError(c, official_types.AuthenticationError("No API key provided. Please provide an API key as part of the Authorization header."))
+			} else if strings.HasPrefix(authorization, "Bearer sk-") {
+				abortWithError(c, official_types.AuthenticationError("You tried to use the official API key which is not supported."))
+			} else {
+				abortWithError(c, official_types.AuthenticationError("Invalid API key."))
 			}
+			return
 		}
-	}
-	if len(API_KEYS) != 0 && !API_KEYS[c.Request.Header.Get("Authorization")] {
-		if c.Request.Header.Get("Authorization") == "" {
-			c.JSON(401, gin.H{"error": "No API key provided. Please provide an API key as part of the Authorization header."})
-		} else if strings.HasPrefix(c.Request.Header.Get("Authorization"), "Bearer sk-") {
-			c.JSON(401, gin.H{"error": "You tried to use the official API key which is not supported."})
-		} else if strings.HasPrefix(c.Request.Header.Get("Authorization"), "Bearer eyJhbGciOiJSUzI1NiI") {
+		if api_key.Disabled {
+			abortWithError(c, official_types.AuthenticationError("This API key is disabled."))
 			return
-		} else {
-			c.JSON(401, gin.H{"error": "Invalid API key."})
 		}
-		c.Abort()
-		return
+		if api_key.ExpiresAt != nil && time.Now().After(*api_key.ExpiresAt) {
+			abortWithError(c, official_types.AuthenticationError("This API key expired."))
+			return
+		}
+		if !api_key.AllowsEndpoint(endpoint) {
+			abortWithError(c, official_types.NewAPIError(403, "invalid_request_error", "insufficient_permissions", "This API key can not be used for "+endpoint+"."))
+			return
+		}
+		c.Set("api_key", api_key)
+		headers, err := keyStore.Take(api_key)
+		for name, value := range headers {
+			c.Header(name, value)
+		}
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Next()
 	}
-	c.Next()
 }
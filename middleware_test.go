@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminCheck(t *testing.T) {
+	ADMIN_PASSWORD = "secret"
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing", "", 401},
+		{"wrong", "guess", 401},
+		{"bearer", "Bearer secret", 401},
+		{"password", "secret", 200},
+	}
+	router := newRouter()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/admin/proxies", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d", recorder.Code, test.status)
+			}
+			if test.status == 200 {
+				return
+			}
+			var body struct {
+				Error official_types.APIError `json:"error"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not an error object: %v", recorder.Body.String(), err)
+			}
+			if body.Error.Type != "invalid_request_error" || body.Error.Message == "" {
+				t.Errorf("error %+v", body.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
+	chatgpt "freechatgpt/internal/chatgpt"
+	official_types "freechatgpt/typings/official"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const modelsInterval = time.Hour
+
+// modelCreated is the created time of every listed model, upstream does not tell
+const modelCreated = 1688888888
+
+// staticModels are listed until a model list was fetched from upstream
+var staticModels = []string{"gpt-3.5-turbo", "gpt-4", "gpt-4o", "gpt-4o-mini", "o1", "o1-mini"}
+
+// refreshModels fetches the models of every account, team accounts are queried once per plan
+func refreshModels() {
+	accounts := accountPool.Accounts()
+	if len(accounts) == 0 {
+		accounts = []string{""}
+	}
+	keep := map[string]bool{}
+	for _, account := range accounts {
+		keep[account] = true
+		proxy_url := proxyPool.Next(account)
+		secret := ACCESS_TOKENS.GetSecret(account)
+		deviceId := deviceID(account, proxy_url)
+		plans := map[string]string{"personal": ""}
+		if account == "" {
+			plans = map[string]string{"anonymous": ""}
+		} else if secret.TeamUserID != "" {
+			plans["team"] = secret.TeamUserID
+		}
+		for plan, team_uid := range plans {
+			plan_secret := secret
+			plan_secret.TeamUserID = team_uid
+			models, err := chatgpt.Upstream.GetModels(&plan_secret, deviceId, proxy_url)
+			if err != nil {
+				// Keep serving the previous list
+				slog.Warn("Failed to fetch models", "account", account, "plan", plan, "error", err)
+				continue
+			}
+			chatgpt.SetPlanModels(account, plan, models)
+		}
+	}
+	chatgpt.RetainPlanModels(keep)
+}
+
+func scheduleModels() {
+	go func() {
+		for {
+			refreshModels()
+			time.Sleep(modelsInterval)
+		}
+	}()
+}
+
+type modelEntry struct {
+	ID            string   `json:"id"`
+	Object        string   `json:"object"`
+	Created       int64    `json:"created"`
+	OwnedBy       string   `json:"owned_by"`
+	Title         string   `json:"title,omitempty"`
+	ContextLength int      `json:"context_length,omitempty"`
+	Images        bool     `json:"supports_images"`
+	Files         bool     `json:"supports_files"`
+	Plans         []string `json:"plans,omitempty"`
+	Accounts      int      `json:"accounts"`
+}
+
+// listModels returns the union of the models of all accounts
+func listModels() []*modelEntry {
+	plans := chatgpt.AllPlanModels()
+	entries := map[string]*modelEntry{}
+	accounts := map[string]map[string]bool{}
+	for _, plan := range plans {
+		for _, model := range plan.Models {
+			entry := entries[model.Slug]
+			if entry == nil {
+				entry = &modelEntry{ID: model.Slug, Object: "model", Created: modelCreated, OwnedBy: "chatgpt-to-api", Title: model.Title}
+				entries[model.Slug] = entry
+				accounts[model.Slug] = map[string]bool{}
+			}
+			if model.MaxTokens > entry.ContextLength {
+				entry.ContextLength = model.MaxTokens
+			}
+			entry.Images = entry.Images || model.SupportsImages()
+			entry.Files = entry.Files || model.SupportsFiles()
+			if !containsString(entry.Plans, plan.Plan) {
+				entry.Plans = append(entry.Plans, plan.Plan)
+			}
+			accounts[model.Slug][plan.Account] = true
+		}
+	}
+	var list []*modelEntry
+	for slug, entry := range entries {
+		entry.Accounts = len(accounts[slug])
+		sort.Strings(entry.Plans)
+		list = append(list, entry)
+	}
+	if len(list) == 0 {
+		for _, model := range staticModels {
+			list = append(list, &modelEntry{ID: model, Object: "model", Created: modelCreated, OwnedBy: "chatgpt-to-api"})
+		}
+	}
+	if len(bard_cookies) != 0 {
+		for _, model := range bardModels {
+			list = append(list, &modelEntry{ID: model, Object: "model", Created: modelCreated, OwnedBy: "google", Accounts: len(bard_cookies)})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+func containsString(slice []string, s string) bool {
+	for _, ele := range slice {
+		if ele == s {
+			return true
+		}
+	}
+	return false
+}
+
+func modelsHandler(c *gin.Context) {
+	list := []*modelEntry{}
+	for _, entry := range listModels() {
+		if checkKeyModel(c, entry.ID) == nil {
+			list = append(list, entry)
+		}
+	}
+	c.JSON(200, gin.H{
+		"object": "list",
+		"data":   list,
+	})
+}
+
+func modelHandler(c *gin.Context) {
+	id := c.Param("id")
+	if err := checkKeyModel(c, id); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	slug := chatgpt_request_converter.ModelSlug(id)
+	for _, entry := range listModels() {
+		if entry.ID == id || entry.ID == slug && !isBardModel(id) {
+			model := *entry
+			model.ID = id
+			c.JSON(200, model)
+			return
+		}
+	}
+	abortWithError(c, official_types.ModelNotFoundError(id))
+}
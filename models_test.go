@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	chatgpt "freechatgpt/internal/chatgpt"
+	official_types "freechatgpt/typings/official"
+	"testing"
+)
+
+func TestListModels(t *testing.T) {
+	chatgpt.SetPlanModels("a", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini", MaxTokens: 8191}, {Slug: "gpt-4o", MaxTokens: 8191}})
+	chatgpt.SetPlanModels("a", "team", []chatgpt.ModelInfo{{Slug: "gpt-4o", MaxTokens: 32767}})
+	chatgpt.SetPlanModels("b", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini", MaxTokens: 8191}})
+	t.Cleanup(func() { chatgpt.RetainPlanModels(map[string]bool{}) })
+	tests := []struct {
+		id       string
+		context  int
+		plans    []string
+		accounts int
+	}{
+		{"gpt-4o", 32767, []string{"personal", "team"}, 1},
+		{"gpt-4o-mini", 8191, []string{"personal"}, 2},
+	}
+	list := listModels()
+	if len(list) != len(tests) {
+		t.Fatalf("listed %d models, want %d", len(list), len(tests))
+	}
+	for i, test := range tests {
+		entry := list[i]
+		if entry.ID != test.id || entry.ContextLength != test.context || entry.Accounts != test.accounts || len(entry.Plans) != len(test.plans) {
+			t.Errorf("entry %+v, want %+v", entry, test)
+		}
+		// created must not change between restarts
+		if entry.Created != modelCreated {
+			t.Errorf("%s created %d", entry.ID, entry.Created)
+		}
+	}
+}
+
+func TestChatCompletionUnknownModel(t *testing.T) {
+	chatgpt.SetPlanModels("a", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini"}})
+	t.Cleanup(func() { chatgpt.RetainPlanModels(map[string]bool{}) })
+	tests := []struct {
+		model  string
+		status int
+	}{
+		{"gpt-4o-mini", 200},
+		{"gpt-nonexistent", 404},
+	}
+	for _, test := range tests {
+		t.Run(test.model, func(t *testing.T) {
+			response := post(t, "/v1/chat/completions", `{"model":"`+test.model+`","messages":[{"role":"user","content":"Hello"}]}`)
+			if response.StatusCode != test.status {
+				t.Fatalf("status %d, want %d", response.StatusCode, test.status)
+			}
+			if test.status == 200 {
+				return
+			}
+			var body struct {
+				Error official_types.APIError `json:"error"`
+			}
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != "model_not_found" {
+				t.Errorf("error %+v", body.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"freechatgpt/internal/fileutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+	"github.com/bogdanfinn/tls-client/profiles"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	proxiesFile      = "proxies.txt"
+	proxyProbeURL    = "https://chatgpt.com/cdn-cgi/trace"
+	proxyProbeFailed = 2
+)
+
+// proxyEntry is one upstream proxy, it is left out of rotation while its probes fail
+type proxyEntry struct {
+	URL       string        `json:"-"`
+	Healthy   bool          `json:"healthy"`
+	Failures  int           `json:"failures"`
+	Latency   time.Duration `json:"-"`
+	LastCheck time.Time     `json:"last_check"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// ProxyPool rotates the proxies of upstream requests. With sticky set an account keeps its proxy
+// as long as the proxy is healthy, so that login and conversations come from the same address.
+type ProxyPool struct {
+	lock     sync.Mutex
+	sticky   bool
+	entries  []*proxyEntry
+	next     int
+	assigned map[string]string
+}
+
+var proxyPool = NewProxyPool()
+
+func NewProxyPool() *ProxyPool {
+	return &ProxyPool{assigned: map[string]string{}}
+}
+
+func (p *ProxyPool) SetSticky(sticky bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sticky = sticky
+}
+
+func (p *ProxyPool) Sticky() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.sticky
+}
+
+// parseProxy accepts http, https, socks5 and socks5h URLs with optional credentials, as well as
+// host:port and host:port:user:password which are taken as http proxies
+func parseProxy(line string) (string, error) {
+	if !strings.Contains(line, "://") {
+		parts := strings.Split(line, ":")
+		switch len(parts) {
+		case 2:
+			line = "http://" + line
+		case 4:
+			line = "http://" + url.UserPassword(parts[2], parts[3]).String() + "@" + parts[0] + ":" + parts[1]
+		default:
+			return "", errors.New("expected host:port or a proxy URL")
+		}
+	}
+	proxy_url, err := url.Parse(line)
+	if err != nil {
+		return "", err
+	}
+	switch proxy_url.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return "", errors.New("unsupported scheme " + proxy_url.Scheme)
+	}
+	if proxy_url.Hostname() == "" || proxy_url.Port() == "" {
+		return "", errors.New("missing host or port")
+	}
+	return proxy_url.String(), nil
+}
+
+// readProxies reads proxies.txt, falling back to http_proxy
+func readProxies() []string {
+	list := readProxyFile()
+	if len(list) == 0 {
+		if proxy := os.Getenv("http_proxy"); proxy != "" {
+			list = append(list, proxy)
+		}
+	}
+	return list
+}
+
+// readProxyFile reads proxies.txt, one proxy per line
+func readProxyFile() []string {
+	var list []string
+	if file, err := os.Open(proxiesFile); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			proxy_url, err := parseProxy(line)
+			if err != nil {
+				slog.Warn("Skipping proxy", "proxy", redactProxy(line), "error", err)
+				continue
+			}
+			list = AppendIfNone(list, proxy_url)
+		}
+	}
+	return list
+}
+
+// saveProxyFile replaces proxies.txt and the proxies of the pool
+func saveProxyFile(list []string) error {
+	content := strings.Join(list, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := fileutil.WriteAtomic(proxiesFile, []byte(content), 0600); err != nil {
+		return err
+	}
+	proxyPool.Load(readProxies())
+	go proxyPool.Probe()
+	return nil
+}
+
+// proxyID identifies a proxy in the admin API without its credentials
+func proxyID(proxy_url string) string {
+	hash := sha256.Sum256([]byte(proxy_url))
+	return hex.EncodeToString(hash[:6])
+}
+
+// Load replaces the proxies of the pool, proxies which stay keep their health
+func (p *ProxyPool) Load(list []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	old := map[string]*proxyEntry{}
+	for _, entry := range p.entries {
+		old[entry.URL] = entry
+	}
+	p.entries = nil
+	for _, proxy_url := range list {
+		entry := old[proxy_url]
+		if entry == nil {
+			entry = &proxyEntry{URL: proxy_url, Healthy: true}
+		}
+		p.entries = append(p.entries, entry)
+	}
+	p.next = 0
+	for account, proxy_url := range p.assigned {
+		if !containsString(list, proxy_url) {
+			delete(p.assigned, account)
+		}
+	}
+}
+
+// Next returns the proxy for a request of account, "" without proxies. Unhealthy proxies are
+// skipped unless all of them are, requests never fall back to a direct connection.
+func (p *ProxyPool) Next(account string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.entries) == 0 {
+		return ""
+	}
+	if p.sticky && account != "" {
+		if entry := p.find(p.assigned[account]); entry != nil && entry.Healthy {
+			return entry.URL
+		}
+	}
+	var entry *proxyEntry
+	for tries := 0; tries < len(p.entries); tries++ {
+		candidate := p.entries[(p.next+tries)%len(p.entries)]
+		if candidate.Healthy {
+			entry = candidate
+			p.next = (p.next + tries + 1) % len(p.entries)
+			break
+		}
+	}
+	if entry == nil {
+		entry = p.entries[p.next%len(p.entries)]
+		p.next = (p.next + 1) % len(p.entries)
+	}
+	if p.sticky && account != "" {
+		p.assigned[account] = entry.URL
+	}
+	return entry.URL
+}
+
+func (p *ProxyPool) find(proxy_url string) *proxyEntry {
+	for _, entry := range p.entries {
+		if entry.URL == proxy_url {
+			return entry
+		}
+	}
+	return nil
+}
+
+// MarkFailed takes a proxy which could not reach upstream out of rotation until a probe succeeds
+func (p *ProxyPool) MarkFailed(proxy_url string, reason string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if entry := p.find(proxy_url); entry != nil && entry.Healthy {
+		entry.Healthy = false
+		entry.LastError = reason
+		slog.Warn("Proxy removed from rotation", "proxy", redactProxy(proxy_url), "error", reason)
+	}
+}
+
+// Probe checks every proxy by fetching proxyProbeURL through it
+func (p *ProxyPool) Probe() {
+	p.lock.Lock()
+	list := make([]string, len(p.entries))
+	for i, entry := range p.entries {
+		list[i] = entry.URL
+	}
+	p.lock.Unlock()
+	var wg sync.WaitGroup
+	for _, proxy_url := range list {
+		wg.Add(1)
+		go func(proxy_url string) {
+			defer wg.Done()
+			start := time.Now()
+			err := probeProxy(proxy_url)
+			p.report(proxy_url, time.Since(start), err)
+		}(proxy_url)
+	}
+	wg.Wait()
+}
+
+func (p *ProxyPool) report(proxy_url string, latency time.Duration, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry := p.find(proxy_url)
+	if entry == nil {
+		return
+	}
+	entry.LastCheck = time.Now()
+	if err == nil {
+		if !entry.Healthy {
+			slog.Info("Proxy recovered", "proxy", redactProxy(proxy_url))
+		}
+		entry.Healthy = true
+		entry.Failures = 0
+		entry.Latency = latency
+		entry.LastError = ""
+		return
+	}
+	entry.Failures++
+	entry.LastError = err.Error()
+	// A proxy which never passed a probe is dropped at once, a working one after repeated failures
+	if entry.Healthy && (entry.Failures >= proxyProbeFailed || entry.Latency == 0) {
+		entry.Healthy = false
+		slog.Warn("Proxy removed from rotation", "proxy", redactProxy(proxy_url), "error", err)
+	}
+}
+
+func probeProxy(proxy_url string) error {
+	client, err := tls_client.NewHttpClient(tls_client.NewNoopLogger(), []tls_client.HttpClientOption{
+		tls_client.WithTimeoutSeconds(10),
+		tls_client.WithClientProfile(profiles.Okhttp4Android13),
+		tls_client.WithProxyUrl(proxy_url),
+	}...)
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+	response, err := client.Get(proxyProbeURL)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return errors.New("probe returned " + response.Status)
+	}
+	return nil
+}
+
+// redactProxy hides the password of a proxy URL for logs and the admin API
+func redactProxy(proxy_url string) string {
+	if parsed, err := url.Parse(proxy_url); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+	return proxy_url
+}
+
+// WatchProxies loads proxies.txt, reloads it when it changes and probes the proxies every interval
+func (p *ProxyPool) WatchProxies(interval time.Duration) {
+	var modified time.Time
+	reload := func() bool {
+		var mod_time time.Time
+		if stat, err := os.Stat(proxiesFile); err == nil {
+			mod_time = stat.ModTime()
+		}
+		if mod_time.Equal(modified) {
+			return false
+		}
+		modified = mod_time
+		p.Load(readProxies())
+		return true
+	}
+	reload()
+	go func() {
+		last_probe := time.Now()
+		p.Probe()
+		for {
+			time.Sleep(5 * time.Second)
+			if reload() || time.Since(last_probe) >= interval {
+				last_probe = time.Now()
+				p.Probe()
+			}
+		}
+	}()
+}
+
+type proxyStatus struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	*proxyEntry
+	LatencyMs int64    `json:"latency_ms"`
+	Accounts  []string `json:"accounts,omitempty"`
+}
+
+// Healthy returns the number of healthy proxies and of all proxies
+func (p *ProxyPool) Healthy() (int, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	healthy := 0
+	for _, entry := range p.entries {
+		if entry.Healthy {
+			healthy++
+		}
+	}
+	return healthy, len(p.entries)
+}
+
+// Status lists the proxies with their health and the accounts sticking to them
+func (p *ProxyPool) Status() []proxyStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	list := []proxyStatus{}
+	for _, entry := range p.entries {
+		copied := *entry
+		status := proxyStatus{ID: proxyID(entry.URL), URL: redactProxy(entry.URL), proxyEntry: &copied, LatencyMs: entry.Latency.Milliseconds()}
+		for account, proxy_url := range p.assigned {
+			if proxy_url == entry.URL {
+				status.Accounts = append(status.Accounts, account)
+			}
+		}
+		sort.Strings(status.Accounts)
+		list = append(list, status)
+	}
+	return list
+}
+
+func proxiesHandler(c *gin.Context) {
+	status := proxyPool.Status()
+	healthy := 0
+	for _, entry := range status {
+		if entry.Healthy {
+			healthy++
+		}
+	}
+	c.JSON(200, gin.H{
+		"sticky":  proxyPool.Sticky(),
+		"total":   len(status),
+		"healthy": healthy,
+		"proxies": status,
+	})
+}
+
+func proxyCheckInterval() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("PROXY_CHECK_INTERVAL"))
+	if err != nil || seconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
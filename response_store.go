@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/fileutil"
+	official_types "freechatgpt/typings/official"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const responsesFile = "responses.json"
+
+// storedResponse is a response kept for GET /v1/responses/:id and previous_response_id
+type storedResponse struct {
+	Response *official_types.Response `json:"response"`
+	// History holds the messages of the response and the ones before it followed by its output.
+	// Instructions are left out, they do not carry over to the next response.
+	History official_types.APIRequest `json:"history"`
+	// Conversation is the upstream conversation of the output, the next response continues it
+	Conversation *chatgpt.ConversationInfo `json:"conversation,omitempty"`
+	// Key is the ID of the API key which created the response, only that key can read it
+	Key      string `json:"key,omitempty"`
+	LastUsed int64  `json:"last_used"`
+}
+
+type ResponseStore struct {
+	lock      sync.Mutex
+	responses map[string]*storedResponse
+	dirty     bool
+}
+
+var responseStore = &ResponseStore{responses: map[string]*storedResponse{}}
+
+// Start loads responses.json and evicts responses unused for longer than ttl
+func (s *ResponseStore) Start(ttl time.Duration) {
+	data, err := os.ReadFile(responsesFile)
+	if err == nil {
+		s.lock.Lock()
+		if err := json.Unmarshal(data, &s.responses); err != nil {
+			slog.Error("Failed to load stored responses", "path", responsesFile, "error", err)
+		}
+		s.lock.Unlock()
+	}
+	go func() {
+		for {
+			s.collect(ttl)
+			s.Save()
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+func (s *ResponseStore) collect(ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, stored := range s.responses {
+		if time.Since(time.Unix(stored.LastUsed, 0)) > ttl {
+			delete(s.responses, id)
+			s.dirty = true
+		}
+	}
+}
+
+// Get returns a copy of the response id created with key
+func (s *ResponseStore) Get(id string, key string) *storedResponse {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.responses[id]
+	if stored == nil || stored.Key != key {
+		return nil
+	}
+	stored.LastUsed = time.Now().Unix()
+	copied := *stored
+	return &copied
+}
+
+func (s *ResponseStore) Set(stored *storedResponse) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored.LastUsed = time.Now().Unix()
+	s.responses[stored.Response.ID] = stored
+	s.dirty = true
+}
+
+// Delete removes the response id created with key, it returns false if there is none
+func (s *ResponseStore) Delete(id string, key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.responses[id]
+	if stored == nil || stored.Key != key {
+		return false
+	}
+	delete(s.responses, id)
+	s.dirty = true
+	return true
+}
+
+// Save writes the responses to responses.json if they changed
+func (s *ResponseStore) Save() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return
+	}
+	data, err := json.Marshal(s.responses)
+	if err == nil {
+		err = fileutil.WriteAtomic(responsesFile, data, 0600)
+	}
+	if err != nil {
+		slog.Error("Failed to save stored responses", "path", responsesFile, "error", err)
+		return
+	}
+	s.dirty = false
+}
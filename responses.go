@@ -0,0 +1,337 @@
+package main
+
+import (
+	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
+	chatgpt_response_converter "freechatgpt/conversion/response/chatgpt"
+	chatgpt "freechatgpt/internal/chatgpt"
+	official_types "freechatgpt/typings/official"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseWriter streams the output of a response as Responses API events. The response is
+// announced with the first event, tool calls are held back and sent as function_call items.
+type responseWriter struct {
+	c        *gin.Context
+	response *official_types.Response
+	tools    bool
+	toolCallBuffer
+	sequence int
+	// message is the output message while its text streams
+	message *official_types.ResponseItem
+	text    strings.Builder
+	reason  string
+	// onFirstWrite may set response headers before the first event
+	onFirstWrite func()
+}
+
+func (w *responseWriter) send(event official_types.ResponseEvent) error {
+	if !w.c.Writer.Written() {
+		if w.onFirstWrite != nil {
+			w.onFirstWrite()
+		}
+		w.c.Header("Content-Type", "text/event-stream")
+		created := official_types.ResponseEvent{Type: "response.created", Response: w.response}
+		w.c.Writer.WriteString(created.String())
+		w.sequence++
+		in_progress := official_types.ResponseEvent{Type: "response.in_progress", SequenceNumber: w.sequence, Response: w.response}
+		w.c.Writer.WriteString(in_progress.String())
+		w.sequence++
+	}
+	event.SequenceNumber = w.sequence
+	w.sequence++
+	_, err := w.c.Writer.WriteString(event.String())
+	w.c.Writer.Flush()
+	return err
+}
+
+func (w *responseWriter) WriteDelta(text string) error {
+	if w.tools {
+		text = w.Add(text)
+	}
+	if text == "" {
+		return nil
+	}
+	return w.writeText(text)
+}
+
+func (w *responseWriter) writeText(text string) error {
+	output_index, content_index := len(w.response.Output), 0
+	if w.message == nil {
+		item := official_types.NewMessageItem("", "in_progress")
+		w.message = &item
+		if err := w.send(official_types.ResponseEvent{Type: "response.output_item.added", OutputIndex: &output_index, Item: &item}); err != nil {
+			return err
+		}
+		part := item.Content[0]
+		if err := w.send(official_types.ResponseEvent{Type: "response.content_part.added", ItemID: item.ID, OutputIndex: &output_index, ContentIndex: &content_index, Part: &part}); err != nil {
+			return err
+		}
+	}
+	if text == "" {
+		return nil
+	}
+	w.text.WriteString(text)
+	return w.send(official_types.ResponseEvent{Type: "response.output_text.delta", ItemID: w.message.ID, OutputIndex: &output_index, ContentIndex: &content_index, Delta: &text})
+}
+
+func (w *responseWriter) SetModel(slug string) {
+	w.response.Model = slug
+}
+
+// Written reports whether an event of the request reached the client
+func (w *responseWriter) Written() bool {
+	return w.c.Writer.Written()
+}
+
+func (w *responseWriter) Finish(reason string) error {
+	w.reason = reason
+	var calls []official_types.ToolCall
+	if w.tools {
+		_, calls = chatgpt_response_converter.ParseToolCalls(w.pending)
+		if len(calls) == 0 && w.pending != "" {
+			if err := w.writeText(w.pending); err != nil {
+				return err
+			}
+		}
+	}
+	if w.message != nil || len(calls) == 0 {
+		if err := w.closeMessage(); err != nil {
+			return err
+		}
+	}
+	for _, call := range calls {
+		output_index := len(w.response.Output)
+		item := official_types.NewFunctionCallItem(call, "in_progress")
+		arguments := *item.Arguments
+		empty := ""
+		item.Arguments = &empty
+		if err := w.send(official_types.ResponseEvent{Type: "response.output_item.added", OutputIndex: &output_index, Item: &item}); err != nil {
+			return err
+		}
+		if err := w.send(official_types.ResponseEvent{Type: "response.function_call_arguments.delta", ItemID: item.ID, OutputIndex: &output_index, Delta: &arguments}); err != nil {
+			return err
+		}
+		if err := w.send(official_types.ResponseEvent{Type: "response.function_call_arguments.done", ItemID: item.ID, OutputIndex: &output_index, Arguments: &arguments}); err != nil {
+			return err
+		}
+		item.Arguments = &arguments
+		item.Status = "completed"
+		w.response.Output = append(w.response.Output, item)
+		if err := w.send(official_types.ResponseEvent{Type: "response.output_item.done", OutputIndex: &output_index, Item: &item}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeMessage ends the output message, an empty one is sent if no text was written
+func (w *responseWriter) closeMessage() error {
+	if w.message == nil {
+		if err := w.writeText(""); err != nil {
+			return err
+		}
+	}
+	output_index, content_index := len(w.response.Output), 0
+	text := w.text.String()
+	item := official_types.NewMessageItem(text, messageStatus(w.reason))
+	item.ID = w.message.ID
+	if err := w.send(official_types.ResponseEvent{Type: "response.output_text.done", ItemID: item.ID, OutputIndex: &output_index, ContentIndex: &content_index, Text: &text}); err != nil {
+		return err
+	}
+	part := item.Content[0]
+	if err := w.send(official_types.ResponseEvent{Type: "response.content_part.done", ItemID: item.ID, OutputIndex: &output_index, ContentIndex: &content_index, Part: &part}); err != nil {
+		return err
+	}
+	w.response.Output = append(w.response.Output, item)
+	w.message = nil
+	return w.send(official_types.ResponseEvent{Type: "response.output_item.done", OutputIndex: &output_index, Item: &item})
+}
+
+// messageStatus is the status of an output message ended for reason
+func messageStatus(reason string) string {
+	if reason == "length" {
+		return "incomplete"
+	}
+	return "completed"
+}
+
+// responseOutput returns the output items of a reply which was not streamed
+func responseOutput(text string, reason string, tools bool) []official_types.ResponseItem {
+	var calls []official_types.ToolCall
+	if tools {
+		text, calls = chatgpt_response_converter.ParseToolCalls(text)
+	}
+	output := []official_types.ResponseItem{}
+	if text != "" || len(calls) == 0 {
+		output = append(output, official_types.NewMessageItem(text, messageStatus(reason)))
+	}
+	for _, call := range calls {
+		output = append(output, official_types.NewFunctionCallItem(call, "completed"))
+	}
+	return output
+}
+
+// requestKeyID returns the ID of the key the request was authorized with, empty when the API is open
+func requestKeyID(c *gin.Context) string {
+	if api_key := requestKey(c); api_key != nil {
+		return api_key.ID
+	}
+	return ""
+}
+
+func responseNotFoundError(param string, code string, id string) *official_types.APIError {
+	api_err := official_types.NewAPIError(404, "invalid_request_error", code, "Response with id '"+id+"' not found.")
+	api_err.Param = param
+	return api_err
+}
+
+// responsesHandler serves the Responses API. A previous_response_id continues the upstream
+// conversation of the stored response, or resends its history if its account is gone.
+func responsesHandler(c *gin.Context) {
+	var request official_types.ResponsesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, invalidJSONError(err))
+		return
+	}
+	c.Set("usage_model", request.Model)
+	if err := checkKeyModel(c, request.Model); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if isBardModel(request.Model) {
+		abortWithError(c, official_types.InvalidRequestError("model", "The Responses API is not supported by "+request.Model))
+		return
+	}
+	turn, api_err := request.ChatRequest()
+	if api_err != nil {
+		abortWithError(c, api_err)
+		return
+	}
+	var previous *storedResponse
+	if request.PreviousResponseID != "" {
+		previous = responseStore.Get(request.PreviousResponseID, requestKeyID(c))
+		if previous == nil {
+			abortWithError(c, responseNotFoundError("previous_response_id", "previous_response_not_found", request.PreviousResponseID))
+			return
+		}
+	}
+	history := turn
+	if previous != nil {
+		history.PrependMessages(previous.History)
+	}
+	full_request := history
+	if request.Instructions != "" {
+		full_request.PrependSystemMessage(request.Instructions)
+		turn.PrependSystemMessage(request.Instructions)
+	}
+	if param, message := chatgpt_request_converter.CheckParams(full_request, STRICT_PARAMS, 1); param != "" {
+		if param == "max_tokens" {
+			param, message = "max_output_tokens", "max_output_tokens must be a positive integer"
+		}
+		abortWithError(c, official_types.InvalidRequestError(param, message))
+		return
+	}
+	if err := checkFiles(c, full_request); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	use_tools := chatgpt_request_converter.ToolsEnabled(full_request)
+
+	route := chatgpt_request_converter.ResolveModel(request.Model)
+	model := request.Model
+	if route.Slug != "" {
+		model = route.Slug
+	}
+	response := official_types.NewResponse(request, model)
+	var attempts int32
+	var writer completionWriter
+	var collected *collectWriter
+	if request.Stream {
+		writer = &responseWriter{c: c, response: response, tools: use_tools, onFirstWrite: func() {
+			c.Header(attemptsHeader, strconv.Itoa(int(atomic.LoadInt32(&attempts))))
+		}}
+	} else {
+		collected = &collectWriter{}
+		writer = collected
+	}
+	limit := &limitWriter{completionWriter: writer, model: request.Model, maxTokens: chatgpt_request_converter.MaxTokens(full_request)}
+	var resume_from resumer
+	if previous != nil && previous.Conversation != nil {
+		resume_from = func(original_request official_types.APIRequest) (*chatgpt.ConversationInfo, official_types.APIRequest) {
+			// The conversation can only be continued by the account owning it
+			if ACCESS_TOKENS.GetSecret(previous.Conversation.Account).Token == "" {
+				return nil, original_request
+			}
+			return previous.Conversation, turn
+		}
+	}
+	prompt_tokens, info, err := serveChoice(c, full_request, route, resume_from, limit, &attempts)
+	c.Set("attempts", int(attempts))
+	if !c.Writer.Written() {
+		c.Header(attemptsHeader, strconv.Itoa(int(attempts)))
+	}
+	if err != nil {
+		if !c.Writer.Written() {
+			abortWithError(c, err)
+			return
+		}
+		api_err := official_types.AsAPIError(err)
+		c.Set("error", api_err)
+		response.Fail(api_err)
+		writer.(*responseWriter).send(official_types.ResponseEvent{Type: "response.failed", Response: response})
+		c.Abort()
+		return
+	}
+	completion_tokens := limit.CompletionTokens()
+	chargeTokens(c, prompt_tokens, completion_tokens)
+	response.SetUsage(prompt_tokens, completion_tokens)
+	reply := limit.emitted.String()
+	if request.Stream {
+		response.Finish(writer.(*responseWriter).reason)
+	} else {
+		if collected.model != "" {
+			response.Model = collected.model
+		}
+		response.Output = responseOutput(reply, collected.reason, use_tools)
+		response.Finish(collected.reason)
+	}
+	if response.Store {
+		var tool_calls []official_types.ToolCall
+		if use_tools {
+			reply, tool_calls = chatgpt_response_converter.ParseToolCalls(reply)
+		}
+		history.Messages = history.Messages[:len(history.Messages):len(history.Messages)]
+		history.AddAssistantMessage(reply, tool_calls)
+		stored := &storedResponse{Response: response, History: history, Key: requestKeyID(c)}
+		if info != nil && info.Account != "" && info.ConversationID != "" {
+			stored.Conversation = info
+		}
+		responseStore.Set(stored)
+	}
+	if request.Stream {
+		writer.(*responseWriter).send(official_types.ResponseEvent{Type: "response." + response.Status, Response: response})
+	} else {
+		c.JSON(200, response)
+	}
+}
+
+func getResponseHandler(c *gin.Context) {
+	stored := responseStore.Get(c.Param("id"), requestKeyID(c))
+	if stored == nil {
+		abortWithError(c, responseNotFoundError("", "not_found", c.Param("id")))
+		return
+	}
+	c.JSON(200, stored.Response)
+}
+
+func deleteResponseHandler(c *gin.Context) {
+	if !responseStore.Delete(c.Param("id"), requestKeyID(c)) {
+		abortWithError(c, responseNotFoundError("", "not_found", c.Param("id")))
+		return
+	}
+	c.JSON(200, gin.H{"id": c.Param("id"), "object": "response", "deleted": true})
+}
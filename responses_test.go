@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// readEvents decodes the events of a streamed response
+func readEvents(t *testing.T, response *http.Response) []official_types.ResponseEvent {
+	t.Helper()
+	var events []official_types.ResponseEvent
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event official_types.ResponseEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// createResponse sends a request to the Responses API and returns the final response
+func createResponse(t *testing.T, body string, stream bool) *official_types.Response {
+	t.Helper()
+	if stream {
+		body = strings.Replace(body, "{", `{"stream":true,`, 1)
+	}
+	response := post(t, "/v1/responses", body)
+	if response.StatusCode != 200 {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	if !stream {
+		var result official_types.Response
+		if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return &result
+	}
+	events := readEvents(t, response)
+	if len(events) < 3 || events[0].Type != "response.created" || events[1].Type != "response.in_progress" {
+		t.Fatalf("stream starts with %+v", events)
+	}
+	var text strings.Builder
+	for i, event := range events {
+		if event.SequenceNumber != i {
+			t.Errorf("event %d %s has sequence number %d", i, event.Type, event.SequenceNumber)
+		}
+		if event.Type == "response.output_text.delta" {
+			text.WriteString(*event.Delta)
+		}
+	}
+	last := events[len(events)-1]
+	if last.Response == nil || last.Type != "response."+last.Response.Status {
+		t.Fatalf("stream ends with %+v", last)
+	}
+	// The deltas add up to the text of the final message
+	for _, item := range last.Response.Output {
+		if item.Type == "message" && item.Content[0].Text != text.String() {
+			t.Errorf("deltas %q, message %q", text.String(), item.Content[0].Text)
+		}
+	}
+	return last.Response
+}
+
+func TestResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status string
+		// output are the types of the output items
+		output []string
+		text   string
+	}{
+		{"text input", `{"model":"gpt-4o-mini","input":"Hello"}`, "completed", []string{"message"}, recordedReply},
+		{"message input", `{"model":"gpt-4o-mini","instructions":"Be brief.","input":[{"role":"user","content":[{"type":"input_text","text":"Hello"}]}]}`, "completed", []string{"message"}, recordedReply},
+		{"max_output_tokens", `{"model":"gpt-4o-mini","input":"Hello","max_output_tokens":2}`, "incomplete", []string{"message"}, "Hello!"},
+	}
+	for _, test := range tests {
+		for _, stream := range []bool{false, true} {
+			name := test.name
+			if stream {
+				name += " stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				response := createResponse(t, test.body, stream)
+				if response.Object != "response" || response.Status != test.status || response.Usage == nil || response.Usage.OutputTokens == 0 {
+					t.Errorf("response %+v", response)
+				}
+				if test.status == "incomplete" && (response.IncompleteDetails == nil || response.IncompleteDetails.Reason != "max_output_tokens") {
+					t.Errorf("incomplete details %+v", response.IncompleteDetails)
+				}
+				if len(response.Output) != len(test.output) {
+					t.Fatalf("output %+v, want %v", response.Output, test.output)
+				}
+				for i, item := range response.Output {
+					if item.Type != test.output[i] {
+						t.Errorf("output %d is %s, want %s", i, item.Type, test.output[i])
+					}
+				}
+				if text := response.Output[0].Content[0].Text; text != test.text {
+					t.Errorf("text %q, want %q", text, test.text)
+				}
+			})
+		}
+	}
+}
+
+func TestResponsesToolCalls(t *testing.T) {
+	replay(t, "testdata/tool_call")
+	body := `{"model":"gpt-4o-mini","input":"Weather in Paris?","tools":[{"type":"function","name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}]}`
+	for _, stream := range []bool{false, true} {
+		response := createResponse(t, body, stream)
+		var calls []official_types.ResponseItem
+		for _, item := range response.Output {
+			if item.Type == "function_call" {
+				calls = append(calls, item)
+			}
+		}
+		if len(calls) != 1 || calls[0].Name != "get_weather" || *calls[0].Arguments != `{"city":"Paris"}` || calls[0].CallID == "" {
+			t.Errorf("stream %v output %+v", stream, response.Output)
+		}
+	}
+}
+
+func TestResponsesInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		param string
+		code  string
+	}{
+		{"max_output_tokens", `{"model":"gpt-4o-mini","input":"Hello","max_output_tokens":-1}`, "max_output_tokens", ""},
+		{"unsupported tool", `{"model":"gpt-4o-mini","input":"Hello","tools":[{"type":"web_search"}]}`, "tools", ""},
+		{"unknown previous response", `{"model":"gpt-4o-mini","input":"Hello","previous_response_id":"resp_missing"}`, "previous_response_id", "previous_response_not_found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, api_err := sendWithKey(t, http.MethodPost, "/v1/responses", "", test.body)
+			if recorder.Code/100 != 4 || api_err.Param != test.param || test.code != "" && api_err.Code != test.code {
+				t.Errorf("status %d, error %+v, want param %q", recorder.Code, api_err, test.param)
+			}
+		})
+	}
+}
+
+func TestStoredResponses(t *testing.T) {
+	setKeys(t, map[string]*APIKey{"owner": {ID: "owner"}, "other": {ID: "other"}})
+	created := func(body string) *official_types.Response {
+		recorder, api_err := sendWithKey(t, http.MethodPost, "/v1/responses", "Bearer owner", body)
+		if recorder.Code != 200 {
+			t.Fatalf("status %d: %+v", recorder.Code, api_err)
+		}
+		var response official_types.Response
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return &response
+	}
+	first := created(`{"model":"gpt-4o-mini","input":"Hello"}`)
+	t.Cleanup(func() { responseStore.Delete(first.ID, "owner") })
+	unstored := created(`{"model":"gpt-4o-mini","input":"Hello","store":false}`)
+	next := created(`{"model":"gpt-4o-mini","input":"And then?","previous_response_id":"` + first.ID + `"}`)
+	t.Cleanup(func() { responseStore.Delete(next.ID, "owner") })
+	if next.PreviousResponseID == nil || *next.PreviousResponseID != first.ID {
+		t.Errorf("previous_response_id %v, want %s", next.PreviousResponseID, first.ID)
+	}
+	if stored := responseStore.Get(next.ID, "owner"); stored == nil || len(stored.History.Messages) != 4 {
+		t.Errorf("history of the continued response %+v, want both turns", stored)
+	}
+	tests := []struct {
+		name   string
+		method string
+		id     string
+		key    string
+		status int
+	}{
+		{"get", http.MethodGet, first.ID, "owner", 200},
+		{"get with another key", http.MethodGet, first.ID, "other", 404},
+		{"get not stored", http.MethodGet, unstored.ID, "owner", 404},
+		{"delete with another key", http.MethodDelete, first.ID, "other", 404},
+		{"delete", http.MethodDelete, first.ID, "owner", 200},
+		{"get deleted", http.MethodGet, first.ID, "owner", 404},
+		{"delete again", http.MethodDelete, first.ID, "owner", 404},
+	}
+	for _, test := range tests {
+		recorder, api_err := sendWithKey(t, test.method, "/v1/responses/"+test.id, "Bearer "+test.key, "")
+		if recorder.Code != test.status {
+			t.Fatalf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+		}
+		if test.status == 404 && api_err.Code != "not_found" {
+			t.Errorf("%s: error %+v", test.name, api_err)
+		}
+	}
+}
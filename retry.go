@@ -0,0 +1,140 @@
+package main
+
+import (
+	chatgpt_request_converter "freechatgpt/conversion/requests/chatgpt"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/logging"
+	"freechatgpt/internal/tracing"
+	official_types "freechatgpt/typings/official"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// attemptsHeader reports how many upstream attempts a response took
+const attemptsHeader = "x-chatgpt-to-api-attempts"
+
+// retryable reports whether another account or proxy may succeed where err failed
+func retryable(err error) bool {
+	api_err, ok := err.(*official_types.APIError)
+	if !ok {
+		return false
+	}
+	if api_err.Code == "no_account_available" || api_err.Code == "invalid_response_format" {
+		return false
+	}
+	return api_err.Type == "server_error" || api_err.Status == 429
+}
+
+// recoverChoice turns a panic while serving a choice into the error of the choice. Choices run in
+// their own goroutines, which gin.Recovery does not cover.
+func recoverChoice(c *gin.Context, err *error) {
+	if recovered := recover(); recovered != nil {
+		logging.From(c).Error("Choice panicked", "panic", recovered, "stack", string(debug.Stack()))
+		*err = official_types.ServerError("The server failed to serve the choice")
+	}
+}
+
+// withRetries runs attempt until it succeeds, fails in a way retrying can not fix, has written
+// to the client or MAX_ATTEMPTS is used up. attempts counts the upstream attempts of the request.
+func withRetries(writer choiceWriter, attempts *int32, attempt func(try int) error) error {
+	var last error
+	for try := 0; try < MAX_ATTEMPTS; try++ {
+		atomic.AddInt32(attempts, 1)
+		err := attempt(try)
+		if api_err, ok := err.(*official_types.APIError); ok && api_err.Code == "no_account_available" && last != nil {
+			// Every candidate failed, report why
+			return last
+		}
+		if err == nil || writer.Written() || !retryable(err) {
+			return err
+		}
+		last = err
+		writer.Reset()
+	}
+	return last
+}
+
+// resumer looks up the upstream conversation a request continues, the returned request only holds
+// the new turn
+type resumer func(original_request official_types.APIRequest) (*chatgpt.ConversationInfo, official_types.APIRequest)
+
+// serveChoice runs one choice of a chat completion, retrying on other accounts and proxies.
+// Only the first attempt continues the conversation found by resume_from, it is pinned to the
+// account owning it. It returns the prompt tokens and the upstream conversation of the reply.
+func serveChoice(c *gin.Context, original_request official_types.APIRequest, route chatgpt_request_converter.Route, resume_from resumer, writer choiceWriter, attempts *int32) (int, *chatgpt.ConversationInfo, error) {
+	// The models are unknown if the model list could not be fetched, let upstream decide then
+	if known := chatgpt.KnownModels(); route.Slug != "" && known != nil && !known[route.Slug] {
+		return 0, nil, official_types.ModelNotFoundError(original_request.Model)
+	}
+	var prompt_tokens int
+	var info *chatgpt.ConversationInfo
+	var tried []string
+	err := withRetries(writer, attempts, func(try int) error {
+		choice_request := original_request
+		var resume *chatgpt.ConversationInfo
+		var lease *AccountLease
+		_, span := tracing.Start(c.Request.Context(), "accounts.Acquire", attribute.Int("chatgpt.attempt", try+1))
+		if resume_from != nil && try == 0 {
+			resume, choice_request = resume_from(original_request)
+			if resume != nil && (len(route.Accounts) == 0 || containsString(route.Accounts, resume.Account)) {
+				lease = accountPool.AcquireAccount(resume.Account, resume.TeamUserID != "")
+			}
+			if lease == nil {
+				resume, choice_request = nil, original_request
+			}
+		}
+		if lease == nil {
+			var wait time.Duration
+			lease, wait = accountPool.Acquire(route.Slug, route.Accounts, tried)
+			if lease == nil && try != 0 {
+				// All other accounts failed or cool down, try again with another proxy
+				lease, wait = accountPool.Acquire(route.Slug, route.Accounts, nil)
+			}
+			if lease == nil {
+				api_err := official_types.UpstreamError(503, "no_account_available", "No account is available for "+original_request.Model)
+				if wait > 0 {
+					api_err.RetryAfter = strconv.Itoa(int(wait.Seconds()) + 1)
+				}
+				tracing.End(span, api_err)
+				return api_err
+			}
+		}
+		span.SetAttributes(attribute.String("chatgpt.account", lease.Account), attribute.Bool("chatgpt.resume", resume != nil))
+		span.End()
+		tried = AppendIfNone(tried, lease.Account)
+		c.Set("usage_account", lease.Account)
+		var position chatgpt.ContinueInfo
+		var err error
+		proxy_url := proxyPool.Next(lease.Account)
+		log := logging.From(c).With("account", lease.Account, "proxy", redactProxy(proxy_url), "attempt", try+1)
+		ctx := tracing.Tag(c.Request.Context(),
+			attribute.String("chatgpt.account", lease.Account),
+			attribute.String("chatgpt.proxy", redactProxy(proxy_url)),
+			attribute.String("chatgpt.model", original_request.Model),
+			attribute.Int("chatgpt.attempt", try+1),
+		)
+		ctx, span = tracing.Start(ctx, "chatgpt.attempt")
+		prompt_tokens, position, err = runChoice(ctx, c, log, choice_request, lease.Account, lease.Secret, proxy_url, resume, writer)
+		if format, ok := writer.(*formatWriter); ok && err == nil {
+			position, err = checkFormat(ctx, c, log, format, choice_request, lease.Account, lease.Secret, proxy_url, position)
+		}
+		tracing.End(span, err)
+		if err != nil {
+			log.Warn("Upstream request failed", "error", err)
+		}
+		lease.Release(err)
+		if api_err, ok := err.(*official_types.APIError); ok && api_err.Code == "upstream_unreachable" && proxy_url != "" {
+			proxyPool.MarkFailed(proxy_url, api_err.Message)
+		}
+		if err == nil {
+			info = &chatgpt.ConversationInfo{Account: lease.Account, TeamUserID: lease.Secret.TeamUserID, ContinueInfo: position}
+		}
+		return err
+	})
+	return prompt_tokens, info, err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	chatgpt_response_converter "freechatgpt/conversion/response/chatgpt"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/tokenizer"
+	official_types "freechatgpt/typings/official"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errChoiceDone is returned to Handler once a choice reached a stop sequence or max_tokens
+var errChoiceDone = errors.New("choice finished")
+
+// completionWriter receives the text of one choice and closes it with a finish reason
+type completionWriter interface {
+	chatgpt.StreamWriter
+	Finish(reason string) error
+}
+
+// collectWriter gathers the text of a non-stream choice
+type collectWriter struct {
+	text   strings.Builder
+	model  string
+	reason string
+}
+
+func (w *collectWriter) WriteDelta(text string) error {
+	w.text.WriteString(text)
+	return nil
+}
+
+func (w *collectWriter) SetModel(slug string) {
+	w.model = slug
+}
+
+func (w *collectWriter) Finish(reason string) error {
+	w.reason = reason
+	return nil
+}
+
+// Written is false, the text is only sent once the choice is done
+func (w *collectWriter) Written() bool {
+	return false
+}
+
+// Reset drops the text before a retry
+func (w *collectWriter) Reset() {
+	w.text.Reset()
+	w.model, w.reason = "", ""
+}
+
+// chunkWriter streams chat.completion.chunk events of one choice to the client,
+// choices of the same request share the lock
+type chunkWriter struct {
+	c        *gin.Context
+	meta     official_types.CompletionMeta
+	index    int
+	lock     *sync.Mutex
+	roleSent bool
+	// onFirstWrite may set response headers before the first chunk of the request
+	onFirstWrite func()
+}
+
+func (w *chunkWriter) write(chunk official_types.ChatCompletionChunk) error {
+	if !w.roleSent {
+		chunk.Choices[0].Delta.Role = "assistant"
+		w.roleSent = true
+	}
+	chunk.Choices[0].Index = w.index
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.c.Writer.Written() {
+		if w.onFirstWrite != nil {
+			w.onFirstWrite()
+		}
+		// Response content type is text/event-stream
+		w.c.Header("Content-Type", "text/event-stream")
+	}
+	_, err := w.c.Writer.WriteString("data: " + chunk.String() + "\n\n")
+	// Flush the response writer buffer to ensure that the client receives each line as it's written
+	w.c.Writer.Flush()
+	return err
+}
+
+func (w *chunkWriter) WriteDelta(text string) error {
+	return w.write(official_types.NewChatCompletionChunk(w.meta, text))
+}
+
+func (w *chunkWriter) SetModel(slug string) {
+	w.meta.SetModel(slug)
+}
+
+func (w *chunkWriter) Finish(reason string) error {
+	return w.write(official_types.StopChunk(w.meta, reason))
+}
+
+// Written reports whether a chunk of the request reached the client
+func (w *chunkWriter) Written() bool {
+	return w.c.Writer.Written()
+}
+
+// toolCallBuffer holds back the tool calls block of a streamed reply
+type toolCallBuffer struct {
+	pending string
+	calling bool
+}
+
+// Add returns the part of the text seen so far which can not belong to the tool calls block
+func (b *toolCallBuffer) Add(text string) string {
+	b.pending += text
+	if b.calling {
+		return ""
+	}
+	if idx := strings.Index(b.pending, official_types.ToolCallsOpen); idx != -1 {
+		b.calling = true
+		before := strings.TrimRight(b.pending[:idx], " \n")
+		b.pending = b.pending[idx:]
+		return before
+	}
+	keep := chatgpt_response_converter.PartialToolCallsOpen(b.pending)
+	flush := b.pending[:len(b.pending)-keep]
+	b.pending = b.pending[len(b.pending)-keep:]
+	return flush
+}
+
+// Reset drops held back text before a retry
+func (b *toolCallBuffer) Reset() {
+	b.pending, b.calling = "", false
+}
+
+// toolCallWriter holds back the tool calls block and streams it as delta.tool_calls
+type toolCallWriter struct {
+	*chunkWriter
+	toolCallBuffer
+	legacy bool
+}
+
+func (w *toolCallWriter) WriteDelta(text string) error {
+	if flush := w.Add(text); flush != "" {
+		return w.chunkWriter.WriteDelta(flush)
+	}
+	return nil
+}
+
+func (w *toolCallWriter) Finish(reason string) error {
+	_, calls := chatgpt_response_converter.ParseToolCalls(w.pending)
+	if len(calls) == 0 {
+		if w.pending != "" {
+			if err := w.chunkWriter.WriteDelta(w.pending); err != nil {
+				return err
+			}
+		}
+		return w.chunkWriter.Finish(reason)
+	}
+	if w.legacy {
+		chunk := official_types.NewChatCompletionChunk(w.meta, "")
+		chunk.Choices[0].Delta.FunctionCall = &calls[0].Function
+		if err := w.write(chunk); err != nil {
+			return err
+		}
+		return w.chunkWriter.Finish("function_call")
+	}
+	for i, call := range calls {
+		index := i
+		call.Index = &index
+		chunk := official_types.NewChatCompletionChunk(w.meta, "")
+		chunk.Choices[0].Delta.ToolCalls = []official_types.ToolCall{call}
+		if err := w.write(chunk); err != nil {
+			return err
+		}
+	}
+	return w.chunkWriter.Finish("tool_calls")
+}
+
+// limitWriter ends a choice at the first stop sequence or once max_tokens is reached
+type limitWriter struct {
+	completionWriter
+	model     string
+	stop      []string
+	maxTokens int
+	tokens    int
+	// emitted is the text passed on, used for the usage of the choice
+	emitted strings.Builder
+	// held is the tail which may be the beginning of a stop sequence
+	held   string
+	reason string
+	// stopSequence is the stop sequence which ended the choice
+	stopSequence string
+}
+
+func (w *limitWriter) WriteDelta(text string) error {
+	if w.reason != "" {
+		return errChoiceDone
+	}
+	text = w.held + text
+	w.held = ""
+	if idx, sequence := firstStop(text, w.stop); idx != -1 {
+		err := w.emit(text[:idx])
+		if err != nil && err != errChoiceDone {
+			return err
+		}
+		if w.reason == "" {
+			w.reason = "stop"
+			w.stopSequence = sequence
+		}
+		return errChoiceDone
+	}
+	keep := partialStop(text, w.stop)
+	w.held = text[len(text)-keep:]
+	return w.emit(text[:len(text)-keep])
+}
+
+func (w *limitWriter) emit(text string) error {
+	if text == "" {
+		return nil
+	}
+	if w.maxTokens > 0 {
+		count := tokenizer.Count(w.model, text)
+		if w.tokens+count > w.maxTokens {
+			text = truncateTokens(w.model, text, w.maxTokens-w.tokens)
+			w.reason = "length"
+		}
+		w.tokens += count
+	}
+	if text != "" {
+		w.emitted.WriteString(text)
+		if err := w.completionWriter.WriteDelta(text); err != nil {
+			return err
+		}
+	}
+	if w.reason != "" {
+		return errChoiceDone
+	}
+	return nil
+}
+
+func (w *limitWriter) Finish(reason string) error {
+	if w.reason == "" && w.held != "" {
+		err := w.emit(w.held)
+		if err != nil && err != errChoiceDone {
+			return err
+		}
+		w.held = ""
+	}
+	if w.reason != "" {
+		reason = w.reason
+	}
+	return w.completionWriter.Finish(reason)
+}
+
+// firstStop returns the index of the earliest stop sequence in text and the sequence, or -1
+func firstStop(text string, stop []string) (int, string) {
+	first, found := -1, ""
+	for _, sequence := range stop {
+		if idx := strings.Index(text, sequence); idx != -1 && (first == -1 || idx < first) {
+			first, found = idx, sequence
+		}
+	}
+	return first, found
+}
+
+// partialStop returns the length of the longest suffix of text that begins a stop sequence
+func partialStop(text string, stop []string) int {
+	longest := 0
+	for _, sequence := range stop {
+		for i := len(sequence) - 1; i > longest; i-- {
+			if strings.HasSuffix(text, sequence[:i]) {
+				longest = i
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// Written reports whether text of the choice may have reached the client, a choice can only be
+// retried before that
+func (w *limitWriter) Written() bool {
+	sent, ok := w.completionWriter.(interface{ Written() bool })
+	return w.emitted.Len() != 0 && (!ok || sent.Written())
+}
+
+// Reset forgets the text of the choice before a retry
+func (w *limitWriter) Reset() {
+	w.held = ""
+	w.tokens = 0
+	w.reason = ""
+	w.stopSequence = ""
+	w.emitted.Reset()
+	if resetter, ok := w.completionWriter.(interface{ Reset() }); ok {
+		resetter.Reset()
+	}
+}
+
+// CompletionTokens counts the tokens of the text written to the choice
+func (w *limitWriter) CompletionTokens() int {
+	return tokenizer.Count(w.model, w.emitted.String())
+}
+
+// truncateTokens returns the longest prefix of text which fits in limit tokens
+func truncateTokens(model string, text string, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	runes := []rune(text)
+	low, high := 0, len(runes)
+	for low < high {
+		mid := (low + high + 1) / 2
+		if tokenizer.Count(model, string(runes[:mid])) <= limit {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return string(runes[:low])
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLimitWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		deltas    []string
+		stop      []string
+		maxTokens int
+		text      string
+		reason    string
+	}{
+		{"no limits", []string{"Hello", " world"}, nil, 0, "Hello world", "stop"},
+		{"stop sequence", []string{"Hello world"}, []string{"wor"}, 0, "Hello ", "stop"},
+		{"stop across deltas", []string{"Hello w", "orld"}, []string{"wor"}, 0, "Hello ", "stop"},
+		{"earliest stop", []string{"one two three"}, []string{"three", "two"}, 0, "one ", "stop"},
+		{"partial stop at the end", []string{"ab", "c"}, []string{"cd"}, 0, "abc", "stop"},
+		{"stop at the start", []string{"STOP here"}, []string{"STOP"}, 0, "", "stop"},
+		{"max_tokens", []string{"Hello world, how are you?"}, nil, 2, "Hello world", "length"},
+		{"max_tokens across deltas", []string{"Hello", " world", ", how are you?"}, nil, 2, "Hello world", "length"},
+		{"fits max_tokens", []string{"Hello"}, nil, 5, "Hello", "stop"},
+		{"stop before max_tokens", []string{"Hello. world, how are you?"}, []string{"."}, 3, "Hello", "stop"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			collected := &collectWriter{}
+			writer := &limitWriter{completionWriter: collected, model: "gpt-4o", stop: test.stop, maxTokens: test.maxTokens}
+			for _, delta := range test.deltas {
+				if err := writer.WriteDelta(delta); err == errChoiceDone {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Finish("stop"); err != nil {
+				t.Fatal(err)
+			}
+			if collected.text.String() != test.text || collected.reason != test.reason {
+				t.Errorf("got %q finishing with %q, want %q with %q", collected.text.String(), collected.reason, test.text, test.reason)
+			}
+			if writer.emitted.String() != test.text {
+				t.Errorf("emitted %q, want %q", writer.emitted.String(), test.text)
+			}
+		})
+	}
+}
+
+func TestLimitWriterReset(t *testing.T) {
+	collected := &collectWriter{}
+	writer := &limitWriter{completionWriter: collected, model: "gpt-4o", stop: []string{"!"}, maxTokens: 10}
+	writer.WriteDelta("Hi!")
+	writer.Finish("stop")
+	writer.Reset()
+	if writer.emitted.Len() != 0 || collected.text.Len() != 0 || writer.reason != "" || writer.tokens != 0 {
+		t.Fatalf("state left after Reset: %q %q %q %d", writer.emitted.String(), collected.text.String(), writer.reason, writer.tokens)
+	}
+	writer.WriteDelta("Again")
+	writer.Finish("stop")
+	if collected.text.String() != "Again" || collected.reason != "stop" {
+		t.Errorf("got %q finishing with %q after Reset", collected.text.String(), collected.reason)
+	}
+}
@@ -0,0 +1,208 @@
+package anthropic
+
+import (
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"strings"
+)
+
+// MessagesRequest is a request of the Anthropic Messages API
+type MessagesRequest struct {
+	Model         string      `json:"model"`
+	Messages      []Message   `json:"messages"`
+	System        interface{} `json:"system,omitempty"`
+	MaxTokens     int         `json:"max_tokens"`
+	StopSequences []string    `json:"stop_sequences,omitempty"`
+	Stream        bool        `json:"stream"`
+	Temperature   *float64    `json:"temperature,omitempty"`
+	TopP          *float64    `json:"top_p,omitempty"`
+	TopK          *int        `json:"top_k,omitempty"`
+	Tools         []Tool      `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *struct {
+		UserID string `json:"user_id,omitempty"`
+	} `json:"metadata,omitempty"`
+}
+
+// Message is a turn of the conversation, its content is a text or a list of content blocks
+type Message struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type Tool struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	InputSchema interface{} `json:"input_schema,omitempty"`
+}
+
+type ToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// inputBlock is a content block of a request message
+type inputBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Source struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		URL       string `json:"url"`
+	} `json:"source"`
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   interface{}     `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+// readBlocks returns the content blocks of a message, a text is read as one text block
+func readBlocks(content interface{}) ([]inputBlock, bool) {
+	if text, ok := content.(string); ok {
+		return []inputBlock{{Type: "text", Text: text}}, true
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, false
+	}
+	var blocks []inputBlock
+	if json.Unmarshal(data, &blocks) != nil {
+		return nil, false
+	}
+	return blocks, true
+}
+
+// joinText returns the text of the text blocks of content
+func joinText(content interface{}) (string, bool) {
+	if content == nil {
+		return "", true
+	}
+	blocks, ok := readBlocks(content)
+	if !ok {
+		return "", false
+	}
+	var texts []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), true
+}
+
+// ChatRequest converts the request to a chat completion request
+func (r *MessagesRequest) ChatRequest() (official_types.APIRequest, *official_types.APIError) {
+	api_request := official_types.APIRequest{
+		Model:       r.Model,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+	}
+	if r.MaxTokens <= 0 {
+		return api_request, official_types.InvalidRequestError("max_tokens", "max_tokens: Field required, it must be a positive integer")
+	}
+	api_request.MaxTokens = &r.MaxTokens
+	if len(r.StopSequences) != 0 {
+		var stop []interface{}
+		for _, sequence := range r.StopSequences {
+			stop = append(stop, sequence)
+		}
+		api_request.Stop = stop
+	}
+	if r.Metadata != nil {
+		api_request.User = r.Metadata.UserID
+	}
+	for _, tool := range r.Tools {
+		api_request.Tools = append(api_request.Tools, official_types.Tool{Type: "function", Function: official_types.Function{Name: tool.Name, Description: tool.Description, Parameters: tool.InputSchema}})
+	}
+	if r.ToolChoice != nil {
+		switch r.ToolChoice.Type {
+		case "auto", "none":
+			api_request.ToolChoice = r.ToolChoice.Type
+		case "any":
+			api_request.ToolChoice = "required"
+		case "tool":
+			api_request.ToolChoice = map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": r.ToolChoice.Name}}
+		default:
+			return api_request, official_types.InvalidRequestError("tool_choice", "tool_choice.type must be auto, any, tool or none")
+		}
+		if r.ToolChoice.DisableParallelToolUse {
+			parallel := false
+			api_request.ParallelToolCalls = &parallel
+		}
+	}
+	if r.System != nil {
+		system, ok := joinText(r.System)
+		if !ok {
+			return api_request, official_types.InvalidRequestError("system", "system must be a string or a list of text blocks")
+		}
+		if system != "" {
+			api_request.AddMessage("system", system)
+		}
+	}
+	if len(r.Messages) == 0 {
+		return api_request, official_types.InvalidRequestError("messages", "messages: at least one message is required")
+	}
+	for _, message := range r.Messages {
+		blocks, ok := readBlocks(message.Content)
+		if !ok {
+			return api_request, official_types.InvalidRequestError("messages", "content must be a string or a list of content blocks")
+		}
+		switch message.Role {
+		case "user":
+			var parts []interface{}
+			for _, block := range blocks {
+				switch block.Type {
+				case "text":
+					parts = append(parts, map[string]interface{}{"type": "text", "text": block.Text})
+				case "image":
+					url := block.Source.URL
+					if block.Source.Type == "base64" {
+						url = "data:" + block.Source.MediaType + ";base64," + block.Source.Data
+					}
+					parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}})
+				case "tool_result":
+					// Tool results answer the tool calls of the previous turn, they go first
+					result, ok := joinText(block.Content)
+					if !ok {
+						return api_request, official_types.InvalidRequestError("messages", "tool_result content must be a string or a list of text blocks")
+					}
+					if block.IsError {
+						result = "Error: " + result
+					}
+					api_request.AddToolMessage(block.ToolUseID, result)
+				default:
+					return api_request, official_types.InvalidRequestError("messages", "content blocks of type "+block.Type+" are not supported")
+				}
+			}
+			if len(parts) != 0 {
+				api_request.AddMessage("user", parts)
+			}
+		case "assistant":
+			var texts []string
+			var tool_calls []official_types.ToolCall
+			for _, block := range blocks {
+				switch block.Type {
+				case "text":
+					texts = append(texts, block.Text)
+				case "tool_use":
+					arguments := string(block.Input)
+					if arguments == "" || arguments == "null" {
+						arguments = "{}"
+					}
+					tool_calls = append(tool_calls, official_types.ToolCall{ID: block.ID, Type: "function", Function: official_types.FunctionCall{Name: block.Name, Arguments: arguments}})
+				case "thinking", "redacted_thinking":
+				default:
+					return api_request, official_types.InvalidRequestError("messages", "content blocks of type "+block.Type+" are not supported")
+				}
+			}
+			api_request.AddAssistantMessage(strings.Join(texts, ""), tool_calls)
+		default:
+			return api_request, official_types.InvalidRequestError("messages", "role must be user or assistant")
+		}
+	}
+	return api_request, nil
+}
@@ -0,0 +1,145 @@
+package anthropic
+
+import (
+	"encoding/json"
+	official_types "freechatgpt/typings/official"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Response is a message object of the Messages API
+type Response struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+// ContentBlock is a text or a tool_use block of a reply
+type ContentBlock struct {
+	Type  string          `json:"type"`
+	Text  *string         `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func NewResponse(model string) *Response {
+	return &Response{
+		ID:      "msg_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:24],
+		Type:    "message",
+		Role:    "assistant",
+		Model:   model,
+		Content: []ContentBlock{},
+	}
+}
+
+func TextBlock(text string) ContentBlock {
+	return ContentBlock{Type: "text", Text: &text}
+}
+
+// ToolUseBlock returns the block of a tool call, arguments which are no JSON object are passed as {}
+func ToolUseBlock(call official_types.ToolCall) ContentBlock {
+	input := json.RawMessage(call.Function.Arguments)
+	var object map[string]interface{}
+	if json.Unmarshal(input, &object) != nil || object == nil {
+		input = json.RawMessage("{}")
+	}
+	return ContentBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input}
+}
+
+// StopReason maps the finish reason of a choice: a reply cut by upstream finish_details max_tokens
+// or max_tokens is max_tokens, one ended by a stop sequence is stop_sequence
+func StopReason(finish_reason string, stop_sequence string, tool_use bool) string {
+	switch {
+	case tool_use:
+		return "tool_use"
+	case finish_reason == "length":
+		return "max_tokens"
+	case stop_sequence != "":
+		return "stop_sequence"
+	}
+	return "end_turn"
+}
+
+// SetStop sets the stop reason and the stop sequence which ended the reply
+func (r *Response) SetStop(stop_reason string, stop_sequence string) {
+	r.StopReason = &stop_reason
+	if stop_sequence != "" {
+		r.StopSequence = &stop_sequence
+	}
+}
+
+// StreamEvent is a server-sent event of a streamed message, its type names the event
+type StreamEvent struct {
+	Type         string        `json:"type"`
+	Message      *Response     `json:"message,omitempty"`
+	Index        *int          `json:"index,omitempty"`
+	ContentBlock *ContentBlock `json:"content_block,omitempty"`
+	Delta        interface{}   `json:"delta,omitempty"`
+	Usage        *Usage        `json:"usage,omitempty"`
+	Error        *Error        `json:"error,omitempty"`
+}
+
+func (e StreamEvent) String() string {
+	data, _ := json.Marshal(e)
+	return "event: " + e.Type + "\ndata: " + string(data) + "\n\n"
+}
+
+type TextDelta struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type InputJSONDelta struct {
+	Type        string `json:"type"`
+	PartialJSON string `json:"partial_json"`
+}
+
+type MessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+// Error is an error object of the Messages API
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error *Error `json:"error"`
+}
+
+// NewError converts an OpenAI error, the status decides the Anthropic error type
+func NewError(err *official_types.APIError) *Error {
+	error_type := "api_error"
+	switch {
+	case err.Status == 401:
+		error_type = "authentication_error"
+	case err.Status == 403:
+		error_type = "permission_error"
+	case err.Status == 404:
+		error_type = "not_found_error"
+	case err.Status == 413:
+		error_type = "request_too_large"
+	case err.Status == 429:
+		error_type = "rate_limit_error"
+	case err.Status == 503 || err.Status == 529:
+		error_type = "overloaded_error"
+	case err.Status >= 400 && err.Status < 500:
+		error_type = "invalid_request_error"
+	}
+	return &Error{Type: error_type, Message: err.Message}
+}
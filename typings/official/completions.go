@@ -0,0 +1,128 @@
+package official
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// CompletionRequest is a request of the legacy completions API
+type CompletionRequest struct {
+	Model            string                 `json:"model"`
+	Prompt           interface{}            `json:"prompt"`
+	Suffix           string                 `json:"suffix,omitempty"`
+	MaxTokens        *int                   `json:"max_tokens,omitempty"`
+	Temperature      *float64               `json:"temperature,omitempty"`
+	TopP             *float64               `json:"top_p,omitempty"`
+	N                int                    `json:"n,omitempty"`
+	Stream           bool                   `json:"stream"`
+	StreamOptions    *StreamOptions         `json:"stream_options,omitempty"`
+	Logprobs         *int                   `json:"logprobs,omitempty"`
+	Echo             bool                   `json:"echo,omitempty"`
+	Stop             interface{}            `json:"stop,omitempty"`
+	PresencePenalty  *float64               `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64               `json:"frequency_penalty,omitempty"`
+	BestOf           *int                   `json:"best_of,omitempty"`
+	Seed             *int                   `json:"seed,omitempty"`
+	LogitBias        map[string]interface{} `json:"logit_bias,omitempty"`
+	User             string                 `json:"user,omitempty"`
+}
+
+// defaultCompletionTokens is the max_tokens of the completions API when a request has none
+const defaultCompletionTokens = 16
+
+// Prompts returns the prompts of the request, a text is one prompt
+func (r *CompletionRequest) Prompts() ([]string, *APIError) {
+	switch v := r.Prompt.(type) {
+	case nil:
+		return []string{""}, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var prompts []string
+		for _, item := range v {
+			prompt, ok := item.(string)
+			if !ok {
+				return nil, InvalidRequestError("prompt", "prompt must be a string or an array of strings, token arrays are not supported")
+			}
+			prompts = append(prompts, prompt)
+		}
+		if len(prompts) == 0 {
+			return nil, InvalidRequestError("prompt", "prompt must not be an empty array")
+		}
+		return prompts, nil
+	}
+	return nil, InvalidRequestError("prompt", "prompt must be a string or an array of strings")
+}
+
+// ChatRequest wraps prompt into a single user message. A suffix is passed as system message
+// since there is no insert mode upstream.
+func (r *CompletionRequest) ChatRequest(prompt string) (APIRequest, *APIError) {
+	if r.Logprobs != nil {
+		return APIRequest{}, InvalidRequestError("logprobs", "logprobs are not supported")
+	}
+	if r.BestOf != nil && *r.BestOf > 1 {
+		return APIRequest{}, InvalidRequestError("best_of", "best_of is not supported")
+	}
+	api_request := APIRequest{
+		Model:            r.Model,
+		MaxTokens:        r.MaxTokens,
+		Temperature:      r.Temperature,
+		TopP:             r.TopP,
+		Stop:             r.Stop,
+		PresencePenalty:  r.PresencePenalty,
+		FrequencyPenalty: r.FrequencyPenalty,
+		Seed:             r.Seed,
+		LogitBias:        r.LogitBias,
+		User:             r.User,
+	}
+	if api_request.MaxTokens == nil {
+		max_tokens := defaultCompletionTokens
+		api_request.MaxTokens = &max_tokens
+	}
+	if r.Suffix != "" {
+		api_request.AddMessage("system", "Continue the text of the user. Your text is followed by this suffix, do not repeat it:\n"+r.Suffix)
+	}
+	api_request.AddMessage("user", prompt)
+	return api_request, nil
+}
+
+// NewTextCompletionMeta returns the meta of a completions API response
+func NewTextCompletionMeta(model string) CompletionMeta {
+	meta := NewCompletionMeta(model)
+	meta.ID = "cmpl-" + strings.TrimPrefix(meta.ID, "chatcmpl-")
+	return meta
+}
+
+// TextCompletion is a response and a streamed chunk of the completions API
+type TextCompletion struct {
+	ID                string       `json:"id"`
+	Object            string       `json:"object"`
+	Created           int64        `json:"created"`
+	Model             string       `json:"model"`
+	SystemFingerprint string       `json:"system_fingerprint"`
+	Choices           []TextChoice `json:"choices"`
+	Usage             *Usage       `json:"usage,omitempty"`
+}
+
+type TextChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason interface{} `json:"finish_reason"`
+}
+
+func (completion *TextCompletion) String() string {
+	resp, _ := json.Marshal(completion)
+	return string(resp)
+}
+
+func NewTextCompletion(meta CompletionMeta, choices []TextChoice) TextCompletion {
+	return TextCompletion{
+		ID:                meta.ID,
+		Object:            "text_completion",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
+		Choices:           choices,
+	}
+}
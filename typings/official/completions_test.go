@@ -0,0 +1,72 @@
+package official
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCompletionRequestChatRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		prompts   []string
+		maxTokens int
+		// roles are the roles of the messages of the first prompt
+		roles []string
+		param string
+	}{
+		{"text", `{"prompt":"Hello"}`, []string{"Hello"}, 16, []string{"user"}, ""},
+		{"no prompt", `{}`, []string{""}, 16, []string{"user"}, ""},
+		{"array", `{"prompt":["One","Two"],"max_tokens":5}`, []string{"One", "Two"}, 5, []string{"user"}, ""},
+		{"suffix", `{"prompt":"Hello","suffix":" Bye."}`, []string{"Hello"}, 16, []string{"system", "user"}, ""},
+		{"tokens", `{"prompt":[1,2]}`, nil, 0, nil, "prompt"},
+		{"empty array", `{"prompt":[]}`, nil, 0, nil, "prompt"},
+		{"logprobs", `{"prompt":"Hello","logprobs":2}`, nil, 0, nil, "logprobs"},
+		{"best_of", `{"prompt":"Hello","best_of":3}`, nil, 0, nil, "best_of"},
+		{"best_of 1", `{"prompt":"Hello","best_of":1}`, []string{"Hello"}, 16, []string{"user"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var request CompletionRequest
+			if err := json.Unmarshal([]byte(test.body), &request); err != nil {
+				t.Fatal(err)
+			}
+			prompts, api_err := request.Prompts()
+			var chat_request APIRequest
+			if api_err == nil {
+				chat_request, api_err = request.ChatRequest(prompts[0])
+			}
+			if test.param != "" {
+				if api_err == nil || api_err.Param != test.param {
+					t.Fatalf("error %+v, want param %q", api_err, test.param)
+				}
+				return
+			}
+			if api_err != nil {
+				t.Fatal(api_err)
+			}
+			if len(prompts) != len(test.prompts) {
+				t.Fatalf("prompts %q, want %q", prompts, test.prompts)
+			}
+			for i := range prompts {
+				if prompts[i] != test.prompts[i] {
+					t.Errorf("prompts %q, want %q", prompts, test.prompts)
+				}
+			}
+			if *chat_request.MaxTokens != test.maxTokens {
+				t.Errorf("max_tokens %d, want %d", *chat_request.MaxTokens, test.maxTokens)
+			}
+			if len(chat_request.Messages) != len(test.roles) {
+				t.Fatalf("messages %+v, want roles %v", chat_request.Messages, test.roles)
+			}
+			for i, message := range chat_request.Messages {
+				if message.Role != test.roles[i] {
+					t.Errorf("message %d is %s, want %s", i, message.Role, test.roles[i])
+				}
+			}
+			if last := chat_request.Messages[len(chat_request.Messages)-1]; last.Content != prompts[0] {
+				t.Errorf("user message %v, want the prompt %q", last.Content, prompts[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package official
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// APIError is an error object of the OpenAI API, Status is the HTTP status it is sent with
+type APIError struct {
+	Status  int         `json:"-"`
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Param   interface{} `json:"param"`
+	Code    interface{} `json:"code"`
+	// RetryAfter is sent as the Retry-After header when set
+	RetryAfter string `json:"-"`
+}
+
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// String returns the error wrapped in an error response
+func (e *APIError) String() string {
+	resp, _ := json.Marshal(ErrorResponse{Error: e})
+	return string(resp)
+}
+
+func NewAPIError(status int, error_type string, code interface{}, message string) *APIError {
+	return &APIError{Status: status, Message: message, Type: error_type, Code: code}
+}
+
+func InvalidRequestError(param string, message string) *APIError {
+	err := NewAPIError(400, "invalid_request_error", nil, message)
+	if param != "" {
+		err.Param = param
+	}
+	return err
+}
+
+func ModelNotFoundError(model string) *APIError {
+	err := NewAPIError(404, "invalid_request_error", "model_not_found", "The model `"+model+"` does not exist or you do not have access to it.")
+	err.Param = "model"
+	return err
+}
+
+func AuthenticationError(message string) *APIError {
+	return NewAPIError(401, "invalid_request_error", "invalid_api_key", message)
+}
+
+func RateLimitError(message string) *APIError {
+	return NewAPIError(429, "requests", "rate_limit_exceeded", message)
+}
+
+func ServerError(message string) *APIError {
+	return NewAPIError(500, "server_error", nil, message)
+}
+
+// UpstreamError is a failure of the upstream website which the client can not fix
+func UpstreamError(status int, code string, message string) *APIError {
+	return NewAPIError(status, "server_error", code, message)
+}
+
+// AsAPIError returns err as an APIError, other errors are server errors
+func AsAPIError(err error) *APIError {
+	var api_err *APIError
+	if errors.As(err, &api_err) {
+		return api_err
+	}
+	return ServerError(err.Error())
+}
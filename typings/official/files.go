@@ -0,0 +1,46 @@
+package official
+
+import "time"
+
+// File is a file object of the Files API
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+func NewFile(filename string, purpose string, bytes int) *File {
+	return &File{
+		ID:        newItemID("file-"),
+		Object:    "file",
+		Bytes:     bytes,
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+	}
+}
+
+type FileList struct {
+	Object  string  `json:"object"`
+	Data    []*File `json:"data"`
+	FirstID *string `json:"first_id"`
+	LastID  *string `json:"last_id"`
+	HasMore bool    `json:"has_more"`
+}
+
+// FilePurposes are the purposes a file may be uploaded with
+var FilePurposes = []string{"assistants", "batch", "fine-tune", "vision", "user_data", "evals"}
+
+func NewFileList(files []*File, has_more bool) FileList {
+	list := FileList{Object: "list", Data: files, HasMore: has_more}
+	if len(files) != 0 {
+		list.FirstID = &files[0].ID
+		list.LastID = &files[len(files)-1].ID
+	}
+	return list
+}
@@ -1,17 +1,121 @@
 package official
 
+const (
+	ToolCallsOpen  = "<tool_calls>"
+	ToolCallsClose = "</tool_calls>"
+)
+
 type APIRequest struct {
-	Messages []api_message `json:"messages"`
-	Stream   bool          `json:"stream"`
-	Model    string        `json:"model"`
+	Messages          []api_message   `json:"messages"`
+	Stream            bool            `json:"stream"`
+	StreamOptions     *StreamOptions  `json:"stream_options,omitempty"`
+	Model             string          `json:"model"`
+	Tools             []Tool          `json:"tools,omitempty"`
+	ToolChoice        interface{}     `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+	Functions         []Function      `json:"functions,omitempty"`
+	FunctionCall      interface{}     `json:"function_call,omitempty"`
+	ResponseFormat    *ResponseFormat `json:"response_format,omitempty"`
+
+	Temperature         *float64               `json:"temperature,omitempty"`
+	TopP                *float64               `json:"top_p,omitempty"`
+	MaxTokens           *int                   `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int                   `json:"max_completion_tokens,omitempty"`
+	Stop                interface{}            `json:"stop,omitempty"`
+	N                   int                    `json:"n,omitempty"`
+	PresencePenalty     *float64               `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64               `json:"frequency_penalty,omitempty"`
+	Seed                *int                   `json:"seed,omitempty"`
+	LogitBias           map[string]interface{} `json:"logit_bias,omitempty"`
+	Logprobs            bool                   `json:"logprobs,omitempty"`
+	User                string                 `json:"user,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type api_message struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content"`
+	Role         string        `json:"role"`
+	Content      interface{}   `json:"content"`
+	Name         string        `json:"name,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID   string        `json:"tool_call_id,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+}
+
+// AddMessage appends a message holding a text or content parts
+func (r *APIRequest) AddMessage(role string, content interface{}) {
+	r.Messages = append(r.Messages, api_message{Role: role, Content: content})
+}
+
+// AddToolMessage appends the result of a tool call
+func (r *APIRequest) AddToolMessage(tool_call_id string, content string) {
+	r.Messages = append(r.Messages, api_message{Role: "tool", ToolCallID: tool_call_id, Content: content})
+}
+
+// AddAssistantMessage appends a reply to the message history
+func (r *APIRequest) AddAssistantMessage(content string, tool_calls []ToolCall) {
+	r.Messages = append(r.Messages, api_message{Role: "assistant", Content: content, ToolCalls: tool_calls})
+}
+
+// ResponseFormat asks for a reply of plain text, any JSON object or JSON matching a schema
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Schema      interface{} `json:"schema,omitempty"`
+	Strict      *bool       `json:"strict,omitempty"`
+}
+
+// FileIDs returns the file_id of the file content parts of the messages
+func (r *APIRequest) FileIDs() []string {
+	var ids []string
+	for _, message := range r.Messages {
+		parts, _ := message.Content.([]interface{})
+		for _, part := range parts {
+			part_map, _ := part.(map[string]interface{})
+			if part_map["type"] != "file" {
+				continue
+			}
+			file, _ := part_map["file"].(map[string]interface{})
+			if id, _ := file["file_id"].(string); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+type Tool struct {
+	Type     string   `json:"type"`
+	Function Function `json:"function"`
+}
+
+type Function struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
 }
 
 type TTSAPIRequest struct {
+	Model  string `json:"model"`
 	Input  string `json:"input"`
 	Voice  string `json:"voice"`
 	Format string `json:"response_format"`
@@ -1,13 +1,47 @@
 package official
 
-import "encoding/json"
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CompletionMeta is shared by all chunks of one response
+type CompletionMeta struct {
+	ID                string
+	Created           int64
+	Model             string
+	SystemFingerprint string
+}
+
+func NewCompletionMeta(model string) CompletionMeta {
+	meta := CompletionMeta{
+		ID:      "chatcmpl-" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Created: time.Now().Unix(),
+	}
+	meta.SetModel(model)
+	return meta
+}
+
+// SetModel sets the echoed model, the fingerprint follows the model
+func (meta *CompletionMeta) SetModel(model string) {
+	hash := sha1.Sum([]byte(model))
+	meta.Model = model
+	meta.SystemFingerprint = "fp_" + hex.EncodeToString(hash[:])[:10]
+}
 
 type ChatCompletionChunk struct {
-	ID      string    `json:"id"`
-	Object  string    `json:"object"`
-	Created int64     `json:"created"`
-	Model   string    `json:"model"`
-	Choices []Choices `json:"choices"`
+	ID                string    `json:"id"`
+	Object            string    `json:"object"`
+	Created           int64     `json:"created"`
+	Model             string    `json:"model"`
+	SystemFingerprint string    `json:"system_fingerprint"`
+	Choices           []Choices `json:"choices"`
+	Usage             *Usage    `json:"usage,omitempty"`
 }
 
 func (chunk *ChatCompletionChunk) String() string {
@@ -22,16 +56,19 @@ type Choices struct {
 }
 
 type Delta struct {
-	Content string `json:"content,omitempty"`
-	Role    string `json:"role,omitempty"`
+	Content      string        `json:"content,omitempty"`
+	Role         string        `json:"role,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
 }
 
-func NewChatCompletionChunk(text string) ChatCompletionChunk {
+func NewChatCompletionChunk(meta CompletionMeta, text string) ChatCompletionChunk {
 	return ChatCompletionChunk{
-		ID:      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-		Object:  "chat.completion.chunk",
-		Created: 0,
-		Model:   "gpt-3.5-turbo-0301",
+		ID:                meta.ID,
+		Object:            "chat.completion.chunk",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
 		Choices: []Choices{
 			{
 				Index: 0,
@@ -44,12 +81,13 @@ func NewChatCompletionChunk(text string) ChatCompletionChunk {
 	}
 }
 
-func StopChunk(reason string) ChatCompletionChunk {
+func StopChunk(meta CompletionMeta, reason string) ChatCompletionChunk {
 	return ChatCompletionChunk{
-		ID:      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-		Object:  "chat.completion.chunk",
-		Created: 0,
-		Model:   "gpt-3.5-turbo-0301",
+		ID:                meta.ID,
+		Object:            "chat.completion.chunk",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
 		Choices: []Choices{
 			{
 				Index:        0,
@@ -60,35 +98,39 @@ func StopChunk(reason string) ChatCompletionChunk {
 }
 
 type ChatCompletion struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Usage   usage    `json:"usage"`
-	Choices []Choice `json:"choices"`
+	ID                string   `json:"id"`
+	Object            string   `json:"object"`
+	Created           int64    `json:"created"`
+	Model             string   `json:"model"`
+	SystemFingerprint string   `json:"system_fingerprint"`
+	Usage             Usage    `json:"usage"`
+	Choices           []Choice `json:"choices"`
 }
 type Msg struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role         string        `json:"role"`
+	Content      string        `json:"content"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
 }
 type Choice struct {
 	Index        int         `json:"index"`
 	Message      Msg         `json:"message"`
 	FinishReason interface{} `json:"finish_reason"`
 }
-type usage struct {
+type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
 }
 
-func NewChatCompletion(full_test string) ChatCompletion {
+func NewChatCompletion(meta CompletionMeta, full_test string) ChatCompletion {
 	return ChatCompletion{
-		ID:      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-		Object:  "chat.completion",
-		Created: int64(0),
-		Model:   "gpt-3.5-turbo-0301",
-		Usage: usage{
+		ID:                meta.ID,
+		Object:            "chat.completion",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
+		Usage: Usage{
 			PromptTokens:     0,
 			CompletionTokens: 0,
 			TotalTokens:      0,
@@ -104,3 +146,14 @@ func NewChatCompletion(full_test string) ChatCompletion {
 		},
 	}
 }
+
+func UsageChunk(meta CompletionMeta, prompt_tokens int, completion_tokens int) ChatCompletionChunk {
+	chunk := StopChunk(meta, "")
+	chunk.Choices = []Choices{}
+	chunk.Usage = &Usage{
+		PromptTokens:     prompt_tokens,
+		CompletionTokens: completion_tokens,
+		TotalTokens:      prompt_tokens + completion_tokens,
+	}
+	return chunk
+}
@@ -0,0 +1,358 @@
+package official
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ResponsesRequest is a request of the Responses API
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              ResponseInput     `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Stream             bool              `json:"stream"`
+	Store              *bool             `json:"store,omitempty"`
+	Tools              []ResponseTool    `json:"tools,omitempty"`
+	ToolChoice         interface{}       `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls,omitempty"`
+	MaxOutputTokens    *int              `json:"max_output_tokens,omitempty"`
+	Temperature        *float64          `json:"temperature,omitempty"`
+	TopP               *float64          `json:"top_p,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	User               string            `json:"user,omitempty"`
+}
+
+// ResponseTool is a tool of the Responses API, only function tools are supported
+type ResponseTool struct {
+	Type        string      `json:"type"`
+	Name        string      `json:"name,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+	Strict      *bool       `json:"strict,omitempty"`
+}
+
+// ResponseInput is either a text, which is read as one user message, or a list of input items
+type ResponseInput []ResponseInputItem
+
+func (input *ResponseInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		*input = ResponseInput{{Type: "message", Role: "user", Content: text}}
+		return nil
+	}
+	var items []ResponseInputItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return errors.New("input must be a string or an array of input items")
+	}
+	*input = items
+	return nil
+}
+
+// ResponseInputItem is a message, a function call of an earlier reply or the output of one
+type ResponseInputItem struct {
+	Type      string      `json:"type,omitempty"`
+	ID        string      `json:"id,omitempty"`
+	Role      string      `json:"role,omitempty"`
+	Content   interface{} `json:"content,omitempty"`
+	CallID    string      `json:"call_id,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Arguments string      `json:"arguments,omitempty"`
+	Output    interface{} `json:"output,omitempty"`
+}
+
+// ChatRequest converts the request to a chat completion request. Its messages are only the input,
+// the instructions and the history of a previous response are added by the caller.
+func (r *ResponsesRequest) ChatRequest() (APIRequest, *APIError) {
+	api_request := APIRequest{
+		Model:             r.Model,
+		ParallelToolCalls: r.ParallelToolCalls,
+		MaxTokens:         r.MaxOutputTokens,
+		Temperature:       r.Temperature,
+		TopP:              r.TopP,
+		User:              r.User,
+	}
+	for _, tool := range r.Tools {
+		if tool.Type != "function" {
+			return api_request, InvalidRequestError("tools", "tools of type "+tool.Type+" are not supported, only function tools are")
+		}
+		api_request.Tools = append(api_request.Tools, Tool{Type: "function", Function: Function{Name: tool.Name, Description: tool.Description, Parameters: tool.Parameters}})
+	}
+	switch v := r.ToolChoice.(type) {
+	case string:
+		api_request.ToolChoice = v
+	case map[string]interface{}:
+		api_request.ToolChoice = map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": v["name"]}}
+	}
+	if len(r.Input) == 0 {
+		return api_request, InvalidRequestError("input", "input must not be empty")
+	}
+	for _, item := range r.Input {
+		switch item.Type {
+		case "", "message":
+			content, err := chatContent(item.Content)
+			if err != nil {
+				return api_request, InvalidRequestError("input", err.Error())
+			}
+			role := item.Role
+			if role == "developer" {
+				role = "system"
+			}
+			if role != "user" && role != "assistant" && role != "system" {
+				return api_request, InvalidRequestError("input", "role "+item.Role+" is not supported")
+			}
+			api_request.Messages = append(api_request.Messages, api_message{Role: role, Content: content})
+		case "function_call":
+			call := ToolCall{ID: item.CallID, Type: "function", Function: FunctionCall{Name: item.Name, Arguments: item.Arguments}}
+			// Calls of one reply share the assistant message
+			if last := len(api_request.Messages) - 1; last >= 0 && api_request.Messages[last].Role == "assistant" && len(api_request.Messages[last].ToolCalls) != 0 {
+				api_request.Messages[last].ToolCalls = append(api_request.Messages[last].ToolCalls, call)
+			} else {
+				api_request.Messages = append(api_request.Messages, api_message{Role: "assistant", Content: "", ToolCalls: []ToolCall{call}})
+			}
+		case "function_call_output":
+			output, ok := item.Output.(string)
+			if !ok {
+				encoded, _ := json.Marshal(item.Output)
+				output = string(encoded)
+			}
+			api_request.Messages = append(api_request.Messages, api_message{Role: "tool", ToolCallID: item.CallID, Content: output})
+		default:
+			return api_request, InvalidRequestError("input", "input items of type "+item.Type+" are not supported")
+		}
+	}
+	return api_request, nil
+}
+
+// chatContent converts the content of an input message to chat completion content parts
+func chatContent(content interface{}) (interface{}, error) {
+	switch v := content.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		var parts []interface{}
+		for _, part := range v {
+			part_map, _ := part.(map[string]interface{})
+			switch part_map["type"] {
+			case "input_text", "output_text", "text":
+				parts = append(parts, map[string]interface{}{"type": "text", "text": part_map["text"]})
+			case "input_image":
+				url, _ := part_map["image_url"].(string)
+				if file_id, _ := part_map["file_id"].(string); url == "" && file_id != "" {
+					parts = append(parts, map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_id": file_id}})
+					continue
+				}
+				if url == "" {
+					return nil, errors.New("input_image needs an image_url or a file_id")
+				}
+				parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}})
+			case "input_file":
+				file := map[string]interface{}{}
+				for _, key := range []string{"file_id", "file_data", "filename"} {
+					if value, _ := part_map[key].(string); value != "" {
+						file[key] = value
+					}
+				}
+				if file["file_id"] == nil && file["file_data"] == nil {
+					return nil, errors.New("input_file needs a file_id or file_data")
+				}
+				parts = append(parts, map[string]interface{}{"type": "file", "file": file})
+			default:
+				return nil, errors.New("content parts of type " + toString(part_map["type"]) + " are not supported")
+			}
+		}
+		return parts, nil
+	}
+	return nil, errors.New("content must be a string or an array of content parts")
+}
+
+func toString(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
+
+// PrependMessages puts the messages of history before the messages of the request
+func (r *APIRequest) PrependMessages(history APIRequest) {
+	r.Messages = append(append([]api_message{}, history.Messages...), r.Messages...)
+}
+
+// PrependSystemMessage puts a system message before the messages of the request
+func (r *APIRequest) PrependSystemMessage(content string) {
+	r.Messages = append([]api_message{{Role: "system", Content: content}}, r.Messages...)
+}
+
+// Response is a response object of the Responses API
+type Response struct {
+	ID                 string             `json:"id"`
+	Object             string             `json:"object"`
+	CreatedAt          int64              `json:"created_at"`
+	Status             string             `json:"status"`
+	Error              *ResponseError     `json:"error"`
+	IncompleteDetails  *IncompleteDetails `json:"incomplete_details"`
+	Instructions       *string            `json:"instructions"`
+	MaxOutputTokens    *int               `json:"max_output_tokens"`
+	Model              string             `json:"model"`
+	Output             []ResponseItem     `json:"output"`
+	ParallelToolCalls  bool               `json:"parallel_tool_calls"`
+	PreviousResponseID *string            `json:"previous_response_id"`
+	Store              bool               `json:"store"`
+	Temperature        *float64           `json:"temperature"`
+	ToolChoice         interface{}        `json:"tool_choice"`
+	Tools              []ResponseTool     `json:"tools"`
+	TopP               *float64           `json:"top_p"`
+	Usage              *ResponseUsage     `json:"usage"`
+	User               string             `json:"user,omitempty"`
+	Metadata           map[string]string  `json:"metadata"`
+}
+
+type ResponseError struct {
+	Code    interface{} `json:"code"`
+	Message string      `json:"message"`
+}
+
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// ResponseItem is an output item, a message or a function call
+type ResponseItem struct {
+	Type      string            `json:"type"`
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	Role      string            `json:"role,omitempty"`
+	Content   []ResponseContent `json:"content,omitempty"`
+	CallID    string            `json:"call_id,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Arguments *string           `json:"arguments,omitempty"`
+}
+
+type ResponseContent struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+type ResponseUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int `json:"total_tokens"`
+}
+
+func newItemID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+// NewResponse returns an in progress response echoing the settings of request
+func NewResponse(request ResponsesRequest, model string) *Response {
+	response := &Response{
+		ID:                newItemID("resp_"),
+		Object:            "response",
+		CreatedAt:         time.Now().Unix(),
+		Status:            "in_progress",
+		MaxOutputTokens:   request.MaxOutputTokens,
+		Model:             model,
+		Output:            []ResponseItem{},
+		ParallelToolCalls: request.ParallelToolCalls == nil || *request.ParallelToolCalls,
+		Store:             request.Store == nil || *request.Store,
+		Temperature:       request.Temperature,
+		ToolChoice:        request.ToolChoice,
+		Tools:             request.Tools,
+		TopP:              request.TopP,
+		User:              request.User,
+		Metadata:          request.Metadata,
+	}
+	if request.Instructions != "" {
+		response.Instructions = &request.Instructions
+	}
+	if request.PreviousResponseID != "" {
+		response.PreviousResponseID = &request.PreviousResponseID
+	}
+	if response.ToolChoice == nil {
+		response.ToolChoice = "auto"
+	}
+	if response.Tools == nil {
+		response.Tools = []ResponseTool{}
+	}
+	if response.Metadata == nil {
+		response.Metadata = map[string]string{}
+	}
+	return response
+}
+
+// NewMessageItem returns an assistant message holding text
+func NewMessageItem(text string, status string) ResponseItem {
+	return ResponseItem{
+		Type:    "message",
+		ID:      newItemID("msg_"),
+		Status:  status,
+		Role:    "assistant",
+		Content: []ResponseContent{{Type: "output_text", Text: text, Annotations: []interface{}{}}},
+	}
+}
+
+// NewFunctionCallItem returns the item of a tool call
+func NewFunctionCallItem(call ToolCall, status string) ResponseItem {
+	arguments := call.Function.Arguments
+	return ResponseItem{
+		Type:      "function_call",
+		ID:        newItemID("fc_"),
+		Status:    status,
+		CallID:    call.ID,
+		Name:      call.Function.Name,
+		Arguments: &arguments,
+	}
+}
+
+// SetUsage sets the token usage of the response
+func (r *Response) SetUsage(input_tokens int, output_tokens int) {
+	r.Usage = &ResponseUsage{InputTokens: input_tokens, OutputTokens: output_tokens, TotalTokens: input_tokens + output_tokens}
+}
+
+// Finish sets the final status, a reply cut by max_output_tokens is incomplete
+func (r *Response) Finish(reason string) {
+	if reason == "length" {
+		r.Status = "incomplete"
+		r.IncompleteDetails = &IncompleteDetails{Reason: "max_output_tokens"}
+		return
+	}
+	r.Status = "completed"
+}
+
+// Fail marks the response failed with err
+func (r *Response) Fail(err *APIError) {
+	r.Status = "failed"
+	r.Error = &ResponseError{Code: err.Code, Message: err.Message}
+	if r.Error.Code == nil {
+		r.Error.Code = "server_error"
+	}
+}
+
+// ResponseEvent is a server-sent event of a streamed response, its type names the event
+type ResponseEvent struct {
+	Type           string           `json:"type"`
+	SequenceNumber int              `json:"sequence_number"`
+	Response       *Response        `json:"response,omitempty"`
+	OutputIndex    *int             `json:"output_index,omitempty"`
+	ContentIndex   *int             `json:"content_index,omitempty"`
+	ItemID         string           `json:"item_id,omitempty"`
+	Item           *ResponseItem    `json:"item,omitempty"`
+	Part           *ResponseContent `json:"part,omitempty"`
+	Delta          *string          `json:"delta,omitempty"`
+	Text           *string          `json:"text,omitempty"`
+	Arguments      *string          `json:"arguments,omitempty"`
+}
+
+func (e ResponseEvent) String() string {
+	data, _ := json.Marshal(e)
+	return "event: " + e.Type + "\ndata: " + string(data) + "\n\n"
+}
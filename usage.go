@@ -0,0 +1,92 @@
+package main
+
+import (
+	"freechatgpt/internal/usage"
+	official_types "freechatgpt/typings/official"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// meter records every finished request of endpoint in the usage store. Handlers report the
+// model, account, tokens and attempts through the context.
+func meter(endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		record := usage.Record{
+			Time:             start.UTC(),
+			Endpoint:         endpoint,
+			Account:          c.GetString("usage_account"),
+			Model:            c.GetString("usage_model"),
+			PromptTokens:     c.GetInt("prompt_tokens"),
+			CompletionTokens: c.GetInt("completion_tokens"),
+			LatencyMs:        time.Since(start).Milliseconds(),
+			Status:           c.Writer.Status(),
+			Attempts:         c.GetInt("attempts"),
+		}
+		if api_key := requestKey(c); api_key != nil {
+			record.Key = api_key.ID
+		}
+		// Errors in a stream leave the status at 200
+		if value, ok := c.Get("error"); ok {
+			record.Status = value.(*official_types.APIError).Status
+		}
+		if record.Attempts == 0 && record.Account != "" {
+			record.Attempts = 1
+		}
+		usage.Add(record)
+	}
+}
+
+// parseUsageTime reads a day, which includes the whole day as the end of a range, or an RFC 3339 time
+func parseUsageTime(value string, fallback time.Time, end bool) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		if end {
+			day = day.Add(24 * time.Hour)
+		}
+		return day, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// usageHandler aggregates the usage records between from and to by the group_by fields
+func usageHandler(c *gin.Context) {
+	now := time.Now().UTC()
+	from, err := parseUsageTime(c.Query("from"), now.Truncate(24*time.Hour).Add(-6*24*time.Hour), false)
+	if err != nil {
+		abortWithError(c, official_types.InvalidRequestError("from", "from must be a day (2006-01-02) or an RFC 3339 time"))
+		return
+	}
+	to, err := parseUsageTime(c.Query("to"), now.Add(time.Second), true)
+	if err != nil {
+		abortWithError(c, official_types.InvalidRequestError("to", "to must be a day (2006-01-02) or an RFC 3339 time"))
+		return
+	}
+	group_by := []string{"day"}
+	if value := c.Query("group_by"); value != "" {
+		group_by = strings.Split(value, ",")
+		for _, field := range group_by {
+			if !containsString(usage.GroupFields, field) {
+				abortWithError(c, official_types.InvalidRequestError("group_by", "group_by takes "+strings.Join(usage.GroupFields, ", ")))
+				return
+			}
+		}
+	}
+	list, err := usage.Query(from, to, group_by)
+	if err != nil {
+		abortWithError(c, official_types.ServerError("Unable to read usage: "+err.Error()))
+		return
+	}
+	c.JSON(200, gin.H{
+		"object":   "list",
+		"from":     from,
+		"to":       to,
+		"group_by": group_by,
+		"data":     list,
+	})
+}
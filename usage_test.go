@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	chatgpt "freechatgpt/internal/chatgpt"
+	"freechatgpt/internal/usage"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	if err := usage.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(usage.Close)
+	chatgpt.SetPlanModels("a", "personal", []chatgpt.ModelInfo{{Slug: "gpt-4o-mini"}})
+	t.Cleanup(func() { chatgpt.RetainPlanModels(map[string]bool{}) })
+	setKeys(t, map[string]*APIKey{"metered": {ID: "metered"}})
+	for _, model := range []string{"gpt-4o-mini", "gpt-4o-mini", "gpt-nonexistent"} {
+		sendWithKey(t, http.MethodPost, "/v1/chat/completions", "Bearer metered", `{"model":"`+model+`","messages":[{"role":"user","content":"Hello"}]}`)
+	}
+	usage.Close()
+	if err := usage.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	list, err := usage.Query(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), []string{"key", "endpoint", "model"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d groups, want 2", len(list))
+	}
+	tests := []struct {
+		model    string
+		requests int
+		errors   int
+		tokens   bool
+	}{
+		{"gpt-4o-mini", 2, 0, true},
+		{"gpt-nonexistent", 1, 1, false},
+	}
+	for i, test := range tests {
+		got := list[i]
+		if got.Key != "metered" || got.Endpoint != "chat" || got.Model != test.model || got.Requests != test.requests || got.Errors != test.errors || (got.TotalTokens > 0) != test.tokens {
+			t.Errorf("group %d is %+v, want %+v", i, got, test)
+		}
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	ADMIN_PASSWORD = "secret"
+	tests := []struct {
+		query  string
+		status int
+		param  string
+	}{
+		{"", 200, ""},
+		{"?from=2024-05-01&to=2024-05-02&group_by=day,model", 200, ""},
+		{"?from=2024-05-01T00:00:00Z", 200, ""},
+		{"?from=yesterday", 400, "from"},
+		{"?to=05/02/2024", 400, "to"},
+		{"?group_by=day,user", 400, "group_by"},
+	}
+	router := newRouter()
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/admin/usage"+test.query, nil)
+			request.Header.Set("Authorization", ADMIN_PASSWORD)
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", recorder.Code, test.status, recorder.Body.String())
+			}
+			var body struct {
+				Data  []usage.Aggregate `json:"data"`
+				Error struct {
+					Param string `json:"param"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Param != test.param {
+				t.Errorf("param %q, want %q", body.Error.Param, test.param)
+			}
+		})
+	}
+}
+
+func TestParseUsageTime(t *testing.T) {
+	fallback := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		end   bool
+		want  time.Time
+	}{
+		{"", false, fallback},
+		{"2024-05-01", false, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		// A day as the end of a range includes the whole day
+		{"2024-05-01", true, time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+		{"2024-05-01T10:30:00Z", true, time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := parseUsageTime(test.value, fallback, test.end)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseUsageTime(%q, %v) = %v, %v, want %v", test.value, test.end, got, err, test.want)
+		}
+	}
+}